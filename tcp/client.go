@@ -0,0 +1,478 @@
+package tcp
+
+import (
+	"context"
+	"crypto/cipher"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Client struct {
+	ServersHost  string           // serversIP:port
+	Conn         *net.TCPConn     // 连接对象
+	name         string           // client的名称
+	connectCode  string           // 连接code 是静态的由server端配发
+	state        int              // 0:未连接   1:连接成功
+	secretKey    string           // 数据传输加密解密秘钥
+	aead         cipher.AEAD      // 数据包加密
+	GetHandle    ClientGetFunc    // get方法
+	NoticeHandle ClientNoticeFunc // 接收通知的方法
+	lock         sync.Mutex       // 保护 Conn, state 以及保证一个帧完整写入
+	backlog      sync.Map         // 积压的数据，只有服务端确认的数据才会被删除
+	backlogCount int              // 积压的数据条数
+	getDataMap   sync.Map         // 等待s端返回的get请求
+	closer       *closer          // 优雅关闭
+}
+
+type ClientConf struct {
+	Name        string
+	ConnectCode string
+	SecretKey   string // 数据传输加密解密秘钥
+}
+
+func SetClientConf(clientName, connectCode, secretKey string) ClientConf {
+	return ClientConf{
+		Name:        clientName,
+		ConnectCode: connectCode,
+		SecretKey:   secretKey,
+	}
+}
+
+func NewClient(host string, conf ...ClientConf) (*Client, error) {
+	c := &Client{
+		ServersHost:  host,
+		state:        0,
+		GetHandle:    make(ClientGetFunc),
+		NoticeHandle: make(ClientNoticeFunc),
+		closer:       newCloser(),
+	}
+	c.DefaultClientName()
+	c.DefaultConnectCode()
+	c.DefaultSecretKey()
+	if len(conf) >= 1 {
+		if len(conf[0].Name) > 0 {
+			if err := c.SetClientName(conf[0].Name); err != nil {
+				return nil, err
+			}
+		}
+		if len(conf[0].ConnectCode) > 0 {
+			c.connectCode = conf[0].ConnectCode
+		}
+		if len(conf[0].SecretKey) > 0 {
+			if err := c.SetSecretKey(conf[0].SecretKey); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// 连接服务器, 失败会在时间轮中重连
+	if err := c.ConnectServers(); err != nil {
+		Error(err)
+	}
+	return c, nil
+}
+
+func (c *Client) SetClientName(name string) error {
+	if strings.IndexAny(name, "@") != -1 {
+		return ErrClientNameErr
+	}
+	if len(name) > 0 && len(name) <= 7 {
+		c.name = name
+		return nil
+	}
+	return ErrNmeLengthAbove
+}
+
+func (c *Client) SetConnectCode(code string) {
+	c.connectCode = code
+}
+
+func (c *Client) SetSecretKey(key string) error {
+	aead, err := NewAEAD(key)
+	if err != nil {
+		return err
+	}
+	c.secretKey = key
+	c.aead = aead
+	return nil
+}
+
+func (c *Client) GetName() string {
+	return c.name
+}
+
+func (c *Client) DefaultClientName() {
+	c.name = DefaultClientName
+}
+
+func (c *Client) DefaultConnectCode() {
+	c.connectCode = DefaultConnectCode
+}
+
+func (c *Client) DefaultSecretKey() {
+	_ = c.SetSecretKey(DefaultSecretKey)
+}
+
+// ConnectServers 建立tcp连接并发送 Connect code, 收到s端回应后连接成功
+func (c *Client) ConnectServers() error {
+	conn, err := net.DialTimeout("tcp", c.ServersHost, ConnectTimeOut*time.Second)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	if c.closer.isClosed() {
+		c.lock.Unlock()
+		_ = conn.Close()
+		return ErrNotConnected
+	}
+	if c.Conn != nil {
+		_ = c.Conn.Close()
+	}
+	c.Conn = conn.(*net.TCPConn)
+	c.state = 0
+	c.lock.Unlock()
+	return c.Write(CommandConnect, []byte(c.connectCode))
+}
+
+// Run 运行客户端, 调用 Shutdown 后返回
+func (c *Client) Run() {
+	// 时间轮,心跳维护，断线重连
+	c.timeWheel()
+
+	for {
+		if c.closer.isClosed() {
+			return
+		}
+		c.lock.Lock()
+		conn := c.Conn
+		c.lock.Unlock()
+		if conn == nil {
+			select {
+			case <-time.After(time.Second):
+			case <-c.closer.closing:
+			}
+			continue
+		}
+		frame, err := ReadFrame(conn)
+		if err != nil {
+			if c.closer.isClosed() {
+				return
+			}
+			Error(err)
+			c.disconnect(conn)
+			continue
+		}
+		packet, err := PacketDecrypt(c.aead, frame)
+		if err != nil {
+			Error("错误的包 err:", err)
+			c.disconnect(conn)
+			continue
+		}
+		if !c.closer.start() {
+			return
+		}
+		go func() {
+			defer c.closer.done()
+			c.handle(packet)
+		}()
+	}
+}
+
+// Shutdown 优雅关闭: 停止接收数据包与心跳, 等待正在执行的处理方法结束后断开连接
+// ctx 超时或取消时不再等待处理方法, 断开连接并返回 ctx.Err(); 未确认的积压数据只保存在内存中
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.closer.close()
+	c.lock.Lock()
+	if c.Conn != nil {
+		// 让阻塞的读取立即返回, 连接保留给处理方法发送应答
+		_ = c.Conn.SetReadDeadline(time.Now())
+	}
+	c.lock.Unlock()
+	err := c.closer.wait(ctx)
+	c.Close()
+	return err
+}
+
+func (c *Client) handle(packet *Packet) {
+	switch packet.Command {
+	// 来自server端的通知消息
+	case CommandNotice:
+		notice := &NoticeData{}
+		bErr := ByteToObj(packet.Data, &notice)
+		if bErr != nil {
+			Error("返回的包解析失败， err = ", bErr)
+			return
+		}
+		// 先应答这个通知，然后处理执行通知
+		ack := &NoticeData{
+			Label:    notice.Label,
+			Id:       notice.Id,
+			Response: []byte("ok"),
+		}
+		b, e := ObjToByte(ack)
+		if e != nil {
+			Error("ObjToByte err = ", e)
+			return
+		}
+		if err := c.Write(CommandNotice, b); err != nil {
+			Error(err)
+		}
+		if fn, ok := c.NoticeHandle[notice.Label]; ok {
+			fn(c, notice.Data)
+		}
+
+	// 来自server端的get请求
+	case CommandGet:
+		getData := &GetData{}
+		bErr := ByteToObj(packet.Data, &getData)
+		if bErr != nil {
+			Error("解析get err :", bErr)
+			return
+		}
+		if fn, ok := c.GetHandle[getData.Label]; ok {
+			code, rse := fn(c, getData.Param)
+			c.ReplyGet(getData.Id, code, rse)
+		}
+
+	case CommandReply:
+		reply := &Reply{}
+		bErr := ByteToObj(packet.Data, &reply)
+		if bErr != nil {
+			Error("返回的包解析失败， err = ", bErr)
+			return
+		}
+		switch CommandCode(reply.Type) {
+		case CommandConnect:
+			if reply.StateCode != 0 {
+				Error("连接失败: ", ErrConnectCode)
+				return
+			}
+			c.lock.Lock()
+			c.state = 1
+			c.lock.Unlock()
+			// 将积压的数据进行发送
+			c.SendBacklog()
+
+		case CommandPut:
+			// 服务端已确认收到删除对应的数据
+			c.backlogDel(reply.CtxId)
+
+		case CommandGet:
+			if v, ok := c.getDataMap.Load(reply.CtxId); ok {
+				getData := v.(*GetData)
+				getData.Response = reply.Data
+				getData.done()
+			}
+		}
+	}
+}
+
+// disconnect 关闭异常的连接，等待时间轮重连
+func (c *Client) disconnect(conn *net.TCPConn) {
+	_ = conn.Close()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.Conn == conn {
+		c.Conn = nil
+		c.state = 0
+	}
+}
+
+func (c *Client) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.Conn == nil {
+		return
+	}
+	err := c.Conn.Close()
+	if err != nil {
+		Error(err.Error())
+	}
+	c.Conn = nil
+	c.state = 0
+}
+
+// Write 封包并发送
+func (c *Client) Write(cmd CommandCode, data []byte) error {
+	frame, err := PacketEncoder(cmd, c.name, c.aead, data)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.Conn == nil {
+		return ErrNotConnected
+	}
+	_, err = c.Conn.Write(frame)
+	return err
+}
+
+func (c *Client) connected() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.state == 1
+}
+
+// Put client put
+// 向服务端发送数据，如果服务端未在线数据会被积压，等重新连接后积压数据会一并发送
+func (c *Client) Put(funcLabel string, data []byte) {
+	putData := PutData{
+		Label: funcLabel,
+		Id:    id(),
+		Body:  data,
+	}
+	// 数据被积压，占时保存
+	c.backlogAdd(putData)
+	// 未与servers端确认连接，不发送数据
+	if !c.connected() {
+		return
+	}
+	b, err := ObjToByte(putData)
+	if err != nil {
+		Error("ObjToByte err = ", err)
+		return
+	}
+	if err = c.Write(CommandPut, b); err != nil {
+		Error(err)
+	}
+}
+
+func (c *Client) Get(funcLabel string, param []byte) ([]byte, error) {
+	return c.get(DefaultSGetTimeOut, funcLabel, param)
+}
+
+func (c *Client) GetTimeOut(funcLabel string, param []byte, timeOut int) ([]byte, error) {
+	return c.get(timeOut, funcLabel, param)
+}
+
+// 向服务端获取数据，指定一个超时时间，未应答就超时
+func (c *Client) get(timeOut int, funcLabel string, param []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*time.Duration(timeOut))
+	defer cancel()
+	res, err := c.GetContext(ctx, funcLabel, param)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, ErrSGetTimeOut(funcLabel, "servers", c.ServersHost)
+	}
+	return res, err
+}
+
+// GetContext 向服务端获取数据，ctx 取消或超时立即返回 ctx.Err() 包装的错误
+func (c *Client) GetContext(ctx context.Context, funcLabel string, param []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, ErrSGetCanceled(funcLabel, "servers", c.ServersHost, err)
+	}
+	getData := &GetData{
+		Label:    funcLabel,
+		Id:       id(),
+		Param:    param,
+		ctxChan:  make(chan bool, 1),
+		Response: make([]byte, 0),
+	}
+	c.getDataMap.Store(getData.Id, getData)
+	defer c.getDataMap.Delete(getData.Id)
+	b, err := ObjToByte(getData)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.Write(CommandGet, b); err != nil {
+		return nil, err
+	}
+	select {
+	case <-getData.ctxChan:
+		return getData.Response, nil
+	case <-ctx.Done():
+		return nil, ErrSGetCanceled(funcLabel, "servers", c.ServersHost, ctx.Err())
+	}
+}
+
+// ReplyGet 返回get  state:0x0 成功  state:2 业务层面的失败
+func (c *Client) ReplyGet(id int64, state int, data []byte) {
+	reply := &Reply{
+		Type:      int(CommandGet),
+		CtxId:     id,
+		Data:      data,
+		StateCode: state,
+	}
+	b, e := ObjToByte(reply)
+	if e != nil {
+		Error("打包数据失败, e= ", e)
+		return
+	}
+	if err := c.Write(CommandReply, b); err != nil {
+		Error(err)
+	}
+}
+
+func (c *Client) GetHandleFunc(label string, f func(c *Client, param []byte) (int, []byte)) {
+	c.GetHandle[label] = f
+}
+
+func (c *Client) NoticeHandleFunc(label string, f func(c *Client, data []byte)) {
+	c.NoticeHandle[label] = f
+}
+
+// 时间轮，持续制定时间发送心跳包, 连接断开时重新连接
+func (c *Client) timeWheel() {
+	go func() {
+		tTime := time.Duration(HeartbeatTime) // 时间轮5秒
+		for {
+			timer := time.NewTimer(tTime * time.Second)
+			select {
+			case <-timer.C:
+			case <-c.closer.closing:
+				timer.Stop()
+				return
+			}
+			c.lock.Lock()
+			conn := c.Conn
+			c.lock.Unlock()
+			if conn == nil {
+				if err := c.ConnectServers(); err != nil {
+					Error("重连服务器失败 err: ", err)
+				}
+				continue
+			}
+			if err := c.Write(CommandHeartbeat, []byte(c.connectCode)); err != nil {
+				Error(err)
+				c.disconnect(conn)
+			}
+		}
+	}()
+}
+
+func (c *Client) backlogAdd(putData PutData) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.backlogCount >= BacklogMax {
+		Error("积压数据超过上限，丢弃 id: ", putData.Id)
+		return
+	}
+	c.backlogCount++
+	c.backlog.Store(putData.Id, putData)
+}
+
+func (c *Client) backlogDel(putId int64) {
+	if _, ok := c.backlog.LoadAndDelete(putId); ok {
+		c.lock.Lock()
+		c.backlogCount--
+		c.lock.Unlock()
+	}
+}
+
+// SendBacklog 发送积压的数据
+func (c *Client) SendBacklog() {
+	c.backlog.Range(func(key, value any) bool {
+		b, err := ObjToByte(value.(PutData))
+		if err != nil {
+			Error("ObjToByte err = ", err)
+			return true
+		}
+		if err = c.Write(CommandPut, b); err != nil {
+			Error(err)
+			return false
+		}
+		return true
+	})
+}
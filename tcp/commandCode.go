@@ -0,0 +1,22 @@
+package tcp
+
+// 指令使用1个字节, 与udp保持一致
+
+type CommandCode uint8
+
+const (
+	CommandConnect   CommandCode = 0x0 // 首次连接确认身份信息
+	CommandPut       CommandCode = 0x1 // 发送消息
+	CommandReply     CommandCode = 0x2 // 收到回应， ackType: connect, heartbeat, put, get
+	CommandHeartbeat CommandCode = 0x3 // 发送心跳
+	CommandNotice    CommandCode = 0x4 // 通知
+	CommandGet       CommandCode = 0x5 // 获取消息
+)
+
+// 连接逻辑
+// 1. c: 建立tcp连接后首个包必须是 CommandConnect, 内容为连接code
+// 2. s: 验证连接code, 失败回应 StateCode:1 并断开连接
+// 3. s: 成功回应 CommandReply(CommandConnect), 之后该连接上的包都被信任
+// 4. c: 收到回应后发送积压的数据
+// 5. c: 每 HeartbeatTime 秒发送心跳, s端超过 HeartbeatTimeLast 秒未收到任何包则断开连接
+// 6. c: 连接断开后在心跳时间轮中重新连接
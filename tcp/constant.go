@@ -0,0 +1,57 @@
+package tcp
+
+import (
+	"fmt"
+)
+
+const (
+	DefaultConnectCode      = "c"
+	DefaultServersName      = "servers"
+	DefaultClientName       = "client"
+	DefaultSecretKey        = "12345678"
+	DefaultSGetTimeOut      = 1000     // 单位 ms
+	DefaultNoticeMaxRetry   = 10       // 通知消息最大重试次数
+	DefaultNoticeRetryTimer = 100      // 重试等待时间 单位ms
+	HeartbeatTime           = 5        // 5s
+	HeartbeatTimeLast       = 15       // 15s 超过该时间未收到任何包视为离线
+	ServersTimeWheel        = 2        // 2s servers 时间轮
+	ConnectTimeOut          = 5        // 5s 建立连接后发送连接包的超时时间
+	MaxFrameSize            = 16 << 20 // 单个数据帧的最大字节
+	BacklogMax              = 10000    // 内存中最大积压数据包条数
+)
+
+const (
+	MaxConnectFrameSize = 4 << 10 // 连接包被接受之前单个数据帧的最大字节
+	WriteTimeOut        = 5       // 5s s端写数据的超时时间
+)
+
+// err
+var (
+	ErrNmeLengthAbove = fmt.Errorf("名字不能超过7个长度")
+	ErrNonePacket     = fmt.Errorf("空包")
+	ErrFrameTooLarge  = fmt.Errorf("数据帧大于 %d 个字节", MaxFrameSize)
+	ErrDecrypt        = fmt.Errorf("解密数据失败")
+	ErrConnectFrame   = fmt.Errorf("连接包大于 %d 个字节", MaxConnectFrameSize)
+	ErrSecretKeyEmpty = fmt.Errorf("秘钥不能为空，并且与Client端统一")
+	ErrConnectCode    = fmt.Errorf("连接code不正确")
+	ErrNotConnected   = fmt.Errorf("未与服务端建立连接")
+	ErrSGetTimeOut    = func(label, name, ip string) error {
+		return fmt.Errorf("请求客户端 FuncLabel:%s | name:%s | IP:%s 超时", label, name, ip)
+	}
+	ErrSGetCanceled = func(label, name, ip string, err error) error {
+		return fmt.Errorf("请求客户端 FuncLabel:%s | name:%s | IP:%s 取消: %w", label, name, ip, err)
+	}
+	ErrNoticeCanceled = func(name, label string, err error) error {
+		return fmt.Errorf("通知客户端 name:%s | label:%s 取消: %w", name, label, err)
+	}
+	ErrNotFondClient = func(name string) error {
+		return fmt.Errorf("未找到客户端 name:%s ", name)
+	}
+	PanicGetHandleFuncExist = func(label string) {
+		panic(fmt.Sprintf("get handle func label:%s is exist.", label))
+	}
+	PanicPutHandleFuncExist = func(label string) {
+		panic(fmt.Sprintf("put handle func label:%s is exist.", label))
+	}
+	ErrClientNameErr = fmt.Errorf("client name 不能含特殊字符 @")
+)
@@ -0,0 +1,3 @@
+module github.com/mangenotwork/beacon-tower/tcp
+
+go 1.19
@@ -0,0 +1,176 @@
+package tcp
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+)
+
+/*
+
+Frame 帧设计, tcp是字节流，使用长度前缀划分数据包
+_______________________________________________________________
+|                |             |              |               |
+| 长度(4字节)     | 指令(1字节)  |  name(7字节)  |   data...     |
+|________________|_____________|______________|_______________|
+
+长度: 指令+name+data 的字节数, 大端序, 不能超过 MaxFrameSize, 连接包不能超过 MaxConnectFrameSize
+指令: 与udp一致 Connect,Put,Reply,Heartbeat,Notice,Get
+name: s端指定name下发，name对应多个连接
+data: nonce(12字节) + 密文, 使用 AES-256-GCM 加密, 指令与name作为附加认证数据
+
+封包 : 装载数据 -> 压缩 -> 加密 -> 长度前缀
+解包 : 读长度 -> 读帧 -> 解密 -> 解压 -> 匹配指令
+
+连接认证在建立连接时完成，之后同一连接上的包不再需要签名
+
+*/
+
+const headSize = 8
+
+type Packet struct {
+	Command CommandCode
+	Name    string
+	Data    []byte
+}
+
+// NewAEAD 由秘钥派生 AES-256-GCM
+func NewAEAD(secretKey string) (cipher.AEAD, error) {
+	if len(secretKey) < 1 {
+		return nil, ErrSecretKeyEmpty
+	}
+	key := sha256.Sum256([]byte("beacon-tower/tcp:" + secretKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// PacketEncoder 封包, 返回包含长度前缀的完整帧
+func PacketEncoder(cmd CommandCode, name string, aead cipher.AEAD, data []byte) ([]byte, error) {
+	ln := len(name)
+	if ln > 7 {
+		return nil, ErrNmeLengthAbove
+	}
+	head := make([]byte, headSize)
+	head[0] = byte(cmd)
+	copy(head[1:], formatName(name))
+	if ln == 0 {
+		copy(head[1:], "0000000")
+	}
+	// 压缩数据
+	dCompress := ZlibCompress(data)
+	// 加密数据, 包头作为附加认证数据
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	dEncrypt := aead.Seal(nonce, nonce, dCompress, head)
+
+	size := headSize + len(dEncrypt)
+	if size > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 4+size))
+	_ = binary.Write(buf, binary.BigEndian, uint32(size))
+	buf.Write(head)
+	buf.Write(dEncrypt)
+	return buf.Bytes(), nil
+}
+
+// ReadFrame 读取一个帧，不含长度前缀
+func ReadFrame(r io.Reader) ([]byte, error) {
+	return readFrame(r, MaxFrameSize, ErrFrameTooLarge)
+}
+
+// ReadConnectFrame 读取连接包, 对端未认证前只允许小帧, 避免按长度前缀分配大块内存
+func ReadConnectFrame(r io.Reader) ([]byte, error) {
+	return readFrame(r, MaxConnectFrameSize, ErrConnectFrame)
+}
+
+func readFrame(r io.Reader, max uint32, errTooLarge error) ([]byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if size > max {
+		return nil, errTooLarge
+	}
+	if size < headSize {
+		return nil, ErrNonePacket
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// PacketDecrypt 解包
+func PacketDecrypt(aead cipher.AEAD, frame []byte) (*Packet, error) {
+	if len(frame) < headSize+aead.NonceSize()+aead.Overhead() {
+		return nil, ErrNonePacket
+	}
+	head := frame[:headSize]
+	b := frame[headSize:]
+	// 解密数据
+	bDecrypt, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], head)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	// 解压数据
+	bDecompress, err := ZlibDecompress(bDecrypt)
+	if err != nil {
+		Error("解压数据失败 err: ", err)
+		return nil, err
+	}
+	return &Packet{
+		Command: CommandCode(head[0]),
+		Name:    string(head[1:headSize]),
+		Data:    bDecompress,
+	}, nil
+}
+
+func ObjToByte(obj interface{}) ([]byte, error) {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return []byte(""), err
+	}
+	return b, nil
+}
+
+func ByteToObj(data []byte, obj interface{}) error {
+	return json.Unmarshal(data, obj)
+}
+
+// ZlibCompress zlib压缩
+func ZlibCompress(src []byte) []byte {
+	buf := new(bytes.Buffer)
+	writer := zlib.NewWriter(buf)
+	_, err := writer.Write(src)
+	err = writer.Close()
+	if err != nil {
+		Error(err)
+	}
+	return buf.Bytes()
+}
+
+// ZlibDecompress zlib解压
+func ZlibDecompress(src []byte) ([]byte, error) {
+	reader := bytes.NewReader(src)
+	gr, err := zlib.NewReader(reader)
+	if err != nil {
+		return []byte(""), err
+	}
+	buf := new(bytes.Buffer)
+	_, err = io.Copy(buf, gr)
+	err = gr.Close()
+	return buf.Bytes(), err
+}
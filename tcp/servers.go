@@ -0,0 +1,657 @@
+package tcp
+
+import (
+	"context"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+type Servers struct {
+	Addr        string                                  // 地址 默认0.0.0.0
+	Port        int                                     // 端口
+	Listener    *net.TCPListener                        // S端的监听对象
+	name        string                                  // servers端的名称
+	CMap        map[string]map[string]*ClientConnectObj // 存放客户端连接信息  map:name -> map:ipaddr -> obj
+	connectCode string                                  // 连接code 是静态的由server端配发
+	secretKey   string                                  // 数据传输加密解密秘钥
+	aead        cipher.AEAD                             // 数据包加密
+	PutHandle   ServersPutFunc                          // PUT类型方法
+	GetHandle   ServersGetFunc                          // GET类型方法
+	onLineTable map[string]*ClientConnInfo              // c端的在线表 key= name+ip
+	lock        sync.RWMutex                            // 保护 CMap, onLineTable
+	getDataMap  sync.Map                                // 等待c端返回的get请求
+	noticeMap   sync.Map                                // 等待c端确认的通知
+	closer      *closer                                 // 优雅关闭
+}
+
+type ClientConnInfo struct {
+	Name        string // 客户端名称
+	Online      bool   // 是否存活
+	IP          string // 连接的地址 ip
+	Addr        string // 连接的地址 ip+port
+	LastTime    int64  // 最后一次确认数据包加入存活的时间
+	DiscardTime int64  // 记录断开的时间
+}
+
+type ServersConf struct {
+	Name        string // servers端的名称
+	ConnectCode string // 连接code 是静态的由server端配发
+	SecretKey   string // 数据传输加密解密秘钥
+}
+
+func SetServersConf(serversName, connectCode, secretKey string) ServersConf {
+	return ServersConf{
+		Name:        serversName,
+		ConnectCode: connectCode,
+		SecretKey:   secretKey,
+	}
+}
+
+func NewServers(addr string, port int, conf ...ServersConf) (*Servers, error) {
+	var err error
+	if len(addr) < 1 {
+		addr = "0.0.0.0"
+	}
+	s := &Servers{
+		Addr:        addr,
+		Port:        port,
+		CMap:        make(map[string]map[string]*ClientConnectObj),
+		PutHandle:   make(ServersPutFunc),
+		GetHandle:   make(ServersGetFunc),
+		onLineTable: make(map[string]*ClientConnInfo),
+		closer:      newCloser(),
+	}
+	s.DefaultServersName()
+	s.DefaultConnectCode()
+	s.DefaultSecretKey()
+	if len(conf) >= 1 {
+		if len(conf[0].Name) > 7 {
+			return nil, ErrNmeLengthAbove
+		}
+		if len(conf[0].Name) > 0 {
+			s.name = conf[0].Name
+		}
+		if len(conf[0].ConnectCode) > 0 {
+			s.connectCode = conf[0].ConnectCode
+		}
+		if err = s.SetSecretKey(conf[0].SecretKey); err != nil {
+			return nil, err
+		}
+	}
+	s.Listener, err = net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(s.Addr), Port: s.Port})
+	if err != nil {
+		Error(err)
+		return nil, err
+	}
+	InfoF("tcp server 启动成功 -->  name:%s |  addr: %s  | conn_code: %s \n",
+		s.name, s.Listener.Addr().String(), s.connectCode)
+	return s, nil
+}
+
+func (s *Servers) SetServersName(name string) error {
+	if len(name) > 0 && len(name) <= 7 {
+		s.name = name
+		return nil
+	}
+	return ErrNmeLengthAbove
+}
+
+func (s *Servers) SetConnectCode(code string) {
+	s.connectCode = code
+}
+
+func (s *Servers) SetSecretKey(key string) error {
+	aead, err := NewAEAD(key)
+	if err != nil {
+		return err
+	}
+	s.secretKey = key
+	s.aead = aead
+	return nil
+}
+
+func (s *Servers) DefaultServersName() {
+	s.name = DefaultServersName
+}
+
+func (s *Servers) DefaultConnectCode() {
+	s.connectCode = DefaultConnectCode
+}
+
+func (s *Servers) DefaultSecretKey() {
+	_ = s.SetSecretKey(DefaultSecretKey)
+}
+
+func (s *Servers) GetServersName() string {
+	return s.name
+}
+
+func (s *Servers) PutHandleFunc(label string, f func(s *Servers, c *ClientInfo, body []byte)) {
+	if _, ok := s.PutHandle[label]; ok {
+		PanicPutHandleFuncExist(label)
+	}
+	s.PutHandle[label] = f
+}
+
+func (s *Servers) GetHandleFunc(label string, f func(s *Servers, param []byte) (int, []byte)) {
+	if _, ok := s.GetHandle[label]; ok {
+		PanicGetHandleFuncExist(label)
+	}
+	s.GetHandle[label] = f
+}
+
+// Run 接收并处理连接, 调用 Shutdown 后返回
+func (s *Servers) Run() {
+
+	// 启动一个时间轮维护c端的连接
+	s.timeWheel()
+
+	for {
+		conn, err := s.Listener.AcceptTCP()
+		if err != nil {
+			if s.closer.isClosed() {
+				return
+			}
+			Error(err)
+			continue
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn 处理一个tcp连接, 首个包必须是连接包
+func (s *Servers) serveConn(conn *net.TCPConn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetReadDeadline(time.Now().Add(ConnectTimeOut * time.Second))
+	frame, err := ReadConnectFrame(conn)
+	if err != nil {
+		Error("读取连接包失败 err:", err)
+		return
+	}
+	packet, err := PacketDecrypt(s.aead, frame)
+	if err != nil {
+		Error("错误的包 err:", err)
+		return
+	}
+	client := &ClientConnectObj{
+		Name: packet.Name,
+		IP:   conn.RemoteAddr().(*net.TCPAddr).IP.String(),
+		Addr: conn.RemoteAddr().(*net.TCPAddr),
+		Conn: conn,
+	}
+	if packet.Command != CommandConnect || string(packet.Data) != s.connectCode {
+		Error("未知客户端，连接code不正确...")
+		s.reply(client, CommandConnect, 0, 1, nil)
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	s.clientJoin(client)
+	defer s.clientLeave(client)
+	s.reply(client, CommandConnect, 0, 0, nil)
+
+	for {
+		frame, err = ReadFrame(conn)
+		if err != nil {
+			if err != io.EOF {
+				Error(err)
+			}
+			return
+		}
+		packet, err = PacketDecrypt(s.aead, frame)
+		if err != nil {
+			Error("错误的包 err:", err)
+			return
+		}
+		s.clientActive(client)
+		if !s.closer.start() {
+			return
+		}
+		go func(packet *Packet, size int) {
+			defer s.closer.done()
+			s.handle(client, packet, size)
+		}(packet, len(frame))
+	}
+}
+
+func (s *Servers) handle(client *ClientConnectObj, packet *Packet, size int) {
+	switch packet.Command {
+	case CommandHeartbeat:
+		s.reply(client, CommandHeartbeat, 0, 0, nil)
+
+	case CommandPut:
+		putData := &PutData{}
+		bErr := ByteToObj(packet.Data, &putData)
+		if bErr != nil {
+			Error("解析put err :", bErr)
+			return
+		}
+		if fn, ok := s.PutHandle[putData.Label]; ok {
+			cInfo := &ClientInfo{
+				Name:        client.Name,
+				Addr:        client.Addr,
+				Interactive: time.Now().Unix(),
+				PacketSize:  size,
+			}
+			fn(s, cInfo, putData.Body)
+		}
+		s.reply(client, CommandPut, putData.Id, 0, nil)
+
+	case CommandGet:
+		getData := &GetData{}
+		boErr := ByteToObj(packet.Data, &getData)
+		if boErr != nil {
+			Error("解析get err :", boErr)
+			return
+		}
+		if fn, ok := s.GetHandle[getData.Label]; ok {
+			code, rse := fn(s, getData.Param)
+			s.reply(client, CommandGet, getData.Id, code, rse)
+		}
+
+	case CommandNotice:
+		notice := &NoticeData{}
+		bErr := ByteToObj(packet.Data, &notice)
+		if bErr != nil {
+			Error("返回的包解析失败， err = ", bErr)
+			return
+		}
+		if v, ok := s.noticeMap.Load(notice.Id); ok {
+			v.(*NoticeData).done()
+		}
+
+	case CommandReply:
+		reply := &Reply{}
+		bErr := ByteToObj(packet.Data, &reply)
+		if bErr != nil {
+			Error("返回的包解析失败， err = ", bErr)
+			return
+		}
+		switch CommandCode(reply.Type) {
+		case CommandGet:
+			if v, ok := s.getDataMap.Load(reply.CtxId); ok {
+				getData := v.(*GetData)
+				getData.Response = reply.Data
+				getData.done()
+			}
+		}
+
+	default:
+		// 未知包丢弃
+		Error("未知包!!!")
+	}
+}
+
+func (s *Servers) Write(client *ClientConnectObj, cmd CommandCode, data []byte) {
+	frame, err := PacketEncoder(cmd, s.name, s.aead, data)
+	if err != nil {
+		Error(err)
+		return
+	}
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	// 写超时, 对端不读数据时不会一直阻塞持锁
+	_ = client.Conn.SetWriteDeadline(time.Now().Add(WriteTimeOut * time.Second))
+	_, err = client.Conn.Write(frame)
+	if err != nil {
+		Error(err.Error())
+		// 帧可能只写了一部分, 字节流已不可用, 断开让c端重连
+		_ = client.Conn.Close()
+	}
+}
+
+type Reply struct {
+	Type      int
+	CtxId     int64 // 数据包上下文的交互id
+	Data      []byte
+	StateCode int // 状态码  0:成功  1:认证失败  2:自定义错误
+}
+
+func (s *Servers) reply(client *ClientConnectObj, cmd CommandCode, id int64, state int, data []byte) {
+	reply := &Reply{
+		Type:      int(cmd),
+		CtxId:     id,
+		Data:      data,
+		StateCode: state,
+	}
+	b, e := ObjToByte(reply)
+	if e != nil {
+		Error("打包数据失败, e= ", e)
+		return
+	}
+	s.Write(client, CommandReply, b)
+}
+
+func (s *Servers) Get(funcLabel, name string, param []byte) ([]byte, error) {
+	return s.GetAtNameTimeOut(DefaultSGetTimeOut, funcLabel, name, param)
+}
+
+func (s *Servers) GetAtNameTimeOut(timeOut int, funcLabel, name string, param []byte) ([]byte, error) {
+	return s.get(timeOut, funcLabel, name, "", param)
+}
+
+func (s *Servers) GetAtIP(funcLabel, name, ip string, param []byte) ([]byte, error) {
+	return s.get(DefaultSGetTimeOut, funcLabel, name, ip, param)
+}
+
+func (s *Servers) GetAtIPTimeOut(timeOut int, funcLabel, name, ip string, param []byte) ([]byte, error) {
+	return s.get(timeOut, funcLabel, name, ip, param)
+}
+
+func (s *Servers) get(timeOut int, funcLabel, name, ip string, param []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*time.Duration(timeOut))
+	defer cancel()
+	res, err := s.GetAtIPContext(ctx, funcLabel, name, ip, param)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, ErrSGetTimeOut(funcLabel, name, ip)
+	}
+	return res, err
+}
+
+// GetContext 同 Get, 由 ctx 控制超时与取消
+func (s *Servers) GetContext(ctx context.Context, funcLabel, name string, param []byte) ([]byte, error) {
+	return s.GetAtIPContext(ctx, funcLabel, name, "", param)
+}
+
+// GetAtIPContext  向指定 client获取数据，  针对name,ip, 获取指定name或ip Client的数据
+// ctx 取消或超时立即返回 ctx.Err() 包装的错误
+func (s *Servers) GetAtIPContext(ctx context.Context, funcLabel, name, ip string, param []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, ErrSGetCanceled(funcLabel, name, ip, err)
+	}
+	c, ok := s.GetClientConnFromIP(name, ip)
+	if !ok {
+		return nil, ErrNotFondClient(name)
+	}
+	getData := &GetData{
+		Label:    funcLabel,
+		Id:       id(),
+		Param:    param,
+		ctxChan:  make(chan bool, 1),
+		Response: make([]byte, 0),
+	}
+	s.getDataMap.Store(getData.Id, getData)
+	defer s.getDataMap.Delete(getData.Id)
+	b, err := ObjToByte(getData)
+	if err != nil {
+		return nil, err
+	}
+	s.Write(c, CommandGet, b)
+	select {
+	case <-getData.ctxChan:
+		return getData.Response, nil
+	case <-ctx.Done():
+		return nil, ErrSGetCanceled(funcLabel, name, ip, ctx.Err())
+	}
+}
+
+type NoticeRetry struct {
+	TimeOutTimer time.Duration // 通知消息超时时间 10s > 重试*重试时间
+	MaxRetry     int           // 通知消息最大重试次数
+	RetryTimer   time.Duration // 重试等待时间
+}
+
+// SetNoticeRetry retryTimer 单位ms
+func (s *Servers) SetNoticeRetry(maxRetry, retryTimer int) *NoticeRetry {
+	return &NoticeRetry{
+		MaxRetry:     maxRetry,
+		RetryTimer:   time.Millisecond * time.Duration(retryTimer),
+		TimeOutTimer: time.Millisecond * time.Duration((maxRetry+1)*retryTimer),
+	}
+}
+
+func (s *Servers) NoticeAll(label string, data []byte, retryConf *NoticeRetry) {
+	for _, name := range s.GetClientAllName() {
+		_, err := s.Notice(name, label, data, retryConf)
+		if err != nil {
+			Error(err)
+		}
+	}
+}
+
+// Notice  通知方法:针对 name,对Client发送通知
+// 特点: 1. 重试次数 2. 指定时间内重试, tcp连接断开重连后也能收到重试的通知
+func (s *Servers) Notice(name, label string, data []byte, retryConf *NoticeRetry) (string, error) {
+	return s.NoticeContext(context.Background(), name, label, data, retryConf)
+}
+
+// NoticeContext 同 Notice, ctx 取消或超时停止重试并返回 ctx.Err() 包装的错误
+func (s *Servers) NoticeContext(ctx context.Context, name, label string, data []byte, retryConf *NoticeRetry) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "通知已取消", ErrNoticeCanceled(name, label, err)
+	}
+	if name == "" {
+		name = DefaultClientName
+	}
+	if retryConf == nil {
+		retryConf = s.SetNoticeRetry(DefaultNoticeMaxRetry, DefaultNoticeRetryTimer)
+	}
+	if _, ok := s.GetClientConn(name); !ok {
+		return "未找到客户端", ErrNotFondClient(name)
+	}
+	noticeData := &NoticeData{
+		Label:   label,
+		Id:      id(),
+		Data:    data,
+		ctxChan: make(chan bool, 1),
+	}
+	s.noticeMap.Store(noticeData.Id, noticeData)
+	defer s.noticeMap.Delete(noticeData.Id)
+	b, err := ObjToByte(noticeData)
+	if err != nil {
+		return "", err
+	}
+	timeout := time.NewTimer(retryConf.TimeOutTimer)
+	defer timeout.Stop()
+	for retry := 0; retry <= retryConf.MaxRetry; retry++ {
+		// 每次重试重新获取连接, 客户端可能已经重连
+		client, ok := s.GetClientConn(name)
+		if ok {
+			for _, c := range client {
+				s.Write(c, CommandNotice, b)
+			}
+		}
+		timer := time.NewTimer(retryConf.RetryTimer)
+		select {
+		case <-noticeData.ctxChan:
+			timer.Stop()
+			return "通知下发完成", nil
+		case <-timeout.C:
+			timer.Stop()
+			return "通知超时，客户端未收到通知", fmt.Errorf("通知超时，客户端未收到通知")
+		case <-ctx.Done():
+			timer.Stop()
+			return "通知已取消", ErrNoticeCanceled(name, label, ctx.Err())
+		case <-timer.C:
+		}
+	}
+	return "重试次数完，还有客户端未收到通知", fmt.Errorf("重试次数完，还有客户端未收到通知")
+}
+
+func (s *Servers) clientJoin(client *ClientConnectObj) {
+	client.Last = time.Now().Unix()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.CMap[client.Name]; !ok {
+		s.CMap[client.Name] = make(map[string]*ClientConnectObj)
+	}
+	s.CMap[client.Name][client.Addr.String()] = client
+	s.onLineTable[fmt.Sprintf("%s@%s", client.Name, client.IP)] = &ClientConnInfo{
+		Name:        client.Name,
+		Online:      true,
+		IP:          client.IP,
+		Addr:        client.Addr.String(),
+		LastTime:    client.Last,
+		DiscardTime: 0,
+	}
+}
+
+// clientActive 收到包，更新最后活跃时间
+func (s *Servers) clientActive(client *ClientConnectObj) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	client.Last = time.Now().Unix()
+	if info, ok := s.onLineTable[fmt.Sprintf("%s@%s", client.Name, client.IP)]; ok {
+		info.LastTime = client.Last
+	}
+}
+
+// clientLeave 连接断开，从连接表移除
+func (s *Servers) clientLeave(client *ClientConnectObj) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if v, ok := s.CMap[client.Name]; ok {
+		if v[client.Addr.String()] == client {
+			delete(v, client.Addr.String())
+		}
+		if len(v) == 0 {
+			delete(s.CMap, client.Name)
+		}
+	}
+	if info, ok := s.onLineTable[fmt.Sprintf("%s@%s", client.Name, client.IP)]; ok && info.Addr == client.Addr.String() {
+		info.Online = false
+		info.DiscardTime = time.Now().Unix()
+	}
+}
+
+// ClientDiscard 断开指定name, ip的客户端连接, ip为空时断开该name下所有连接
+func (s *Servers) ClientDiscard(name, ip string) {
+	if name == "" {
+		name = DefaultClientName
+	}
+	name = formatName(name)
+	s.lock.RLock()
+	conns := make([]*ClientConnectObj, 0)
+	for _, c := range s.CMap[name] {
+		if ip == "" || c.IP == ip {
+			conns = append(conns, c)
+		}
+	}
+	s.lock.RUnlock()
+	for _, c := range conns {
+		_ = c.Conn.Close()
+	}
+}
+
+func (s *Servers) GetClientAllName() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	nameList := make([]string, 0, len(s.CMap))
+	for name := range s.CMap {
+		nameList = append(nameList, name)
+	}
+	return nameList
+}
+
+// GetClientConn 获取name下的所有连接，返回的是副本
+func (s *Servers) GetClientConn(name string) (map[string]*ClientConnectObj, bool) {
+	if name == "" {
+		name = DefaultClientName
+	}
+	name = formatName(name)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	v, ok := s.CMap[name]
+	if !ok || len(v) == 0 {
+		return nil, false
+	}
+	list := make(map[string]*ClientConnectObj, len(v))
+	for k, c := range v {
+		list[k] = c
+	}
+	return list, true
+}
+
+func (s *Servers) GetClientConnFromIP(name, ip string) (*ClientConnectObj, bool) {
+	if list, ok := s.GetClientConn(name); ok {
+		for _, c := range list {
+			if ip == "" { // 如果未指定IP 则取 name下的随机一个IP
+				return c, true
+			}
+			if c.IP == ip {
+				return c, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// timeWheel 时间轮, 断开超过 HeartbeatTimeLast 未活跃的连接
+func (s *Servers) timeWheel() {
+	go func() {
+		tTime := time.Duration(ServersTimeWheel)
+		for {
+			timer := time.NewTimer(tTime * time.Second)
+			select {
+			case <-timer.C:
+			case <-s.closer.closing:
+				timer.Stop()
+				return
+			}
+			t := time.Now().Unix()
+			s.lock.RLock()
+			idle := make([]*ClientConnectObj, 0)
+			for _, v := range s.CMap {
+				for _, c := range v {
+					if t-c.Last > HeartbeatTimeLast {
+						idle = append(idle, c)
+					}
+				}
+			}
+			s.lock.RUnlock()
+			for _, c := range idle {
+				InfoF("离线客户端名称:%s IP地址:%s  当前t=%d last=%d", c.Name, c.IP, t, c.Last)
+				_ = c.Conn.Close()
+			}
+		}
+	}()
+}
+
+// Shutdown 优雅关闭: 停止接收新连接与时间轮, 等待正在执行的处理方法结束后断开所有连接
+// ctx 超时或取消时不再等待处理方法, 断开所有连接并返回 ctx.Err()
+func (s *Servers) Shutdown(ctx context.Context) error {
+	s.closer.close()
+	err := s.Listener.Close()
+	if wErr := s.closer.wait(ctx); wErr != nil {
+		err = wErr
+	}
+	s.lock.RLock()
+	conns := make([]*ClientConnectObj, 0)
+	for _, v := range s.CMap {
+		for _, c := range v {
+			conns = append(conns, c)
+		}
+	}
+	s.lock.RUnlock()
+	for _, c := range conns {
+		_ = c.Conn.Close()
+	}
+	return err
+}
+
+// OnLineTable 获取当前客户端连接情况, 返回的是副本
+func (s *Servers) OnLineTable() map[string]*ClientConnInfo {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	table := make(map[string]*ClientConnInfo, len(s.onLineTable))
+	for k, v := range s.onLineTable {
+		info := *v
+		table[k] = &info
+	}
+	return table
+}
+
+type ClientConnectObj struct {
+	Name string
+	IP   string
+	Addr *net.TCPAddr
+	Conn *net.TCPConn
+	Last int64      // 最后一次收到包的时间
+	lock sync.Mutex // 保证一个帧完整写入
+}
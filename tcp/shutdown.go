@@ -0,0 +1,68 @@
+package tcp
+
+import (
+	"context"
+	"sync"
+)
+
+// closer 优雅关闭: 关闭信号 + 登记正在执行的处理方法
+type closer struct {
+	lock     sync.Mutex
+	closing  chan struct{}
+	handling sync.WaitGroup
+}
+
+func newCloser() *closer {
+	return &closer{
+		closing: make(chan struct{}),
+	}
+}
+
+// start 登记一个处理方法, 已关闭返回false; 与 close 互斥保证 wait 之后不会再有登记
+func (c *closer) start() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.isClosed() {
+		return false
+	}
+	c.handling.Add(1)
+	return true
+}
+
+// done 处理方法执行结束
+func (c *closer) done() {
+	c.handling.Done()
+}
+
+// close 发出关闭信号, 重复调用无影响
+func (c *closer) close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.isClosed() {
+		close(c.closing)
+	}
+}
+
+func (c *closer) isClosed() bool {
+	select {
+	case <-c.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait 等待所有处理方法结束, ctx 超时或取消返回 ctx.Err()
+func (c *closer) wait(ctx context.Context) error {
+	finish := make(chan struct{})
+	go func() {
+		c.handling.Wait()
+		close(finish)
+	}()
+	select {
+	case <-finish:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,119 @@
+package tcp
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// blockingPair Put 处理方法阻塞到 release 关闭
+func blockingPair(t *testing.T, release chan struct{}) (*Servers, *Client) {
+	t.Helper()
+	entered := make(chan struct{})
+	s := testServers(t, func(s *Servers) {
+		s.PutHandleFunc("slow", func(s *Servers, c *ClientInfo, body []byte) {
+			close(entered)
+			<-release
+		})
+	})
+	c := testClient(t, s, ClientConf{}, nil)
+	waitFor(t, "connect", c.connected)
+	c.Put("slow", nil)
+	select {
+	case <-entered:
+	case <-time.After(3 * time.Second):
+		t.Fatal("put handler not called")
+	}
+	return s, c
+}
+
+func TestServersShutdownDrain(t *testing.T) {
+	release := make(chan struct{})
+	s, c := blockingPair(t, release)
+
+	result := make(chan error, 1)
+	go func() { result <- s.Shutdown(context.Background()) }()
+	select {
+	case err := <-result:
+		t.Fatalf("Shutdown returned %v while a handler was running", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Shutdown did not return after the handler finished")
+	}
+	// 处理方法结束后的应答在断开连接前发出
+	waitFor(t, "put ack", func() bool { return c.backlogLen() == 0 })
+	waitFor(t, "disconnect", func() bool { return !c.currentConn() })
+}
+
+func TestServersShutdownContext(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	s, c := blockingPair(t, release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+	// 超时后仍然断开所有连接
+	waitFor(t, "disconnect", func() bool { return !c.currentConn() })
+}
+
+func TestClientShutdown(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	finished := make(chan struct{})
+	s := testServers(t, nil)
+	c, err := NewClient(s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.NoticeHandleFunc("slow", func(c *Client, data []byte) {
+		close(entered)
+		<-release
+		close(finished)
+	})
+	stopped := make(chan struct{})
+	go func() {
+		c.Run()
+		close(stopped)
+	}()
+	waitFor(t, "connect", c.connected)
+	go func() { _, _ = s.Notice(c.GetName(), "slow", nil, nil) }()
+	select {
+	case <-entered:
+	case <-time.After(3 * time.Second):
+		t.Fatal("notice handler not called")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err = c.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return")
+	}
+
+	// 再次关闭等待处理方法结束
+	result := make(chan error, 1)
+	go func() { result <- c.Shutdown(context.Background()) }()
+	close(release)
+	if err = <-result; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-finished:
+	default:
+		t.Fatal("Shutdown returned before the handler finished")
+	}
+}
@@ -0,0 +1,308 @@
+package tcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	CloseLog()
+	os.Exit(m.Run())
+}
+
+// testServers 启动一个监听随机端口的s端, setup 在 Run 之前注册方法
+func testServers(t *testing.T, setup func(s *Servers)) *Servers {
+	t.Helper()
+	s, err := NewServers("127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setup != nil {
+		setup(s)
+	}
+	go s.Run()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = s.Shutdown(ctx)
+	})
+	return s
+}
+
+// testClient 连接到s端, setup 在 Run 之前注册方法
+func testClient(t *testing.T, s *Servers, conf ClientConf, setup func(c *Client)) *Client {
+	t.Helper()
+	c, err := NewClient(s.Listener.Addr().String(), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setup != nil {
+		setup(c)
+	}
+	go c.Run()
+	t.Cleanup(c.Close)
+	return c
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (c *Client) currentConn() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.Conn != nil
+}
+
+func (c *Client) backlogLen() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.backlogCount
+}
+
+func TestPut(t *testing.T) {
+	got := make(chan []byte, 1)
+	s := testServers(t, func(s *Servers) {
+		s.PutHandleFunc("put", func(s *Servers, c *ClientInfo, body []byte) {
+			got <- body
+		})
+	})
+	c := testClient(t, s, ClientConf{}, nil)
+	waitFor(t, "connect", c.connected)
+
+	c.Put("put", []byte("hello"))
+	select {
+	case b := <-got:
+		if string(b) != "hello" {
+			t.Fatalf("got %q", b)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("put not delivered")
+	}
+	waitFor(t, "put ack", func() bool { return c.backlogLen() == 0 })
+}
+
+func TestGet(t *testing.T) {
+	s := testServers(t, func(s *Servers) {
+		s.GetHandleFunc("s", func(s *Servers, param []byte) (int, []byte) {
+			return 0, append(param, '!')
+		})
+	})
+	c := testClient(t, s, ClientConf{}, func(c *Client) {
+		c.GetHandleFunc("c", func(c *Client, param []byte) (int, []byte) {
+			return 0, append(param, '?')
+		})
+	})
+	waitFor(t, "connect", c.connected)
+
+	b, err := c.Get("s", []byte("ping"))
+	if err != nil || string(b) != "ping!" {
+		t.Fatalf("client get: %q %v", b, err)
+	}
+	b, err = s.Get("c", c.GetName(), []byte("ping"))
+	if err != nil || string(b) != "ping?" {
+		t.Fatalf("servers get: %q %v", b, err)
+	}
+	if _, err = c.GetTimeOut("none", nil, 100); err == nil {
+		t.Fatal("get without handler should time out")
+	}
+}
+
+func TestNotice(t *testing.T) {
+	got := make(chan []byte, 1)
+	s := testServers(t, nil)
+	c := testClient(t, s, ClientConf{}, func(c *Client) {
+		c.NoticeHandleFunc("n", func(c *Client, data []byte) {
+			got <- data
+		})
+	})
+	waitFor(t, "connect", c.connected)
+
+	if _, err := s.Notice(c.GetName(), "n", []byte("news"), nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case b := <-got:
+		if string(b) != "news" {
+			t.Fatalf("got %q", b)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("notice not delivered")
+	}
+	if _, err := s.Notice("nobody", "n", nil, nil); err == nil {
+		t.Fatal("notice to unknown client should fail")
+	}
+}
+
+func TestBadConnectCode(t *testing.T) {
+	s := testServers(t, nil)
+	c := testClient(t, s, ClientConf{Name: "bad", ConnectCode: "wrong"}, nil)
+
+	// s端回复失败后断开, c端等待重连
+	waitFor(t, "disconnect", func() bool { return !c.currentConn() })
+	if c.connected() {
+		t.Fatal("client connected with a wrong code")
+	}
+	if _, ok := s.GetClientConn("bad"); ok {
+		t.Fatal("servers registered a client with a wrong code")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	got := make(chan []byte, 2)
+	s := testServers(t, func(s *Servers) {
+		s.PutHandleFunc("put", func(s *Servers, c *ClientInfo, body []byte) {
+			got <- body
+		})
+	})
+	c := testClient(t, s, ClientConf{}, nil)
+	waitFor(t, "connect", c.connected)
+
+	s.ClientDiscard(c.GetName(), "")
+	waitFor(t, "disconnect", func() bool { return !c.currentConn() })
+	// 断开期间的数据被积压
+	c.Put("put", []byte("offline"))
+	if c.backlogLen() != 1 {
+		t.Fatalf("backlog = %d, want 1", c.backlogLen())
+	}
+
+	// 与时间轮中的重连一致
+	if err := c.ConnectServers(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "reconnect", c.connected)
+	select {
+	case b := <-got:
+		if string(b) != "offline" {
+			t.Fatalf("got %q", b)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("backlog not sent after reconnect")
+	}
+	waitFor(t, "backlog ack", func() bool { return c.backlogLen() == 0 })
+	if _, ok := s.GetClientConn(c.GetName()); !ok {
+		t.Fatal("servers lost the reconnected client")
+	}
+}
+
+func pending(m *sync.Map) int {
+	n := 0
+	m.Range(func(key, value any) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// silentClient 完成连接认证后不再读写的c端
+func silentClient(t *testing.T, s *Servers, name string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	frame, err := PacketEncoder(CommandConnect, name, s.aead, []byte(s.connectCode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ReadFrame(conn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetContextCancel(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	s := testServers(t, func(s *Servers) {
+		s.GetHandleFunc("slow", func(s *Servers, param []byte) (int, []byte) {
+			<-release
+			return 0, nil
+		})
+	})
+	c := testClient(t, s, ClientConf{}, nil)
+	waitFor(t, "connect", c.connected)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := c.GetContext(ctx, "slow", nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if n := pending(&c.getDataMap); n != 0 {
+		t.Fatalf("%d get requests left on client", n)
+	}
+	// 已取消的 ctx 不发送请求
+	if _, err := c.GetContext(ctx, "slow", nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+
+	silentClient(t, s, "quiet")
+	waitFor(t, "quiet client", func() bool { _, ok := s.GetClientConn("quiet"); return ok })
+	tctx, tcancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer tcancel()
+	if _, err := s.GetContext(tctx, "f", "quiet", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+	if n := pending(&s.getDataMap); n != 0 {
+		t.Fatalf("%d get requests left on servers", n)
+	}
+}
+
+func TestNoticeContextCancel(t *testing.T) {
+	s := testServers(t, nil)
+	silentClient(t, s, "quiet")
+	waitFor(t, "quiet client", func() bool { _, ok := s.GetClientConn("quiet"); return ok })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 80*time.Millisecond)
+	defer cancel()
+	// 重试时间远大于 ctx, 只有 ctx 能让它返回
+	start := time.Now()
+	_, err := s.NoticeContext(ctx, "quiet", "n", []byte("x"), s.SetNoticeRetry(100, 1000))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("NoticeContext did not return on cancel")
+	}
+	if n := pending(&s.noticeMap); n != 0 {
+		t.Fatalf("%d notices left on servers", n)
+	}
+}
+
+func TestReadConnectFrameLimit(t *testing.T) {
+	frame := func(size int) *bytes.Reader {
+		buf := new(bytes.Buffer)
+		_ = binary.Write(buf, binary.BigEndian, uint32(size))
+		buf.Write(make([]byte, size))
+		return bytes.NewReader(buf.Bytes())
+	}
+	if _, err := ReadConnectFrame(frame(MaxConnectFrameSize)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadConnectFrame(frame(MaxConnectFrameSize + 1)); err != ErrConnectFrame {
+		t.Fatalf("err = %v, want ErrConnectFrame", err)
+	}
+	if _, err := ReadFrame(frame(MaxConnectFrameSize + 1)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,111 @@
+package tcp
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+func formatName(str string) string {
+	ln := len(str)
+	if ln > 0 && ln <= 7 {
+		// 补齐位
+		for i := 0; i < 7-ln; i++ {
+			str += " "
+		}
+	}
+	return str
+}
+
+// LogClose 是否关闭日志
+var LogClose bool = true
+var std = newStd()
+
+// CloseLog 关闭日志
+func CloseLog() {
+	LogClose = false
+}
+
+type logger struct {
+	outFile       bool
+	outFileWriter *os.File
+}
+
+func newStd() *logger {
+	return &logger{}
+}
+
+func SetLogFile(name string) {
+	std.outFile = true
+	std.outFileWriter, _ = os.OpenFile(name+time.Now().Format("-20060102")+".log",
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+}
+
+type Level int
+
+var LevelMap = map[Level]string{
+	1: "[Info]  ",
+	4: "[Error] ",
+}
+
+func (l *logger) Log(level Level, args string, times int) {
+	var buffer bytes.Buffer
+	buffer.WriteString(time.Now().Format("2006-01-02 15:04:05.000 "))
+	buffer.WriteString(LevelMap[level])
+	_, file, line, _ := runtime.Caller(times)
+	fileList := strings.Split(file, "/")
+	// 最多显示两级路径
+	if len(fileList) > 3 {
+		fileList = fileList[len(fileList)-3 : len(fileList)]
+	}
+	buffer.WriteString(strings.Join(fileList, "/"))
+	buffer.WriteString(":")
+	buffer.WriteString(strconv.Itoa(line))
+	buffer.WriteString(" \t| ")
+	buffer.WriteString(args)
+	buffer.WriteString("\n")
+	out := buffer.Bytes()
+	if LogClose {
+		_, _ = buffer.WriteTo(os.Stdout)
+	}
+	if l.outFile {
+		_, _ = l.outFileWriter.Write(out)
+	}
+}
+
+func Info(args ...interface{}) {
+	std.Log(1, fmt.Sprint(args...), 2)
+}
+
+func InfoF(format string, args ...interface{}) {
+	std.Log(1, fmt.Sprintf(format, args...), 2)
+}
+
+func Error(args ...interface{}) {
+	std.Log(4, fmt.Sprint(args...), 2)
+}
+
+func ErrorF(format string, args ...interface{}) {
+	std.Log(4, fmt.Sprintf(format, args...), 2)
+}
+
+var lastId int64
+
+// id 返回一个进程内唯一且递增的 INT64 ID, 毫秒时间戳左移12位
+func id() int64 {
+	for {
+		last := atomic.LoadInt64(&lastId)
+		next := time.Now().UnixMilli() << 12
+		if next <= last {
+			next = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&lastId, last, next) {
+			return next
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package udp
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+
+IP黑白名单与封禁: 被拒绝的包直接丢弃, 不回应
+
+1. 黑名单优先, 在黑名单中的地址都被拒绝
+2. 白名单为空时允许所有地址, 不为空时只允许白名单中的地址
+3. BlockClient 临时封禁 name 在 ip 下的c端, 到期后自动解封
+4. 黑白名单与只按 ip 的封禁在解包前按来源地址检查, 不解密
+5. 按 name 的封禁在连接包与心跳包认证通过后检查, 已连接的c端由 BlockClient 移除连接, 之后的包签名校验失败需要重新连接
+6. 只有设置了 Authenticator 时 name 才对应c端的凭证, 共用 ConnectCode 时 name 由c端自己填写, 按 name 的封禁可以通过改名绕过, 需要按 ip 封禁
+
+*/
+
+// FilterStats IP黑白名单与封禁丢弃的包数量
+type FilterStats struct {
+	Denied     uint64 // 在黑名单中
+	NotAllowed uint64 // 不在白名单中
+	Blocked    uint64 // 被 BlockClient 封禁
+}
+
+// ipFilter IP黑白名单与封禁, 并发安全
+type ipFilter struct {
+	lock    sync.RWMutex
+	allow   []*net.IPNet
+	deny    []*net.IPNet
+	blocked map[string]int64 // name@ip -> 解封时间 UnixMilli, 0 为永久; name 或 ip 为空表示任意
+	stats   FilterStats
+}
+
+func newIPFilter() *ipFilter {
+	return &ipFilter{
+		blocked: make(map[string]int64),
+	}
+}
+
+// parseCIDRs 解析 CIDR, 单个 IP 按 /32 或 /128 处理
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, item := range list {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, ErrCIDR(item)
+			}
+			if ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, ErrCIDR(item)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// check 来源地址是否允许通讯, 检查黑白名单与只按 ip 的封禁
+func (f *ipFilter) check(ip net.IP) bool {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	if containsIP(f.deny, ip) {
+		atomic.AddUint64(&f.stats.Denied, 1)
+		return false
+	}
+	if len(f.allow) > 0 && !containsIP(f.allow, ip) {
+		atomic.AddUint64(&f.stats.NotAllowed, 1)
+		return false
+	}
+	return !f.blockedLocked(onLineKey("", ip.String()))
+}
+
+// blockedName 认证通过的 name 在 ip 下是否被封禁, name 为补齐后的名称
+func (f *ipFilter) blockedName(name, ip string) bool {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.blockedLocked(onLineKey(name, ip), onLineKey(name, ""))
+}
+
+func (f *ipFilter) blockedLocked(keys ...string) bool {
+	if len(f.blocked) == 0 {
+		return false
+	}
+	now := time.Now().UnixMilli()
+	for _, key := range keys {
+		if until, ok := f.blocked[key]; ok && (until == 0 || until > now) {
+			atomic.AddUint64(&f.stats.Blocked, 1)
+			return true
+		}
+	}
+	return false
+}
+
+// sweep 移除到期的封禁
+func (f *ipFilter) sweep() {
+	now := time.Now().UnixMilli()
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for key, until := range f.blocked {
+		if until != 0 && until <= now {
+			delete(f.blocked, key)
+		}
+	}
+}
+
+func (f *ipFilter) snapshot() FilterStats {
+	return FilterStats{
+		Denied:     atomic.LoadUint64(&f.stats.Denied),
+		NotAllowed: atomic.LoadUint64(&f.stats.NotAllowed),
+		Blocked:    atomic.LoadUint64(&f.stats.Blocked),
+	}
+}
+
+// SetAllowList 设置白名单, 元素为 CIDR 或 IP; 为空时允许所有地址
+func (s *Servers) SetAllowList(cidrs ...string) error {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+	s.filter.lock.Lock()
+	defer s.filter.lock.Unlock()
+	s.filter.allow = nets
+	return nil
+}
+
+// SetDenyList 设置黑名单, 元素为 CIDR 或 IP, 优先于白名单
+func (s *Servers) SetDenyList(cidrs ...string) error {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+	s.filter.lock.Lock()
+	defer s.filter.lock.Unlock()
+	s.filter.deny = nets
+	return nil
+}
+
+// BlockClient 封禁 name 在 ip 下的c端 duration 时间并移除其连接, duration 小于等于0时永久封禁直到 UnblockClient
+// name 为空时封禁该 ip 下的所有c端, ip 为空时封禁 name 的所有地址; 没有 Authenticator 时 name 可以被c端修改, 见文件头
+func (s *Servers) BlockClient(name, ip string, duration time.Duration) error {
+	if name == "" && ip == "" {
+		return ErrBlockClient
+	}
+	if ip != "" {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return ErrCIDR(ip)
+		}
+		ip = parsed.String()
+	}
+	if name != "" {
+		name = formatName(name)
+	}
+	var until int64
+	if duration > 0 {
+		until = time.Now().Add(duration).UnixMilli()
+	}
+	s.filter.lock.Lock()
+	s.filter.blocked[onLineKey(name, ip)] = until
+	s.filter.lock.Unlock()
+	InfoF("封禁客户端 名称:%s IP地址:%s 时长:%s", name, ip, duration)
+	if name != "" {
+		s.ClientDiscard(name, ip)
+		return nil
+	}
+	for _, info := range s.clients.snapshot() {
+		if info.Online && info.IP == ip {
+			s.ClientDiscard(info.Name, ip)
+		}
+	}
+	return nil
+}
+
+// UnblockClient 解除 BlockClient 的封禁, name 与 ip 与封禁时一致
+func (s *Servers) UnblockClient(name, ip string) {
+	if ip != "" {
+		if parsed := net.ParseIP(ip); parsed != nil {
+			ip = parsed.String()
+		}
+	}
+	if name != "" {
+		name = formatName(name)
+	}
+	s.filter.lock.Lock()
+	defer s.filter.lock.Unlock()
+	delete(s.filter.blocked, onLineKey(name, ip))
+}
+
+// FilterStats IP黑白名单与封禁丢弃的包数量
+func (s *Servers) FilterStats() FilterStats {
+	return s.filter.snapshot()
+}
@@ -0,0 +1,154 @@
+package udp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := parseCIDRs([]string{"10.0.0.0/8", " 192.168.1.1 ", "", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nets) != 3 {
+		t.Fatalf("%d nets", len(nets))
+	}
+	// 单个 IP 按 /32 或 /128 处理
+	if ones, _ := nets[1].Mask.Size(); ones != 32 || !nets[1].Contains(net.ParseIP("192.168.1.1")) || nets[1].Contains(net.ParseIP("192.168.1.2")) {
+		t.Fatalf("ipv4 %s", nets[1])
+	}
+	if ones, _ := nets[2].Mask.Size(); ones != 128 {
+		t.Fatalf("ipv6 %s", nets[2])
+	}
+	for _, bad := range []string{"10.0.0.0/33", "nope", "300.1.1.1"} {
+		if _, err = parseCIDRs([]string{bad}); err == nil {
+			t.Fatalf("%q parsed", bad)
+		}
+	}
+}
+
+// 黑名单优先于白名单, 白名单为空时允许所有地址
+func TestFilterDenyBeatsAllow(t *testing.T) {
+	s := testServers(t)
+	if err := s.SetAllowList("10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetDenyList("10.1.0.0/16"); err != nil {
+		t.Fatal(err)
+	}
+	if !s.filter.check(net.ParseIP("10.2.0.1")) {
+		t.Fatal("allowed address rejected")
+	}
+	if s.filter.check(net.ParseIP("10.1.0.1")) {
+		t.Fatal("denied address inside the allow list accepted")
+	}
+	if s.filter.check(net.ParseIP("192.168.0.1")) {
+		t.Fatal("address outside the allow list accepted")
+	}
+	if err := s.SetAllowList(); err != nil {
+		t.Fatal(err)
+	}
+	if !s.filter.check(net.ParseIP("192.168.0.1")) {
+		t.Fatal("empty allow list rejected an address")
+	}
+	if stats := s.FilterStats(); stats.Denied != 1 || stats.NotAllowed != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+// 黑名单中的地址签名正确也不解包
+func TestFilterBeforeDecrypt(t *testing.T) {
+	s := testServers(t)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9}
+	s.clients.join(formatName("alice"), "127.0.0.1", addr, session{Version: 1})
+	s.SignStore(addr.String(), "sign123")
+	b, err := PacketEncoderVersion(CommandNotice, 1, "alice", "sign123", s.cipher, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SetDenyList("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := s.receive(addr, b, len(b)); ok {
+		t.Fatal("denied address accepted")
+	}
+	if err = s.SetDenyList(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := s.receive(addr, b, len(b)); !ok {
+		t.Fatal("packet rejected after the deny list was cleared")
+	}
+}
+
+// 封禁移除连接, 到期后自动解封
+func TestBlockClientExpiry(t *testing.T) {
+	s := testServers(t)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9}
+	s.clientJoin(formatName("alice"), "127.0.0.1", addr, session{Version: 1})
+	if err := s.BlockClient("", "", time.Second); err != ErrBlockClient {
+		t.Fatalf("empty ban: %v", err)
+	}
+	if err := s.BlockClient("alice", "", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.BlockClient("", "127.0.0.2", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.GetClientConn("alice"); ok {
+		t.Fatal("connection kept after block")
+	}
+	if !s.filter.blockedName(formatName("alice"), "127.0.0.1") || s.filter.check(net.ParseIP("127.0.0.2")) {
+		t.Fatal("not blocked")
+	}
+	// 按 name 的封禁不在解包前检查
+	if !s.filter.check(net.ParseIP("127.0.0.1")) || s.filter.blockedName(formatName("bob"), "127.0.0.1") {
+		t.Fatal("other clients blocked")
+	}
+	time.Sleep(80 * time.Millisecond)
+	if s.filter.blockedName(formatName("alice"), "127.0.0.1") || !s.filter.check(net.ParseIP("127.0.0.2")) {
+		t.Fatal("still blocked after expiry")
+	}
+	s.filter.sweep()
+	if len(s.filter.blocked) != 0 {
+		t.Fatalf("%d expired bans kept", len(s.filter.blocked))
+	}
+}
+
+func TestUnblockClient(t *testing.T) {
+	s := testServers(t)
+	if err := s.BlockClient("alice", "127.0.0.1", 0); err != nil {
+		t.Fatal(err)
+	}
+	s.filter.sweep()
+	if !s.filter.blockedName(formatName("alice"), "127.0.0.1") {
+		t.Fatal("permanent ban expired")
+	}
+	// 与封禁时的 name 与 ip 不一致不解封
+	s.UnblockClient("alice", "")
+	if !s.filter.blockedName(formatName("alice"), "127.0.0.1") {
+		t.Fatal("unblocked with another key")
+	}
+	s.UnblockClient("alice", "127.0.0.1")
+	if s.filter.blockedName(formatName("alice"), "127.0.0.1") {
+		t.Fatal("still blocked after unblock")
+	}
+}
+
+// 按 name 的封禁在认证通过后检查, 被封禁的c端连接不被回应
+func TestBlockedNameAfterAuth(t *testing.T) {
+	s, c := testPair(t, func(s *Servers) {
+		s.SetAuthenticator(NewStaticAuthenticator(map[string]string{"c1": "c"}))
+		if err := s.BlockClient("c1", "", 0); err != nil {
+			t.Fatal(err)
+		}
+	}, func(conf *ClientConf) {
+		conf.Backoff = Backoff{Min: 20 * time.Millisecond, Max: 50 * time.Millisecond}
+	})
+	time.Sleep(300 * time.Millisecond)
+	if c.State() == StateConnected || s.FilterStats().Blocked == 0 {
+		t.Fatalf("blocked client state %s stats %+v", c.State(), s.FilterStats())
+	}
+	s.UnblockClient("c1", "")
+	waitConnected(t, c)
+}
@@ -0,0 +1,235 @@
+package udp
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+
+客户端认证: 连接包与心跳包携带的连接code作为c端的凭证, 按c端名称校验
+
+1. 未设置 Authenticator 时所有c端共用 ServersConf.ConnectCode
+2. 认证失败只回应 Reply{StateCode: StateCodeAuth}, 不移除已有的连接, c端进入 StateRejected 按退避时间重试
+3. 吊销单个c端后, 该c端的下一个心跳(最多 HeartbeatTime)被拒绝, 不再刷新的连接超时后离线, 其他c端不受影响
+4. 连接按地址记录认证通过的名称, 该地址的 Put, Get, Notice, Reply 包头名称不一致时拒绝
+5. RevokeClient 吊销凭证并立即移除该c端所有的连接, 签名与会话密钥, Authenticator 需要实现 Revoker
+
+*/
+
+// Authenticator 校验c端的凭证, 返回 nil 表示通过; 实现需要并发安全
+// name 为c端名称, ip 为c端地址, credential 为c端的连接code
+type Authenticator interface {
+	Authenticate(name, ip, credential string) error
+}
+
+// AuthenticatorFunc 回调形式的 Authenticator
+type AuthenticatorFunc func(name, ip, credential string) error
+
+func (f AuthenticatorFunc) Authenticate(name, ip, credential string) error {
+	return f(name, ip, credential)
+}
+
+// Revoker 可以吊销c端凭证的 Authenticator, 见 Servers.RevokeClient
+type Revoker interface {
+	Revoke(name string)
+}
+
+// StaticAuthenticator 静态凭证表 c端名称 -> 凭证, 可在运行中增加与吊销
+type StaticAuthenticator struct {
+	lock  sync.RWMutex
+	creds map[string]string
+}
+
+// NewStaticAuthenticator creds 为 c端名称 -> 凭证
+func NewStaticAuthenticator(creds map[string]string) *StaticAuthenticator {
+	a := &StaticAuthenticator{}
+	a.replace(creds)
+	return a
+}
+
+func (a *StaticAuthenticator) replace(creds map[string]string) {
+	m := make(map[string]string, len(creds))
+	for name, credential := range creds {
+		m[name] = credential
+	}
+	a.lock.Lock()
+	a.creds = m
+	a.lock.Unlock()
+}
+
+// Set 设置 name 的凭证, 已存在时替换
+func (a *StaticAuthenticator) Set(name, credential string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.creds[name] = credential
+}
+
+// Revoke 吊销 name 的凭证
+func (a *StaticAuthenticator) Revoke(name string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.creds, name)
+}
+
+func (a *StaticAuthenticator) Authenticate(name, ip, credential string) error {
+	a.lock.RLock()
+	expect, ok := a.creds[name]
+	a.lock.RUnlock()
+	if !ok {
+		return ErrAuthUnknownClient(name)
+	}
+	if subtle.ConstantTimeCompare([]byte(expect), []byte(credential)) != 1 {
+		return ErrAuthCredential
+	}
+	return nil
+}
+
+// FileAuthenticator 凭证文件, 每行 "c端名称 凭证", # 开头为注释
+// 文件修改后自动重新加载(检查间隔 AuthFileCheckInterval), 删除某一行即吊销该c端
+type FileAuthenticator struct {
+	path    string
+	static  *StaticAuthenticator
+	lock    sync.Mutex
+	modTime time.Time
+	checked time.Time
+}
+
+// NewFileAuthenticator 加载凭证文件 path
+func NewFileAuthenticator(path string) (*FileAuthenticator, error) {
+	a := &FileAuthenticator{
+		path:   path,
+		static: NewStaticAuthenticator(nil),
+	}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload 重新加载凭证文件, 失败时保留之前的凭证
+func (a *FileAuthenticator) Reload() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.load()
+}
+
+// load 调用方持有锁
+func (a *FileAuthenticator) load() error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	creds := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return ErrAuthFileLine(a.path, line)
+		}
+		creds[fields[0]] = fields[1]
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	a.static.replace(creds)
+	a.modTime = info.ModTime()
+	a.checked = time.Now()
+	return nil
+}
+
+// refresh 文件修改时间变化时重新加载
+func (a *FileAuthenticator) refresh() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if time.Since(a.checked) < AuthFileCheckInterval*time.Millisecond {
+		return
+	}
+	a.checked = time.Now()
+	info, err := os.Stat(a.path)
+	if err != nil {
+		Error("凭证文件检查失败 err:", err)
+		return
+	}
+	if info.ModTime().Equal(a.modTime) {
+		return
+	}
+	if err = a.load(); err != nil {
+		Error("凭证文件加载失败, 保留之前的凭证 err:", err)
+		return
+	}
+	InfoF("重新加载凭证文件 %s", a.path)
+}
+
+func (a *FileAuthenticator) Authenticate(name, ip, credential string) error {
+	a.refresh()
+	return a.static.Authenticate(name, ip, credential)
+}
+
+// SetAuthenticator 设置c端认证, 为 nil 时所有c端共用连接code
+func (s *Servers) SetAuthenticator(auth Authenticator) {
+	s.authLock.Lock()
+	defer s.authLock.Unlock()
+	s.auth = auth
+}
+
+// authenticate 校验连接包与心跳包的凭证
+func (s *Servers) authenticate(name, ip, credential string) error {
+	s.authLock.RLock()
+	auth := s.auth
+	s.authLock.RUnlock()
+	if auth == nil {
+		if credential != s.connectCode {
+			return ErrAuthCredential
+		}
+		return nil
+	}
+	return auth.Authenticate(name, ip, credential)
+}
+
+// rejectClient 认证失败, 只回应 StateCodeAuth, 伪造的连接包不影响已有的连接
+func (s *Servers) rejectClient(addr *net.UDPAddr) {
+	s.replyRefuse(addr, StateCodeAuth, nil)
+}
+
+// nameCheck 包头名称与该地址认证通过的名称一致
+func (s *Servers) nameCheck(addr string, packet *Packet) bool {
+	sess, ok := s.clients.session(addr)
+	return ok && sess.name == formatName(packet.Name)
+}
+
+// RevokeClient 吊销c端 name 的凭证, 并移除它所有的连接, 签名与会话密钥, 不用等待心跳被拒绝或超时
+// Authenticator 未设置或没有实现 Revoker(如 FileAuthenticator 需要删除文件中的行)时返回 ErrAuthNotRevocable, 连接不移除
+func (s *Servers) RevokeClient(name string) error {
+	s.authLock.RLock()
+	revoker, ok := s.auth.(Revoker)
+	s.authLock.RUnlock()
+	if !ok {
+		return ErrAuthNotRevocable
+	}
+	revoker.Revoke(name)
+	conns, _ := s.GetClientConn(name)
+	s.ClientDiscard(name, "")
+	for addr := range conns {
+		s.signMap.Delete(addr)
+	}
+	return nil
+}
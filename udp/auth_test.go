@@ -0,0 +1,159 @@
+package udp
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStaticAuthenticator(t *testing.T) {
+	a := NewStaticAuthenticator(map[string]string{"alice": "a1"})
+	if err := a.Authenticate("alice", "127.0.0.1", "a1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Authenticate("alice", "127.0.0.1", "bad"); err != ErrAuthCredential {
+		t.Fatalf("wrong credential: %v", err)
+	}
+	if err := a.Authenticate("bob", "127.0.0.1", "a1"); err == nil {
+		t.Fatal("unknown client accepted")
+	}
+	a.Set("bob", "b1")
+	a.Revoke("alice")
+	if err := a.Authenticate("bob", "127.0.0.1", "b1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Authenticate("alice", "127.0.0.1", "a1"); err == nil {
+		t.Fatal("revoked client accepted")
+	}
+}
+
+func TestFileAuthenticator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clients")
+	if err := os.WriteFile(path, []byte("# name credential\nalice a1\n\nbob b1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewFileAuthenticator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Authenticate("bob", "127.0.0.1", "b1"); err != nil {
+		t.Fatal(err)
+	}
+	// 删除一行即吊销, 格式错误时保留之前的凭证
+	if err = os.WriteFile(path, []byte("alice a1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Authenticate("bob", "127.0.0.1", "b1"); err == nil {
+		t.Fatal("removed line still accepted")
+	}
+	if err = os.WriteFile(path, []byte("alice\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Reload(); err == nil {
+		t.Fatal("malformed line loaded")
+	}
+	if err = a.Authenticate("alice", "127.0.0.1", "a1"); err != nil {
+		t.Fatalf("previous credentials lost: %v", err)
+	}
+}
+
+// 已认证的地址使用其他c端名称的包被拒绝
+func TestNameCheck(t *testing.T) {
+	s := testServers(t)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9}
+	s.clients.join(formatName("alice"), "127.0.0.1", addr, session{Version: 1})
+	s.SignStore(addr.String(), "sign123")
+	packet := func(name string) []byte {
+		b, err := PacketEncoderVersion(CommandNotice, 1, name, "sign123", s.cipher, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	forged := packet("admin")
+	if _, _, ok := s.receive(addr, forged, len(forged)); ok {
+		t.Fatal("packet with another client's name accepted")
+	}
+	legit := packet("alice")
+	if _, _, ok := s.receive(addr, legit, len(legit)); !ok {
+		t.Fatal("packet with the authenticated name rejected")
+	}
+	// 连接被移除后签名不再有效
+	s.ClientDiscard("alice", "127.0.0.1")
+	if _, _, ok := s.receive(addr, legit, len(legit)); ok {
+		t.Fatal("packet accepted after the connection was discarded")
+	}
+}
+
+// 认证失败只拒绝, 不影响同名已有的连接
+func TestRejectClientKeepsSession(t *testing.T) {
+	s := testServers(t)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9}
+	s.clients.join(formatName("alice"), "127.0.0.1", addr, session{Version: 1})
+	s.SignStore(addr.String(), "sign123")
+	s.rejectClient(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 10})
+	s.rejectClient(addr)
+	if _, ok := s.clients.session(addr.String()); !ok {
+		t.Fatal("session removed by a failed attempt")
+	}
+	if !s.SignCheck(addr.String(), "sign123") {
+		t.Fatal("sign removed by a failed attempt")
+	}
+}
+
+// 凭证错误的c端被拒绝, 已连接的同名c端继续通讯
+func TestAuthRejectedClient(t *testing.T) {
+	s, c := testPair(t, nil, nil)
+	s.SetAuthenticator(NewStaticAuthenticator(map[string]string{"c1": "c"}))
+	waitConnected(t, c)
+	bad, err := NewClient(s.Conn.LocalAddr().String(), ClientConf{Name: "c1", ConnectCode: "wrong", SecretKey: "pair-test", Backlog: NewMemoryBacklog()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go bad.Serve()
+	defer bad.Close()
+	deadline := time.Now().Add(3 * time.Second)
+	for bad.State() != StateRejected {
+		if time.Now().After(deadline) {
+			t.Fatalf("state %s", bad.State())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := s.clients.session(c.Conn.LocalAddr().String()); !ok {
+		t.Fatal("connected client removed")
+	}
+}
+
+// RevokeClient 立即移除连接与签名, 之后的心跳被拒绝
+func TestRevokeClient(t *testing.T) {
+	s, c := testPair(t, nil, nil)
+	if err := s.RevokeClient("c1"); err != ErrAuthNotRevocable {
+		t.Fatalf("without Authenticator: %v", err)
+	}
+	s.SetAuthenticator(NewStaticAuthenticator(map[string]string{"c1": "c"}))
+	waitConnected(t, c)
+	addr := c.Conn.LocalAddr().String()
+	if _, ok := s.clients.session(addr); !ok {
+		t.Fatal("client not connected")
+	}
+	if err := s.RevokeClient("c1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.clients.session(addr); ok {
+		t.Fatal("session kept after revoke")
+	}
+	if _, ok := s.GetClientConn("c1"); ok {
+		t.Fatal("connection kept after revoke")
+	}
+	if _, ok := s.signMap.Load(addr); ok {
+		t.Fatal("sign kept after revoke")
+	}
+	if err := s.authenticate("c1", "127.0.0.1", "c"); err == nil {
+		t.Fatal("revoked client authenticated")
+	}
+}
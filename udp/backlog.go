@@ -2,177 +2,239 @@ package udp
 
 import (
 	"bufio"
-	"fmt"
+	"bytes"
 	"io"
-	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"sync"
 	"sync/atomic"
-	"time"
 )
 
-// backlog 积压的数据，所有发送的数据都会到这里，只有服务端确认的数据才会被删除
-var backlog sync.Map
-var backlogCount int64 = 0
-var backlogCountMax int64 = 10000 // 内存中最大积压数据包条数
-var backlogCountMin int64 = 5000  // 持久化加载的最小量级
-var backlogFile = "%d.udb"
+// BacklogStore 积压数据的存储，所有Put的数据都会到这里，只有服务端确认的数据才会被删除
+// 实现需要并发安全; 内置 NewMemoryBacklog, NewWALBacklog, NewBoltBacklog
+type BacklogStore interface {
+	Add(putData PutData) error                // 写入, Id 已存在时不重复写入
+	Ack(id int64) error                       // 删除服务端已确认的数据, 不存在时不报错
+	Range(f func(putData PutData) bool) error // 遍历未确认的数据, f 返回 false 时停止
+	Len() int                                 // 未确认的数据条数
+	Close() error                             // 持久化后关闭, 关闭后不能再写入
+}
 
-func backlogAdd(putId int64, putData PutData) {
-	atomic.AddInt64(&backlogCount, 1)
-	backlog.Store(putId, putData)
-	backlogStorage()
+// DurableBacklog 积压存储的可选接口, 进程重启后数据不丢失时 Durable 返回 true
+// c端只向持久化的存储导入旧版 .udb 文件, 没有实现的自定义存储不导入
+type DurableBacklog interface {
+	Durable() bool
 }
 
-func backlogDel(putId int64) {
-	atomic.AddInt64(&backlogCount, -1)
-	backlog.Delete(putId)
+// udbLock 同一进程内多个客户端导入旧版持久化文件互斥
+var udbLock sync.Mutex
+
+// legacyUdbFile 旧版本的持久化文件 时间戳.udb, 没有记录服务端, 只由开启了 ClientConf.LegacyUdb 的客户端导入
+var legacyUdbFile = regexp.MustCompile(`^\d+\.udb$`)
+
+// backlogPrefix 默认积压存储的子目录与旧版持久化文件的前缀, 以客户端名称和服务端地址区分
+func backlogPrefix(clientName, serversHost string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, clientName+"@"+serversHost)
 }
 
-func backlogLen() int64 {
-	n := 0
-	backlog.Range(func(key, value any) bool {
-		n++
-		return true
-	})
-	return int64(n)
+// newBacklog c端默认的积压存储: <dir>/<客户端名称@服务端地址> 下的 WAL
+func newBacklog(clientName, serversHost, dir string, policy WALSyncPolicy) (BacklogStore, error) {
+	return NewWALBacklog(filepath.Join(dir, backlogPrefix(clientName, serversHost)), policy)
+}
+
+// memoryBacklog 内存中的积压数据, 进程退出后丢失, 用于只读或临时的文件系统
+type memoryBacklog struct {
+	data  sync.Map // putId -> PutData
+	count int64    // 积压数据条数
+}
+
+// NewMemoryBacklog 内存积压存储, 不持久化
+func NewMemoryBacklog() BacklogStore {
+	return &memoryBacklog{}
 }
 
-// backlogStorage 持久化方案: 保护内存不持续增长,尽力保证server掉线后数据不丢失，监听非强制kill把数据持久化
-// 只有当积压数据条数大于设定值(backlogCount > max)就将当前所有积压的数据持久化到磁盘，释放内存存放新的数据
-// 当积压数据条数小于设定值(backlogCount < min)就把持久化数据写到积压内存
-// 当监听到非强制kill把数据持久化
-func backlogStorage() {
-	if backlogLen() > backlogCountMax {
-		Error("触发持久化...... backlogCount = ", backlogCount, " 真实len = ", backlogLen())
-		toUdb()
+func (b *memoryBacklog) store(putData PutData) bool {
+	if _, loaded := b.data.LoadOrStore(putData.Id, putData); loaded {
+		return false
 	}
+	atomic.AddInt64(&b.count, 1)
+	return true
 }
 
-func toUdb() {
-	if backlogCount < 1 {
-		return
+func (b *memoryBacklog) get(putId int64) (PutData, bool) {
+	value, ok := b.data.Load(putId)
+	if !ok {
+		return PutData{}, false
 	}
-	file, err := os.OpenFile(fmt.Sprintf(backlogFile, time.Now().Unix()), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		Error(err)
+	return value.(PutData), true
+}
+
+func (b *memoryBacklog) delete(putId int64) bool {
+	if _, ok := b.data.LoadAndDelete(putId); !ok {
+		return false
 	}
-	defer func() {
-		_ = file.Close()
-	}()
-	backlog.Range(func(key, value any) bool {
-		vb, vbErr := ObjToByte(value)
-		_, vbErr = file.Write(vb)
-		_, vbErr = file.Write([]byte("\n"))
-		if vbErr != nil {
-			Error(vbErr)
+	atomic.AddInt64(&b.count, -1)
+	return true
+}
+
+func (b *memoryBacklog) Add(putData PutData) error {
+	b.store(putData)
+	return nil
+}
+
+func (b *memoryBacklog) Ack(id int64) error {
+	b.delete(id)
+	return nil
+}
+
+func (b *memoryBacklog) Range(f func(putData PutData) bool) error {
+	b.data.Range(func(key, value any) bool {
+		if value == nil {
+			return true
 		}
-		backlogDel(key.(int64))
-		return true
+		return f(value.(PutData))
 	})
+	return nil
 }
 
-// BacklogLoad 加载持久化数据 并消费
-func BacklogLoad() {
-	if backlogLen() > backlogCountMin {
-		Error("当前 队列 大于触发条件不加载 : ", backlogCount)
-		return
-	}
-	files, err := ioutil.ReadDir(".")
+func (b *memoryBacklog) Len() int {
+	return int(atomic.LoadInt64(&b.count))
+}
+
+func (b *memoryBacklog) Close() error {
+	return nil
+}
+
+// walBacklog 未确认的数据保存在内存中, 写入与确认都追加到 WAL, 打开时回放恢复, 见 wal.go
+type walBacklog struct {
+	memoryBacklog
+	wal *wal
+}
+
+// NewWALBacklog 在目录 dir 下打开 WAL 积压存储并恢复未确认的数据, policy 为刷盘策略
+// 同一个目录同时只能由一个c端使用
+func NewWALBacklog(dir string, policy WALSyncPolicy) (BacklogStore, error) {
+	b := &walBacklog{}
+	w, pending, err := openWAL(dir, policy, b.get)
 	if err != nil {
-		Error("error reading directory:", err)
-		return
+		return nil, err
 	}
-	for _, file := range files {
-		extension := path.Ext(file.Name())
-		if extension == ".udb" {
-			filePath := "./" + file.Name()
-			// 删掉没用的文件
-			if file.Size() == 0 {
-				err := os.Remove(filePath)
-				if err != nil {
-					Error(err)
-					return
-				}
-			}
-			if file.Size() > 0 {
-				Info(file.Name())
-				fileToBacklog(filePath)
-				if backlogCount > backlogCountMin {
-					break
-				}
-			}
-		}
+	b.wal = w
+	for _, putData := range pending {
+		b.store(putData)
+	}
+	if len(pending) > 0 {
+		InfoF("WAL 恢复积压数据 %d 条 dir:%s", len(pending), dir)
 	}
+	return b, nil
 }
 
-func fileToBacklog(fName string) {
-	f, err := os.Open(fName)
+// Add 写入 WAL 后积压, 先写入 WAL 保证确认记录在写入记录之后; 写入失败时不积压, 返回错误
+func (b *walBacklog) Add(putData PutData) error {
+	if _, ok := b.data.Load(putData.Id); ok {
+		return nil
+	}
+	if err := b.wal.append(&putData); err != nil {
+		return err
+	}
+	b.store(putData)
+	return nil
+}
+
+func (b *walBacklog) Ack(id int64) error {
+	if !b.delete(id) {
+		return nil
+	}
+	return b.wal.ack(id)
+}
+
+func (b *walBacklog) Close() error {
+	return b.wal.close()
+}
+
+// Durable 见 DurableBacklog
+func (b *walBacklog) Durable() bool {
+	return true
+}
+
+// isUdbFile 是否是客户端积压的旧版持久化文件, legacy 为 true 时包括没有记录服务端的 时间戳.udb
+func isUdbFile(name, prefix string, legacy bool) bool {
+	if path.Ext(name) != ".udb" {
+		return false
+	}
+	return strings.HasPrefix(name, prefix+"_") || legacy && legacyUdbFile.MatchString(name)
+}
+
+// importUdb 将工作目录下旧版的 .udb 持久化文件导入积压存储后删除, legacy 见 isUdbFile
+// 只导入实现了 DurableBacklog 的存储, 导入内存存储后删除文件会在重启时丢失数据
+func importUdb(store BacklogStore, prefix string, legacy bool) {
+	udbLock.Lock()
+	defer udbLock.Unlock()
+	files, err := os.ReadDir(".")
 	if err != nil {
-		Error(err)
+		Error("error reading directory:", err)
 		return
 	}
-	putDataList1 := make([]PutData, 0)
-	putDataList2 := make([]PutData, 0)
-	var n int64 = 0
-	reader := bufio.NewReader(f)
-	for {
-		n++
-		line, _, linErr := reader.ReadLine()
-		if linErr == io.EOF {
-			break
+	for _, file := range files {
+		if file.IsDir() || !isUdbFile(file.Name(), prefix, legacy) {
+			continue
 		}
-		//Info(string(line))
-		putData := PutData{}
-		err = ByteToObj(line, &putData)
+		n, err := udbToBacklog(store, file.Name())
 		if err != nil {
 			Error(err)
 			continue
 		}
-		//Info("持久化 putData = ", putData)
-		if n < int64(backlogCountMax/2)+1 {
-			putDataList1 = append(putDataList1, putData)
-		} else {
-			putDataList2 = append(putDataList2, putData)
-		}
-		if err != nil {
+		InfoF("导入旧版持久化文件 %s %d 条", file.Name(), n)
+		if err = os.Remove(file.Name()); err != nil {
 			Error(err)
-			return
 		}
 	}
-	for _, v := range putDataList1 {
-		Error("加入 数据到队列 ... ")
-		backlogAdd(v.Id, v)
-		Error("加入后的count = ", backlogCount)
-	}
-	_ = f.Close()
-	resetBacklogFile(fName, putDataList2)
 }
 
-func resetBacklogFile(fName string, putDataList []PutData) {
-	err := os.Remove(fName)
-	if err != nil {
-		Error(err)
-		return
-	}
-	if len(putDataList) < 1 {
-		return
-	}
-	file, err := os.OpenFile(fName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+func udbToBacklog(store BacklogStore, fName string) (int, error) {
+	f, err := os.Open(fName)
 	if err != nil {
-		Error(err)
-		return
+		return 0, err
 	}
 	defer func() {
-		_ = file.Close()
+		_ = f.Close()
 	}()
-	for _, v := range putDataList {
-		vb, vbErr := ObjToByte(v)
-		_, vbErr = file.Write(vb)
-		_, vbErr = file.Write([]byte("\n"))
-		if vbErr != nil {
-			Error(vbErr)
+	n := 0
+	// 旧版一行一条 JSON, 长度不限, 不能使用 ReadLine(超过缓冲区的行会被拆开)
+	reader := bufio.NewReader(f)
+	for {
+		line, linErr := reader.ReadBytes('\n')
+		if linErr != nil && linErr != io.EOF {
+			return n, linErr
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) == 0 {
+			if linErr == io.EOF {
+				break
+			}
+			continue
+		}
+		putData := PutData{}
+		if err = ByteToObj(line, &putData); err != nil {
+			Error(err)
+			continue
+		}
+		// 写入失败时保留文件, 下次启动重新导入
+		if err = store.Add(putData); err != nil {
+			return n, err
+		}
+		n++
+		if linErr == io.EOF {
+			break
 		}
 	}
+	return n, nil
 }
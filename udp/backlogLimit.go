@@ -0,0 +1,320 @@
+package udp
+
+import (
+	"container/list"
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+
+积压数据的限制: 在任意 BacklogStore 外记录每条数据的大小与Put时间
+
+1. MaxEntries, MaxBytes 超过时按 Overflow 策略处理, 大小按 Label + Body 的字节计算
+2. TTL 超过该时间未确认的数据在写入, 遍历重发与c端时间轮中被丢弃
+3. 打开时遍历已有的数据建立记录, 没有Put时间的旧数据按打开的时间计算
+4. 单条数据超过 MaxBytes 时无论哪种策略都返回 ErrBacklogFull
+5. BacklogBlock 必须设置 TTL, 最早的数据过期后由c端时间轮丢弃, 阻塞的 Put 随之返回
+6. 丢弃的数据在解锁后通知 onDrop, onDrop 中可以再读写积压存储
+
+*/
+
+// BacklogOverflow 积压数据超过限制时的策略
+type BacklogOverflow int
+
+const (
+	BacklogDropOldest BacklogOverflow = iota // 丢弃最早的数据, 默认
+	BacklogDropNewest                        // 丢弃新Put的数据, Put 与 PutAsync 返回 ErrBacklogDropped
+	BacklogBlock                             // 阻塞 Put 直到数据被确认或过期, 需要设置 TTL
+	BacklogReject                            // Put 返回 ErrBacklogFull
+)
+
+// BacklogLimit 积压数据的限制, 零值不限制
+type BacklogLimit struct {
+	MaxEntries int             // 最多条数
+	MaxBytes   int64           // 最多字节
+	TTL        time.Duration   // 超过该时间未确认的数据被丢弃
+	Overflow   BacklogOverflow // 超过条数或字节时的策略
+}
+
+func (l BacklogLimit) enabled() bool {
+	return l.MaxEntries > 0 || l.MaxBytes > 0 || l.TTL > 0
+}
+
+func (l BacklogLimit) check() error {
+	if l.Overflow == BacklogBlock && l.TTL <= 0 {
+		return ErrBacklogBlockTTL
+	}
+	return nil
+}
+
+// BacklogDropStats 积压数据丢弃的数量
+type BacklogDropStats struct {
+	Oldest   uint64 // BacklogDropOldest 丢弃的最早数据
+	Newest   uint64 // BacklogDropNewest 丢弃的新数据
+	Rejected uint64 // 返回 ErrBacklogFull 的数据
+	Expired  uint64 // 超过 TTL 的数据
+}
+
+type backlogEntry struct {
+	id    int64
+	label string
+	size  int64
+	time  int64 // Put时间 UnixMilli
+}
+
+// backlogDrop 等待通知 onDrop 的丢弃记录
+type backlogDrop struct {
+	id     int64
+	label  string
+	reason error
+}
+
+// limitedBacklog 有限制的积压存储
+type limitedBacklog struct {
+	BacklogStore
+	lock    sync.Mutex
+	cond    *sync.Cond
+	limit   BacklogLimit
+	order   *list.List              // 按Put时间排列, 队首最早
+	entries map[int64]*list.Element // id -> backlogEntry
+	bytes   int64
+	closed  bool
+	stats   BacklogDropStats
+	onDrop  func(id int64, label string, reason error) // 数据被丢弃时调用, 调用时不持有锁
+	dropped []backlogDrop                              // 持有锁期间丢弃的数据, 解锁后通知 onDrop
+}
+
+func backlogEntrySize(putData *PutData) int64 {
+	return int64(len(putData.Label) + len(putData.Body))
+}
+
+// newLimitedBacklog 为积压存储加上限制, 已有的数据按限制处理
+func newLimitedBacklog(store BacklogStore, limit BacklogLimit) (*limitedBacklog, error) {
+	if err := limit.check(); err != nil {
+		return nil, err
+	}
+	b := &limitedBacklog{
+		BacklogStore: store,
+		limit:        limit,
+		order:        list.New(),
+		entries:      make(map[int64]*list.Element),
+	}
+	b.cond = sync.NewCond(&b.lock)
+	now := time.Now().UnixMilli()
+	exist := make([]*backlogEntry, 0, store.Len())
+	err := store.Range(func(putData PutData) bool {
+		t := putData.Time
+		if t == 0 {
+			t = now
+		}
+		exist = append(exist, &backlogEntry{id: putData.Id, label: putData.Label, size: backlogEntrySize(&putData), time: t})
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(exist, func(i, j int) bool { return exist[i].time < exist[j].time })
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, e := range exist {
+		b.push(e)
+	}
+	b.expire()
+	for b.limit.Overflow == BacklogDropOldest && b.over(0, 0) && b.order.Len() > 0 {
+		b.dropOldest()
+	}
+	return b, nil
+}
+
+// push 记录一条数据, 调用方持有锁
+func (b *limitedBacklog) push(e *backlogEntry) {
+	b.entries[e.id] = b.order.PushBack(e)
+	b.bytes += e.size
+}
+
+// remove 移除一条数据的记录并唤醒阻塞的 Put, 调用方持有锁
+func (b *limitedBacklog) remove(elem *list.Element) *backlogEntry {
+	e := b.order.Remove(elem).(*backlogEntry)
+	delete(b.entries, e.id)
+	b.bytes -= e.size
+	b.cond.Broadcast()
+	return e
+}
+
+// over 再写入 n 条共 size 字节的数据是否超过限制, 调用方持有锁
+func (b *limitedBacklog) over(n int, size int64) bool {
+	if b.limit.MaxEntries > 0 && b.order.Len()+n > b.limit.MaxEntries {
+		return true
+	}
+	return b.limit.MaxBytes > 0 && b.bytes+size > b.limit.MaxBytes
+}
+
+// drop 从存储中删除一条数据, 记录后由 unlock 通知 onDrop, 调用方持有锁
+func (b *limitedBacklog) drop(elem *list.Element, reason error) {
+	e := b.remove(elem)
+	if err := b.BacklogStore.Ack(e.id); err != nil {
+		Error("丢弃积压数据失败 err:", err)
+	}
+	if b.onDrop != nil {
+		b.dropped = append(b.dropped, backlogDrop{id: e.id, label: e.label, reason: reason})
+	}
+}
+
+// unlock 解锁后通知持有锁期间丢弃的数据
+func (b *limitedBacklog) unlock() {
+	dropped := b.dropped
+	b.dropped = nil
+	b.lock.Unlock()
+	for _, d := range dropped {
+		b.onDrop(d.id, d.label, d.reason)
+	}
+}
+
+func (b *limitedBacklog) dropOldest() {
+	b.drop(b.order.Front(), ErrBacklogDropped)
+	atomic.AddUint64(&b.stats.Oldest, 1)
+}
+
+// expire 丢弃超过 TTL 的数据, 调用方持有锁
+func (b *limitedBacklog) expire() {
+	if b.limit.TTL <= 0 {
+		return
+	}
+	before := time.Now().Add(-b.limit.TTL).UnixMilli()
+	for elem := b.order.Front(); elem != nil; elem = b.order.Front() {
+		if elem.Value.(*backlogEntry).time >= before {
+			return
+		}
+		b.drop(elem, ErrBacklogExpired)
+		atomic.AddUint64(&b.stats.Expired, 1)
+	}
+}
+
+func (b *limitedBacklog) Add(putData PutData) error {
+	return b.addContext(context.Background(), putData)
+}
+
+// addContext 写入数据, BacklogBlock 阻塞时 ctx 取消或超时返回 ctx.Err(), 数据不写入
+func (b *limitedBacklog) addContext(ctx context.Context, putData PutData) error {
+	b.lock.Lock()
+	defer b.unlock()
+	if b.closed {
+		return ErrBacklogClosed
+	}
+	if _, ok := b.entries[putData.Id]; ok {
+		return nil
+	}
+	size := backlogEntrySize(&putData)
+	if b.limit.MaxBytes > 0 && size > b.limit.MaxBytes {
+		atomic.AddUint64(&b.stats.Rejected, 1)
+		return ErrBacklogFull
+	}
+	b.expire()
+	for b.over(1, size) {
+		switch b.limit.Overflow {
+		case BacklogDropNewest:
+			atomic.AddUint64(&b.stats.Newest, 1)
+			return ErrBacklogDropped
+		case BacklogReject:
+			atomic.AddUint64(&b.stats.Rejected, 1)
+			return ErrBacklogFull
+		case BacklogBlock:
+			if len(b.dropped) > 0 {
+				// 阻塞前先通知已丢弃的数据, 重新加锁后再检查
+				b.unlock()
+				b.lock.Lock()
+			} else if err := b.wait(ctx); err != nil {
+				return err
+			}
+			if b.closed {
+				return ErrBacklogClosed
+			}
+			b.expire()
+		default:
+			b.dropOldest()
+		}
+	}
+	t := putData.Time
+	if t == 0 {
+		t = time.Now().UnixMilli()
+	}
+	b.push(&backlogEntry{id: putData.Id, label: putData.Label, size: size, time: t})
+	if err := b.BacklogStore.Add(putData); err != nil {
+		b.remove(b.entries[putData.Id])
+		return err
+	}
+	return nil
+}
+
+// wait 等待数据被确认或过期, ctx 取消时唤醒, 调用方持有锁
+func (b *limitedBacklog) wait(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.Done() != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				b.lock.Lock()
+				b.cond.Broadcast()
+				b.lock.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+	b.cond.Wait()
+	return ctx.Err()
+}
+
+func (b *limitedBacklog) Ack(id int64) error {
+	b.lock.Lock()
+	if elem, ok := b.entries[id]; ok {
+		b.remove(elem)
+	}
+	b.lock.Unlock()
+	return b.BacklogStore.Ack(id)
+}
+
+// Range 先丢弃过期的数据, 避免重发
+func (b *limitedBacklog) Range(f func(putData PutData) bool) error {
+	b.sweep()
+	return b.BacklogStore.Range(f)
+}
+
+// sweep 丢弃过期的数据, 由c端时间轮调用
+func (b *limitedBacklog) sweep() {
+	b.lock.Lock()
+	defer b.unlock()
+	b.expire()
+}
+
+func (b *limitedBacklog) Close() error {
+	b.lock.Lock()
+	b.closed = true
+	b.cond.Broadcast()
+	b.lock.Unlock()
+	return b.BacklogStore.Close()
+}
+
+func (b *limitedBacklog) snapshot() BacklogDropStats {
+	return BacklogDropStats{
+		Oldest:   atomic.LoadUint64(&b.stats.Oldest),
+		Newest:   atomic.LoadUint64(&b.stats.Newest),
+		Rejected: atomic.LoadUint64(&b.stats.Rejected),
+		Expired:  atomic.LoadUint64(&b.stats.Expired),
+	}
+}
+
+// BacklogDropStats 积压数据因限制丢弃的数量, 未设置 ClientConf.BacklogLimit 时为零
+func (c *Client) BacklogDropStats() BacklogDropStats {
+	if b, ok := c.backlog.(*limitedBacklog); ok {
+		return b.snapshot()
+	}
+	return BacklogDropStats{}
+}
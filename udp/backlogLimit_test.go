@@ -0,0 +1,207 @@
+package udp
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func limitedStore(t *testing.T, limit BacklogLimit) *limitedBacklog {
+	t.Helper()
+	b, err := newLimitedBacklog(NewMemoryBacklog(), limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func limitedAdd(b *limitedBacklog, ids ...int64) error {
+	for _, id := range ids {
+		if err := b.Add(PutData{Label: "l", Id: id, Body: []byte("body")}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestBacklogDropOldest(t *testing.T) {
+	b := limitedStore(t, BacklogLimit{MaxEntries: 2})
+	if err := limitedAdd(b, 1, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	if got := backlogIds(t, b); len(got) != 2 || got[0] != 2 || got[1] != 3 {
+		t.Fatalf("got %v", got)
+	}
+	if stats := b.snapshot(); stats != (BacklogDropStats{Oldest: 1}) {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+func TestBacklogDropNewest(t *testing.T) {
+	b := limitedStore(t, BacklogLimit{MaxEntries: 2, Overflow: BacklogDropNewest})
+	_ = limitedAdd(b, 1, 2)
+	if err := limitedAdd(b, 3); err != ErrBacklogDropped {
+		t.Fatalf("err = %v", err)
+	}
+	if got := backlogIds(t, b); len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Fatalf("got %v", got)
+	}
+	if stats := b.snapshot(); stats != (BacklogDropStats{Newest: 1}) {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+func TestBacklogReject(t *testing.T) {
+	// 每条 label+body 5 字节
+	b := limitedStore(t, BacklogLimit{MaxBytes: 10, Overflow: BacklogReject})
+	_ = limitedAdd(b, 1, 2)
+	if err := limitedAdd(b, 3); err != ErrBacklogFull {
+		t.Fatalf("err = %v", err)
+	}
+	if err := b.Add(PutData{Id: 4, Body: make([]byte, 11)}); err != ErrBacklogFull {
+		t.Fatalf("entry larger than MaxBytes: err = %v", err)
+	}
+	if b.Len() != 2 {
+		t.Fatalf("len %d", b.Len())
+	}
+	if stats := b.snapshot(); stats != (BacklogDropStats{Rejected: 2}) {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+func TestBacklogBlock(t *testing.T) {
+	if _, err := newLimitedBacklog(NewMemoryBacklog(), BacklogLimit{MaxEntries: 1, Overflow: BacklogBlock}); err != ErrBacklogBlockTTL {
+		t.Fatalf("block without TTL: err = %v", err)
+	}
+	b := limitedStore(t, BacklogLimit{MaxEntries: 1, TTL: time.Hour, Overflow: BacklogBlock})
+	_ = limitedAdd(b, 1)
+	done := make(chan error, 1)
+	go func() { done <- limitedAdd(b, 2) }()
+	select {
+	case err := <-done:
+		t.Fatalf("add returned %v while full", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// 确认后唤醒阻塞的 Put
+	_ = b.Ack(1)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("add still blocked after ack")
+	}
+	// 关闭后唤醒阻塞的 Put
+	go func() { done <- limitedAdd(b, 3) }()
+	time.Sleep(20 * time.Millisecond)
+	_ = b.Close()
+	select {
+	case err := <-done:
+		if err != ErrBacklogClosed {
+			t.Fatalf("err = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("add still blocked after close")
+	}
+}
+
+// ctx 取消后阻塞的 Put 返回, 数据不写入
+func TestBacklogBlockContext(t *testing.T) {
+	b := limitedStore(t, BacklogLimit{MaxEntries: 1, TTL: time.Hour, Overflow: BacklogBlock})
+	_ = limitedAdd(b, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- b.addContext(ctx, PutData{Label: "l", Id: 2}) }()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("err = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("add still blocked after cancel")
+	}
+	if got := backlogIds(t, b); len(got) != 1 || got[0] != 1 {
+		t.Fatalf("got %v", got)
+	}
+}
+
+// onDrop 在解锁后调用, 可以再写入积压
+func TestBacklogOnDropUnlocked(t *testing.T) {
+	b := limitedStore(t, BacklogLimit{MaxEntries: 2})
+	var dropped []int64
+	b.onDrop = func(id int64, label string, reason error) {
+		if !b.lock.TryLock() {
+			t.Errorf("onDrop %d called with the lock held", id)
+			return
+		}
+		b.lock.Unlock()
+		if reason != ErrBacklogDropped {
+			t.Errorf("reason %v", reason)
+		}
+		dropped = append(dropped, id)
+		if id == 1 {
+			_ = limitedAdd(b, 10)
+		}
+	}
+	_ = limitedAdd(b, 1, 2, 3)
+	if len(dropped) != 2 || dropped[0] != 1 || dropped[1] != 2 {
+		t.Fatalf("dropped %v", dropped)
+	}
+	if got := backlogIds(t, b); len(got) != 2 || got[0] != 3 || got[1] != 10 {
+		t.Fatalf("got %v", got)
+	}
+}
+
+// 过期的数据被丢弃, 阻塞的 Put 随之返回
+func TestBacklogTTL(t *testing.T) {
+	b := limitedStore(t, BacklogLimit{MaxEntries: 1, TTL: 30 * time.Millisecond, Overflow: BacklogBlock})
+	_ = limitedAdd(b, 1)
+	done := make(chan error, 1)
+	go func() { done <- limitedAdd(b, 2) }()
+	time.Sleep(50 * time.Millisecond)
+	b.sweep()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("add still blocked after the oldest entry expired")
+	}
+	if got := backlogIds(t, b); len(got) != 1 || got[0] != 2 {
+		t.Fatalf("got %v", got)
+	}
+	// 打开时已经过期的数据直接丢弃
+	store := NewMemoryBacklog()
+	_ = store.Add(PutData{Id: 3, Time: time.Now().Add(-time.Hour).UnixMilli()})
+	_ = store.Add(PutData{Id: 4})
+	reopened, err := newLimitedBacklog(store, BacklogLimit{TTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := backlogIds(t, reopened); len(got) != 1 || got[0] != 4 {
+		t.Fatalf("reopened %v", got)
+	}
+	if stats := reopened.snapshot(); stats != (BacklogDropStats{Expired: 1}) {
+		t.Fatalf("stats %+v", stats)
+	}
+	if stats := b.snapshot(); stats.Expired != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+func TestClientBacklogDropStats(t *testing.T) {
+	c := &Client{backlog: NewMemoryBacklog()}
+	if stats := c.BacklogDropStats(); stats != (BacklogDropStats{}) {
+		t.Fatalf("stats without limit %+v", stats)
+	}
+	b := limitedStore(t, BacklogLimit{MaxEntries: 1})
+	_ = limitedAdd(b, 1, 2)
+	c.backlog = b
+	if stats := c.BacklogDropStats(); stats.Oldest != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
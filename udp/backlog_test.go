@@ -0,0 +1,233 @@
+package udp
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestBacklogUdbFile(t *testing.T) {
+	prefix := backlogPrefix("c1", "127.0.0.1:1234")
+	other := backlogPrefix("c2", "127.0.0.1:1234")
+	own := prefix + "_1700000000.udb"
+
+	cases := []struct {
+		prefix string
+		legacy bool
+		name   string
+		want   bool
+	}{
+		{prefix, false, own, true},
+		{prefix, false, "1700000000.udb", false},
+		{prefix, false, prefix + "_1700000000.log", false},
+		{prefix, true, "1700000000.udb", true},
+		{prefix, true, own, true},
+		{other, false, own, false},
+	}
+	for _, v := range cases {
+		if got := isUdbFile(v.name, v.prefix, v.legacy); got != v.want {
+			t.Errorf("%s legacy=%v isUdbFile(%s) = %v, want %v", v.prefix, v.legacy, v.name, got, v.want)
+		}
+	}
+}
+
+// writeUdb 在当前目录写入旧版的 .udb 文件, 每行一个 JSON 的 PutData
+func writeUdb(t *testing.T, name string, ids ...int64) {
+	t.Helper()
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	for _, id := range ids {
+		b, _ := ObjToByte(&PutData{Label: "udb", Id: id})
+		_, _ = f.Write(append(b, '\n'))
+	}
+}
+
+func chdirTemp(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.Chdir(wd)
+	})
+}
+
+func TestImportUdb(t *testing.T) {
+	chdirTemp(t)
+	prefix := backlogPrefix("c1", "127.0.0.1:8080")
+	writeUdb(t, prefix+"_1.udb", 1, 2)
+	writeUdb(t, backlogPrefix("c2", "127.0.0.1:8080")+"_1.udb", 3)
+	writeUdb(t, "1700000000.udb", 4)
+
+	store, err := NewWALBacklog(filepath.Join("backlog", prefix), WALSyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = store.Close()
+	}()
+	importUdb(store, prefix, false)
+	if store.Len() != 2 {
+		t.Fatalf("imported %d entries, want 2", store.Len())
+	}
+	if _, err = os.Stat(prefix + "_1.udb"); !os.IsNotExist(err) {
+		t.Fatal("imported file kept")
+	}
+	// 没有记录服务端的文件只在开启后导入
+	if _, err = os.Stat("1700000000.udb"); err != nil {
+		t.Fatal("unprefixed file imported without opt-in")
+	}
+	importUdb(store, prefix, true)
+	if store.Len() != 3 {
+		t.Fatalf("imported %d entries, want 3", store.Len())
+	}
+	if _, err = os.Stat(backlogPrefix("c2", "127.0.0.1:8080") + "_1.udb"); err != nil {
+		t.Fatal("another client's file imported")
+	}
+}
+
+// 旧版一行一条 JSON, 超过读取缓冲区的行完整导入
+func TestBacklogUdbImportLongLine(t *testing.T) {
+	store := NewMemoryBacklog()
+	long := PutData{Label: "long", Id: 1, Body: bytes.Repeat([]byte("x"), 64<<10)}
+	lines := make([]byte, 0)
+	for _, putData := range []PutData{long, {Label: "short", Id: 2}} {
+		line, err := ObjToByte(putData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+	name := filepath.Join(t.TempDir(), "c1_1700000000.udb")
+	if err := os.WriteFile(name, lines[:len(lines)-1], 0644); err != nil {
+		t.Fatal(err)
+	}
+	n, err := udbToBacklog(store, name)
+	if err != nil || n != 2 {
+		t.Fatalf("imported %d %v", n, err)
+	}
+	got := backlogIds(t, store)
+	if len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Fatalf("got %v", got)
+	}
+	_ = store.Range(func(putData PutData) bool {
+		if putData.Id == 1 && !bytes.Equal(putData.Body, long.Body) {
+			t.Fatal("long line truncated")
+		}
+		return true
+	})
+}
+
+// customBacklog 没有实现 DurableBacklog 的自定义存储
+type customBacklog struct {
+	BacklogStore
+}
+
+func TestDurableBacklog(t *testing.T) {
+	wal, err := NewWALBacklog(t.TempDir(), WALSyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = wal.Close()
+	}()
+	bolt, err := NewBoltBacklog(filepath.Join(t.TempDir(), "backlog.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = bolt.Close()
+	}()
+	cases := []struct {
+		store BacklogStore
+		want  bool
+	}{
+		{NewMemoryBacklog(), false},
+		{wal, true},
+		{bolt, true},
+		{customBacklog{wal}, false},
+	}
+	for _, v := range cases {
+		durable, ok := v.store.(DurableBacklog)
+		if got := ok && durable.Durable(); got != v.want {
+			t.Errorf("%T durable = %v, want %v", v.store, got, v.want)
+		}
+	}
+}
+
+func backlogIds(t *testing.T, store BacklogStore) []int64 {
+	t.Helper()
+	ids := make([]int64, 0, store.Len())
+	if err := store.Range(func(putData PutData) bool {
+		ids = append(ids, putData.Id)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// 内置存储的 Add, Ack, Range, Len 行为一致, 持久化的存储重新打开后恢复未确认的数据
+func TestBacklogStores(t *testing.T) {
+	walDir, boltPath := t.TempDir(), filepath.Join(t.TempDir(), "backlog.db")
+	stores := []struct {
+		name string
+		open func() (BacklogStore, error)
+	}{
+		{"memory", func() (BacklogStore, error) { return NewMemoryBacklog(), nil }},
+		{"wal", func() (BacklogStore, error) { return NewWALBacklog(walDir, WALSyncNever) }},
+		{"bolt", func() (BacklogStore, error) { return NewBoltBacklog(boltPath) }},
+	}
+	for _, v := range stores {
+		t.Run(v.name, func(t *testing.T) {
+			store, err := v.open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, id := range []int64{1, 2, 3, 2} {
+				if err = store.Add(PutData{Label: "l", Id: id, Body: []byte("b")}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if store.Len() != 3 {
+				t.Fatalf("len %d after a duplicate add, want 3", store.Len())
+			}
+			if err = store.Ack(2); err != nil {
+				t.Fatal(err)
+			}
+			if err = store.Ack(9); err != nil {
+				t.Fatal("ack of an unknown id:", err)
+			}
+			if got := backlogIds(t, store); len(got) != 2 || got[0] != 1 || got[1] != 3 {
+				t.Fatalf("got %v", got)
+			}
+			if err = store.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if v.name == "memory" {
+				return
+			}
+			if store, err = v.open(); err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = store.Close()
+			}()
+			if got := backlogIds(t, store); len(got) != 2 || got[0] != 1 || got[1] != 3 {
+				t.Fatalf("reopened %v", got)
+			}
+		})
+	}
+}
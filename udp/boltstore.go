@@ -0,0 +1,117 @@
+package udp
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltBacklogBucket = []byte("backlog")
+
+// boltBacklog 积压数据保存在嵌入式 KV(bbolt) 中, key = PutData.Id(大端), value = PutData 二进制信封
+// 不占用内存, 适合积压量大的c端; 每次写入与确认都是一次刷盘的事务
+type boltBacklog struct {
+	db    *bolt.DB
+	count int64
+}
+
+// NewBoltBacklog 打开 path 的 bbolt 数据库作为积压存储, 文件不存在时创建
+// 同一个文件同时只能由一个进程打开, 被占用时等待1秒后返回错误
+func NewBoltBacklog(path string) (BacklogStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	b := &boltBacklog{db: db}
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(boltBacklogBucket)
+		if err != nil {
+			return err
+		}
+		b.count = int64(bucket.Stats().KeyN)
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func boltKey(id int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
+
+func (b *boltBacklog) Add(putData PutData) error {
+	value, err := putData.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	added := false
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBacklogBucket)
+		key := boltKey(putData.Id)
+		if bucket.Get(key) != nil {
+			return nil
+		}
+		added = true
+		return bucket.Put(key, value)
+	})
+	if err == nil && added {
+		atomic.AddInt64(&b.count, 1)
+	}
+	return err
+}
+
+func (b *boltBacklog) Ack(id int64) error {
+	deleted := false
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBacklogBucket)
+		key := boltKey(id)
+		if bucket.Get(key) == nil {
+			return nil
+		}
+		deleted = true
+		return bucket.Delete(key)
+	})
+	if err == nil && deleted {
+		atomic.AddInt64(&b.count, -1)
+	}
+	return err
+}
+
+// Range 按 Id 顺序遍历, f 在只读事务中执行
+func (b *boltBacklog) Range(f func(putData PutData) bool) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltBacklogBucket).Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			putData := PutData{}
+			// value 只在事务内有效, 解码后的 Body 引用 value, 需要复制
+			if err := putData.UnmarshalBinary(append([]byte(nil), v...)); err != nil {
+				Error("积压数据解析失败 err:", err)
+				continue
+			}
+			if !f(putData) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+func (b *boltBacklog) Len() int {
+	return int(atomic.LoadInt64(&b.count))
+}
+
+func (b *boltBacklog) Close() error {
+	return b.db.Close()
+}
+
+// Durable 见 DurableBacklog
+func (b *boltBacklog) Durable() bool {
+	return true
+}
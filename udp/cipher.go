@@ -0,0 +1,218 @@
+package udp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+/*
+
+数据包加密套件
+
+AEAD 套件(AES-256-GCM, ChaCha20-Poly1305):
+______________________________________________________________
+|                |              |                            |
+|  包头(15字节)   | nonce(12字节) |  密文 + 认证标签(16字节)...  |
+|________________|______________|____________________________|
+
+1. 每个包使用随机 nonce，相同明文得到不同密文
+2. 包头(指令,name,签名) 作为附加认证数据，被篡改的包头无法解密
+3. 秘钥由 SecretKey 经 sha256 派生为 32 字节
+
+DES ECB 仅作为旧版兼容，用于已部署的节点迁移，不建议继续使用
+
+迁移: 默认套件为 AES-256-GCM, 升级s端时设置 ServersConf.LegacySecretKey 为原来的 DES 秘钥,
+s端先使用配置的套件解密, 失败时使用 DES ECB 解密并按该c端的地址回包, 之后逐个升级c端, 全部升级后移除;
+未设置时仍使用 DES ECB 的c端无法连接, 需要同时升级所有节点
+
+*/
+
+// CipherSuite 加密套件
+type CipherSuite uint8
+
+const (
+	CipherAES256GCM        CipherSuite = iota // AES-256-GCM 默认
+	CipherChaCha20Poly1305                    // ChaCha20-Poly1305 适用于无AES硬件加速的设备
+	CipherDesECB                              // DES ECB 旧版兼容
+)
+
+func (suite CipherSuite) String() string {
+	switch suite {
+	case CipherAES256GCM:
+		return "AES-256-GCM"
+	case CipherChaCha20Poly1305:
+		return "ChaCha20-Poly1305"
+	case CipherDesECB:
+		return "DES-ECB"
+	}
+	return "unknown"
+}
+
+// Cipher 数据包加解密, header 为包头会作为附加认证数据
+type Cipher interface {
+	Suite() CipherSuite
+	Encrypt(header, data []byte) ([]byte, error)
+	Decrypt(header, data []byte) ([]byte, error)
+}
+
+// NewCipher 根据加密套件和秘钥创建 Cipher
+func NewCipher(suite CipherSuite, secretKey string) (Cipher, error) {
+	switch suite {
+	case CipherAES256GCM, CipherChaCha20Poly1305:
+		if len(secretKey) < 1 {
+			return nil, ErrSecretKeyEmpty
+		}
+		return newAEADCipher(suite, deriveKey(secretKey))
+	case CipherDesECB:
+		if len(secretKey) != 8 {
+			return nil, ErrDesSecretKey
+		}
+		return &desCipher{key: []byte(secretKey)}, nil
+	}
+	return nil, ErrCipherSuite(suite)
+}
+
+// deriveKey 将任意长度的秘钥派生为32字节
+func deriveKey(secretKey string) []byte {
+	sum := sha256.Sum256([]byte("beacon-tower/udp:" + secretKey))
+	return sum[:]
+}
+
+// newAEADCipher 使用32字节的 key 创建 AEAD 套件
+func newAEADCipher(suite CipherSuite, key []byte) (Cipher, error) {
+	switch suite {
+	case CipherAES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		return &aeadCipher{suite: suite, aead: aead}, nil
+	case CipherChaCha20Poly1305:
+		aead, err := chacha20poly1305.New(key)
+		if err != nil {
+			return nil, err
+		}
+		return &aeadCipher{suite: suite, aead: aead}, nil
+	}
+	return nil, ErrCipherSuite(suite)
+}
+
+type aeadCipher struct {
+	suite CipherSuite
+	aead  cipher.AEAD
+}
+
+func (a *aeadCipher) Suite() CipherSuite {
+	return a.suite
+}
+
+func (a *aeadCipher) Encrypt(header, data []byte) ([]byte, error) {
+	nonceSize := a.aead.NonceSize()
+	out := make([]byte, nonceSize, nonceSize+len(data)+a.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, out); err != nil {
+		return nil, err
+	}
+	return a.aead.Seal(out, out[:nonceSize], data, header), nil
+}
+
+func (a *aeadCipher) Decrypt(header, data []byte) ([]byte, error) {
+	nonceSize := a.aead.NonceSize()
+	if len(data) < nonceSize+a.aead.Overhead() {
+		return nil, ErrDecrypt
+	}
+	out, err := a.aead.Open(nil, data[:nonceSize], data[nonceSize:], header)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return out, nil
+}
+
+type desCipher struct {
+	key []byte
+}
+
+func (d *desCipher) Suite() CipherSuite {
+	return CipherDesECB
+}
+
+func (d *desCipher) Encrypt(header, data []byte) ([]byte, error) {
+	out := DesECBEncrypt(data, d.key)
+	if out == nil {
+		return nil, ErrEncrypt
+	}
+	return out, nil
+}
+
+func (d *desCipher) Decrypt(header, data []byte) ([]byte, error) {
+	out := DesECBDecrypt(data, d.key)
+	if out == nil {
+		return nil, ErrDecrypt
+	}
+	return out, nil
+}
+
+// SetLegacySecretKey 设置迁移期间兼容的 DES ECB 秘钥(8个字节), 为空时不再兼容
+func (s *Servers) SetLegacySecretKey(key string) error {
+	if key == "" {
+		s.legacy = nil
+		return nil
+	}
+	legacy, err := NewCipher(CipherDesECB, key)
+	if err != nil {
+		return err
+	}
+	s.legacy = legacy
+	return nil
+}
+
+// addrCipher s端向 addr 发包使用的加密套件, 迁移期间使用 DES ECB 的c端回 DES ECB
+func (s *Servers) addrCipher(addr string) Cipher {
+	if s.legacy != nil {
+		if _, ok := s.legacyAddrs.Load(addr); ok {
+			return s.legacy
+		}
+	}
+	return s.cipher
+}
+
+// openPacket s端解包, 迁移期间配置的套件解密失败时尝试 DES ECB, 并记录该地址是否使用 DES ECB
+// 协商了认证码的c端先校验认证码(见 mac.go), 建立了会话密钥的c端只使用会话密钥(见 kex.go)
+func (s *Servers) openPacket(addr string, data []byte, n int) (*Packet, error) {
+	sess, ok := s.packetSession(addr, data[:n])
+	if ok && sess.mac != nil {
+		if n, ok = sess.mac.open(data, n); !ok {
+			return nil, ErrPacketMAC
+		}
+		packet, err := PacketDecrypt(s.sessionCipher(addr, sess), data, n)
+		if err != nil {
+			return nil, err
+		}
+		packet.authed = true
+		return packet, nil
+	}
+	if ok && sess.keys != nil {
+		return PacketDecrypt(sess.keys, data, n)
+	}
+	packet, err := PacketDecrypt(s.cipher, data, n)
+	if err == nil || s.legacy == nil || s.cipher.Suite() == CipherDesECB {
+		if err == nil && s.legacy != nil {
+			s.legacyAddrs.Delete(addr)
+		}
+		return packet, err
+	}
+	packet, lErr := PacketDecrypt(s.legacy, data, n)
+	if lErr != nil {
+		return nil, err
+	}
+	s.legacyAddrs.Store(addr, true)
+	return packet, nil
+}
@@ -0,0 +1,138 @@
+package udp
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	CloseLog()
+	os.Exit(m.Run())
+}
+
+func TestCipherSuites(t *testing.T) {
+	header := []byte("header")
+	data := []byte("beacon-tower cipher test data")
+	for _, suite := range []CipherSuite{CipherAES256GCM, CipherChaCha20Poly1305} {
+		t.Run(suite.String(), func(t *testing.T) {
+			c, err := NewCipher(suite, "cipher-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := c.Encrypt(header, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			again, _ := c.Encrypt(header, data)
+			if bytes.Equal(out, again) {
+				t.Fatal("same ciphertext for the same data")
+			}
+			plain, err := c.Decrypt(header, out)
+			if err != nil || !bytes.Equal(plain, data) {
+				t.Fatalf("round trip %q %v", plain, err)
+			}
+			if _, err = c.Decrypt([]byte("headex"), out); err != ErrDecrypt {
+				t.Fatal("tampered header accepted")
+			}
+			tampered := append([]byte(nil), out...)
+			tampered[len(tampered)-1] ^= 1
+			if _, err = c.Decrypt(header, tampered); err != ErrDecrypt {
+				t.Fatal("tampered ciphertext accepted")
+			}
+			if _, err = c.Decrypt(header, out[:8]); err != ErrDecrypt {
+				t.Fatal("short data accepted")
+			}
+			wrong, _ := NewCipher(suite, "wrong-key")
+			if _, err = wrong.Decrypt(header, out); err != ErrDecrypt {
+				t.Fatal("wrong key accepted")
+			}
+		})
+	}
+}
+
+func TestCipherDes(t *testing.T) {
+	if _, err := NewCipher(CipherDesECB, "short"); err != ErrDesSecretKey {
+		t.Fatalf("got %v", err)
+	}
+	c, _ := NewCipher(CipherDesECB, "12345678")
+	out, err := c.Encrypt(nil, []byte("legacy data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := c.Decrypt(nil, out); err != nil || string(plain) != "legacy data" {
+		t.Fatalf("round trip %q %v", plain, err)
+	}
+	if _, err = NewCipher(CipherAES256GCM, ""); err != ErrSecretKeyEmpty {
+		t.Fatalf("got %v", err)
+	}
+}
+
+// 包头(指令,name,签名)被篡改或秘钥不一致的包无法解包
+func TestPacketCipher(t *testing.T) {
+	for _, suite := range []CipherSuite{CipherAES256GCM, CipherChaCha20Poly1305, CipherDesECB} {
+		t.Run(suite.String(), func(t *testing.T) {
+			c, _ := NewCipher(suite, "12345678")
+			b, err := PacketEncoder(CommandPut, "c", "sign123", c, []byte("packet data"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			packet, err := PacketDecrypt(c, b, len(b))
+			if err != nil || string(packet.Data) != "packet data" || packet.Sign != "sign123" {
+				t.Fatalf("round trip %+v %v", packet, err)
+			}
+			wrong, _ := NewCipher(suite, "87654321")
+			if _, err = PacketDecrypt(wrong, b, len(b)); err == nil {
+				t.Fatal("wrong key accepted")
+			}
+			if suite == CipherDesECB {
+				return
+			}
+			tampered := append([]byte(nil), b...)
+			tampered[1] = 'x'
+			if _, err = PacketDecrypt(c, tampered, len(tampered)); err == nil {
+				t.Fatal("tampered header accepted")
+			}
+		})
+	}
+}
+
+// 迁移期间s端同时接受 DES ECB 的c端, 并按该地址回 DES ECB
+func TestLegacyCipher(t *testing.T) {
+	s, err := NewServers("127.0.0.1", 0, ServersConf{SecretKey: "new-key", LegacySecretKey: "12345678"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = s.Conn.Close()
+	})
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9}
+	des, _ := NewCipher(CipherDesECB, "12345678")
+	old, _ := PacketEncoder(CommandPut, "c", "sign123", des, []byte("old"))
+	packet, err := s.openPacket(addr.String(), old, len(old))
+	if err != nil || string(packet.Data) != "old" {
+		t.Fatalf("legacy packet %v", err)
+	}
+	if s.addrCipher(addr.String()).Suite() != CipherDesECB {
+		t.Fatal("legacy client answered with the new suite")
+	}
+	upgraded, _ := PacketEncoder(CommandPut, "c", "sign123", s.cipher, []byte("new"))
+	if _, err = s.openPacket(addr.String(), upgraded, len(upgraded)); err != nil {
+		t.Fatal(err)
+	}
+	if s.addrCipher(addr.String()).Suite() != CipherAES256GCM {
+		t.Fatal("upgraded client answered with DES")
+	}
+	wrong, _ := NewCipher(CipherDesECB, "87654321")
+	bad, _ := PacketEncoder(CommandPut, "c", "sign123", wrong, []byte("bad"))
+	if _, err = s.openPacket(addr.String(), bad, len(bad)); err == nil {
+		t.Fatal("wrong DES key accepted")
+	}
+	if err = s.SetLegacySecretKey(""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.openPacket(addr.String(), old, len(old)); err == nil {
+		t.Fatal("legacy packet accepted after migration")
+	}
+}
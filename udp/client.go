@@ -1,12 +1,16 @@
 package udp
 
 import (
-	"fmt"
+	"context"
+	"crypto/ed25519"
+	"encoding"
+	"errors"
 	"net"
 	"os"
 	"os/signal"
-	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -17,17 +21,69 @@ type Client struct {
 	SConn        *net.UDPAddr     // s端连接信息
 	name         string           // client的名称
 	connectCode  string           // 连接code 是静态的由server端配发
-	state        int              // 0:未连接   1:连接成功  2:server端丢失
-	sign         string           // 签名
+	state        ClientState      // 连接状态
+	sign         atomic.Value     // 签名 string, 收到连接回应时更新
 	secretKey    string           // 数据传输加密解密秘钥
+	cipher       Cipher           // 数据包加密套件
+	jsonEnvelope bool             // 发送旧版 JSON 信封
+	version      uint32           // 使用的协议版本
+	features     uint32           // 与s端协商的特性
+	seq          uint64           // 防重放序号
+	stamp        int64            // 连接包与心跳包的时间戳ms, 见 replay.go
 	GetHandle    ClientGetFunc    // get方法
 	NoticeHandle ClientNoticeFunc // 接收通知的方法
+	fragment     *fragmentBuffer  // 分片重组
+	closer       *closer          // 优雅关闭
+	backlog      BacklogStore     // 积压的数据
+	getDataMap   sync.Map         // 等待s端返回的get请求
+	putWait      sync.Map         // 等待s端确认的 PutAsync, putId -> *PutFuture
+	putLabels    sync.Map         // 未确认的Put, putId -> label, 用于确认与丢弃回调
+	putHooks     putHooks         // Put确认与丢弃的回调
+
+	stateLock     sync.Mutex                            // 保护 state, onStateChange, backoff
+	stateNotify   notifier                              // 按顺序执行状态变化回调
+	onStateChange func(c *Client, from, to ClientState) // 状态变化回调
+	backoff       Backoff                               // 连接/重连的指数退避
+	wake          chan struct{}                         // 状态变化时唤醒时间轮
+	lastRecv      int64                                 // 最后一次收到s端数据包的时间 UnixNano
+
+	maxVersion       uint32 // 设置的协议版本, 每次重连先按该版本连接
+	connectedVersion int32  // 最近一次连接成功的协议版本, -1 为从未连接成功, 见 versionRejected
+
+	putEpoch   int64             // Put序号的 Epoch, 启动的时间
+	putSeq     map[string]uint64 // 每个标签的Put序号
+	putSeqLock sync.Mutex        // 保护 putSeq
+
+	kxLock       sync.Mutex        // 保护 kxPriv, kxPub, keys, serverKeyPin, mac 与签名的更新
+	kxPriv       []byte            // 最近一次连接包的临时私钥, 收到回应后丢弃
+	kxPub        []byte            // 最近一次连接包的临时公钥
+	keys         *sessionKeys      // 密钥交换的会话密钥
+	serverKeyPin ed25519.PublicKey // 固定的s端身份公钥
+	mac          *packetMAC        // 包认证密钥
+
+	prevSign   atomic.Value    // 上一次的签名 string
+	strictAuth uint32          // 严格模式, 只接受认证码, 见 serverAuth.go
+	authStats  ServerAuthStats // 未通过认证的s端包数量
 }
 
 type ClientConf struct {
 	Name        string
 	ConnectCode string
-	SecretKey   string // 数据传输加密解密秘钥
+	SecretKey   string      // 数据传输加密解密秘钥, DES ECB 时为8个字节
+	CipherSuite CipherSuite // 加密套件 默认 AES-256-GCM, 需与Servers端统一
+	Backoff     Backoff     // 连接/重连的指数退避, 零值使用默认值
+
+	LegacyProtocol bool // 使用旧版协议(版本0)与未升级的Servers端通讯
+	LegacyUdb      bool // 加载工作目录下旧版没有记录服务端的 时间戳.udb 文件, 多个c端连接不同服务端时只能由对应的c端开启
+
+	Backlog     BacklogStore  // 积压数据的存储, 为空时使用 BacklogDir 下的 WAL
+	BacklogDir  string        // 默认积压存储 WAL 的目录, 默认 DefaultBacklogDir
+	BacklogSync WALSyncPolicy // 默认积压存储 WAL 的刷盘策略, 默认 WALSyncInterval
+
+	BacklogLimit BacklogLimit // 积压数据的条数, 字节, 过期时间限制与超过时的策略, 零值不限制
+
+	ServerKeyPin     ed25519.PublicKey // s端身份密钥的公钥, 设置后只接受该s端签名的密钥交换
+	StrictServerAuth bool              // 严格模式, 只接受认证码校验通过的s端包并丢弃来源地址不是s端的包, 见 serverAuth.go
 }
 
 func SetClientConf(clientName, connectCode, secretKey string) ClientConf {
@@ -39,13 +95,42 @@ func SetClientConf(clientName, connectCode, secretKey string) ClientConf {
 }
 
 func NewClient(host string, conf ...ClientConf) (*Client, error) {
+	var err error
 	c := &Client{
 		ServersHost:  host,
-		state:        0,
+		state:        StateDisconnected,
 		GetHandle:    make(ClientGetFunc),
 		NoticeHandle: make(ClientNoticeFunc),
+		fragment:     newFragmentBuffer(),
+		closer:       newCloser(),
+		backoff:      Backoff{}.withDefault(),
+		wake:         make(chan struct{}, 1),
+		version:      uint32(ProtocolVersion),
+		seq:          uint64(time.Now().UnixNano()),
+		putEpoch:     time.Now().UnixMilli(),
+		putSeq:       make(map[string]uint64),
+
+		maxVersion:       uint32(ProtocolVersion),
+		connectedVersion: -1,
 	}
+	backlogDir, backlogSync, backlogLimit, legacyUdb := DefaultBacklogDir, WALSyncInterval, BacklogLimit{}, false
 	if len(conf) >= 1 {
+		c.backoff = conf[0].Backoff.withDefault()
+		c.serverKeyPin = conf[0].ServerKeyPin
+		c.SetStrictServerAuth(conf[0].StrictServerAuth)
+		c.backlog = conf[0].Backlog
+		backlogLimit = conf[0].BacklogLimit
+		if err = backlogLimit.check(); err != nil {
+			return nil, err
+		}
+		if len(conf[0].BacklogDir) > 0 {
+			backlogDir = conf[0].BacklogDir
+		}
+		backlogSync = conf[0].BacklogSync
+		legacyUdb = conf[0].LegacyUdb
+		if conf[0].LegacyProtocol {
+			c.version, c.maxVersion = 0, 0
+		}
 		if len(conf[0].ConnectCode) > 0 {
 			c.connectCode = conf[0].ConnectCode
 		}
@@ -58,26 +143,53 @@ func NewClient(host string, conf ...ClientConf) (*Client, error) {
 		if len(conf[0].Name) > 0 && len(conf[0].Name) <= 7 {
 			c.name = conf[0].Name
 		}
-		if len(conf[0].SecretKey) != 8 {
-			return nil, fmt.Errorf("秘钥的长度只能为8，并且与Servers端统一")
-		} else if len(conf[0].SecretKey) == 0 {
+		if len(conf[0].SecretKey) == 0 {
 			c.secretKey = DefaultSecretKey
 		} else {
 			c.secretKey = conf[0].SecretKey
 		}
+		c.cipher, err = NewCipher(conf[0].CipherSuite, c.secretKey)
+		if err != nil {
+			return nil, err
+		}
 	} else {
 		c.DefaultClientName()
 		c.DefaultConnectCode()
 		c.DefaultSecretKey()
 	}
-	sHost := strings.Split(c.ServersHost, ":")
-	sip := net.ParseIP(sHost[0])
-	sport, err := strconv.Atoi(sHost[1])
+	dstAddr, err := net.ResolveUDPAddr("udp", c.ServersHost)
+	if err != nil {
+		return nil, err
+	}
 	srcAddr := &net.UDPAddr{IP: net.IPv4zero, Port: 0}
-	dstAddr := &net.UDPAddr{IP: sip, Port: sport}
 	c.Conn, err = net.DialUDP("udp", srcAddr, dstAddr)
 	if err != nil {
 		Error(err)
+		return nil, err
+	}
+	_ = c.Conn.SetReadBuffer(SocketReadBuffer)
+	if c.backlog == nil {
+		c.backlog, err = newBacklog(c.name, c.ServersHost, backlogDir, backlogSync)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if durable, ok := c.backlog.(DurableBacklog); ok && durable.Durable() {
+		importUdb(c.backlog, backlogPrefix(c.name, c.ServersHost), legacyUdb)
+	}
+	if backlogLimit.enabled() {
+		limited, err := newLimitedBacklog(c.backlog, backlogLimit)
+		if err != nil {
+			return nil, err
+		}
+		limited.onDrop = c.putDropped
+		c.backlog = limited
+	}
+	if err = c.backlog.Range(func(putData PutData) bool {
+		c.putLabels.Store(putData.Id, putData.Label)
+		return true
+	}); err != nil {
+		return nil, err
 	}
 	// 连接服务器
 	c.ConnectServers()
@@ -100,68 +212,129 @@ func (c *Client) SetConnectCode(code string) {
 }
 
 func (c *Client) SetSecretKey(key string) error {
-	if len(key) != 8 {
+	if len(key) < 1 {
 		return ErrClientSecretKey
 	}
+	cipher, err := NewCipher(c.cipher.Suite(), key)
+	if err != nil {
+		return err
+	}
 	c.secretKey = key
+	c.cipher = cipher
 	return nil
 }
 
+// SetJSONEnvelope 发送时使用旧版 JSON 信封，用于灰度升级期间兼容未升级的Servers端，接收时两种信封都能识别
+func (c *Client) SetJSONEnvelope(on bool) {
+	c.jsonEnvelope = on
+}
+
+// encode 按与s端协商的特性序列化信封, 未协商二进制信封时使用 JSON 信封
+func (c *Client) encode(obj encoding.BinaryMarshaler) ([]byte, error) {
+	return envelopeEncode(obj, c.jsonEnvelope || !c.Features().Has(FeatureBinaryEnvelope))
+}
+
+// SetCipherSuite 设置加密套件，需与Servers端统一
+func (c *Client) SetCipherSuite(suite CipherSuite) error {
+	cipher, err := NewCipher(suite, c.secretKey)
+	if err != nil {
+		return err
+	}
+	c.cipher = cipher
+	return nil
+}
+
+// Run 运行客户端, 收到信号量 SIGTERM, SIGINT, SIGHUP, SIGQUIT 时执行 Shutdown 后返回
+// 嵌入到自己处理信号量的服务中时使用 Serve
 func (c *Client) Run() {
-	// 时间轮,心跳维护，动态刷新签名
-	c.timeWheel()
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGKILL, syscall.SIGHUP, syscall.SIGQUIT)
+	defer signal.Stop(ch)
 	go func() {
 		select {
-		case s := <-ch:
+		case <-ch:
 			Info("Client退出....")
-			toUdb() // 将积压的数据持久化
-			if i, ok := s.(syscall.Signal); ok {
-				os.Exit(int(i))
-			} else {
-				os.Exit(0)
+			if err := c.Shutdown(context.Background()); err != nil {
+				Error(err)
 			}
+		case <-c.closer.closing:
 		}
 	}()
+	c.Serve()
+}
+
+// Serve 运行客户端, 不监听信号量, 调用 Shutdown 后返回
+func (c *Client) Serve() {
+	// 时间轮,心跳维护，动态刷新签名
+	c.timeWheel()
 
 	// 启动与servers进行交互
-	data := make([]byte, 1024)
+	data := make([]byte, ReadBufferSize)
 	for {
 		n, remoteAddr, err := c.Conn.ReadFromUDP(data)
 		if err != nil {
+			if c.closer.isClosed() {
+				return
+			}
 			Error(err)
-			c.state = 0 // 连接有异常更新连接状态
+			// 连接有异常(如s端端口不可达)更新连接状态
+			c.setState(StateServerLost, StateConnected)
+			continue
+		}
+		if !c.fromServer(remoteAddr) {
 			continue
 		}
 		c.SConn = remoteAddr
 		// Info("解包....size = ", n)
-		packet, err := PacketDecrypt(c.secretKey, data, n)
+		packet, handshake, err := c.packetDecrypt(data, n)
 		if err != nil {
 			Error("错误的包 err:", err)
 			continue
 		}
+		if handshake && packet.Command != CommandReply {
+			c.handshakeDropped()
+			continue
+		}
+		atomic.StoreInt64(&c.lastRecv, time.Now().UnixNano())
+		// 分片包收齐后再处理
+		if packet.Command == CommandFragment {
+			whole, ok := c.fragment.add(remoteAddr.String(), packet)
+			if !ok {
+				continue
+			}
+			packet = whole
+		}
+		if !c.closer.start() {
+			return
+		}
 		go func() {
+			defer c.closer.done()
 			switch packet.Command {
 			// 来自server端的通知消息
 			case CommandNotice:
+				if !c.serverAuth(packet) {
+					return
+				}
 				notice := &NoticeData{}
-				bErr := ByteToObj(packet.Data, &notice)
+				bErr := EnvelopeDecode(packet.Data, notice)
 				if bErr != nil {
-					Error("返回的包解析失败， err = ", err)
+					Error("返回的包解析失败， err = ", bErr)
+					return
 				}
-				// 异步应答这个通知，然后处理执行通知
+				// 异步应答这个通知，然后处理执行通知; 应答同样登记到 closer, Shutdown 等待它发送完
+				c.closer.fork()
 				go func() {
-					notice.Response = []byte("ok")
-					b, e := ObjToByte(notice)
+					defer c.closer.done()
+					ack := &NoticeData{
+						Label:    notice.Label,
+						Id:       notice.Id,
+						Response: []byte("ok"),
+					}
+					b, e := c.encode(ack)
 					if e != nil {
 						Error("ObjToByte err = ", e)
 					}
-					pack, pErr := PacketEncoder(CommandNotice, c.name, c.sign, c.secretKey, b)
-					if pErr != nil {
-						Error(pErr)
-					}
-					c.Write(pack)
+					c.writePacket(CommandNotice, b)
 				}()
 				if fn, ok := c.NoticeHandle[notice.Label]; ok {
 					fn(c, notice.Data)
@@ -169,19 +342,19 @@ func (c *Client) Run() {
 
 			// 来自server端的get请求
 			case CommandGet:
-				if c.sign != packet.Sign {
-					Info("未知主机认证!")
+				if !c.serverAuth(packet) {
 					return
 				}
 				getData := &GetData{}
-				bErr := ByteToObj(packet.Data, &getData)
+				bErr := EnvelopeDecode(packet.Data, getData)
 				if bErr != nil {
-					Error("解析put err :", bErr)
+					Error("解析get err :", bErr)
+					return
 				}
 				if fn, ok := c.GetHandle[getData.Label]; ok {
 					code, rse := fn(c, getData.Param)
 					getData.Response = rse
-					gb, gbErr := ObjToByte(getData)
+					gb, gbErr := c.encode(getData)
 					if gbErr != nil {
 						Error("对象转字节错误...")
 					}
@@ -190,44 +363,87 @@ func (c *Client) Run() {
 
 			case CommandReply:
 				reply := &Reply{}
-				bErr := ByteToObj(packet.Data, &reply)
+				bErr := EnvelopeDecode(packet.Data, reply)
 				if bErr != nil {
 					Error("返回的包解析失败， err = ", bErr)
+					return
+				}
+				if handshake && CommandCode(reply.Type) != CommandConnect {
+					c.handshakeDropped()
+					return
+				}
+				if CommandCode(reply.Type) != CommandConnect && !c.serverAuth(packet) {
+					return
 				}
 				switch CommandCode(reply.Type) {
 				case CommandConnect: // 连接包与心跳包的反馈会触发
-					// 存储签名
-					c.sign = string(reply.Data)
-					c.state = 1
+					if reply.StateCode == StateCodeVersion {
+						// s端不支持当前协议版本, 能降级时立即重连
+						if c.versionRejected(reply) {
+							c.ConnectServers()
+						}
+						return
+					}
+					if reply.StateCode == StateCodeAuth {
+						if c.refusalIgnored() {
+							Error("忽略没有s端身份签名的认证拒绝")
+							return
+						}
+						// 凭证不正确或已被吊销, 按退避时间重试直到s端更新凭证
+						if c.setState(StateRejected, StateConnecting, StateConnected, StateServerLost) {
+							Error(ErrAuthRejected)
+						}
+						return
+					}
+					if packet.Version != c.ProtocolVersion() {
+						// 切换协议版本前发出的连接包的回应
+						return
+					}
+					// 存储签名与协商的特性
+					sign, features, rest := parseConnectReply(reply.Data, packet.Version)
+					macKey, kx, ok := cutMACKey(rest, features)
+					if !ok {
+						return
+					}
+					derived, accepted := c.acceptKeyExchange(features, kx)
+					if !accepted || !c.acceptPacketMAC(features, macKey, derived) {
+						return
+					}
+					c.setSign(sign)
+					atomic.StoreUint32(&c.features, uint32(features))
+					atomic.StoreInt32(&c.connectedVersion, int32(packet.Version))
+					c.setState(StateConnected)
 					// 将积压的数据进行发送
 					c.SendBacklog()
 				case CommandPut:
-					if c.sign != packet.Sign {
-						Error("未知主机认证!")
-						return
-					}
 					if reply.StateCode != 0 {
 						// 签名错误
 						Error("签名错误")
 						break
 					}
 					// 服务端以确认收到删除对应的数据
-					backlogDel(reply.CtxId)
+					if err := c.backlog.Ack(reply.CtxId); err != nil {
+						Error("积压数据确认失败 err:", err)
+					}
+					// 协商了 FeaturePutResponse 时携带s端处理方法的应答
+					resp := PutResponse{}
+					if c.Features().Has(FeaturePutResponse) && len(reply.Data) > 0 {
+						if err := EnvelopeDecode(reply.Data, &resp); err != nil {
+							Error("Put应答解析失败 err:", err)
+						}
+					}
+					c.putAcked(reply.CtxId, resp)
 
 				case CommandGet:
-					if c.sign != packet.Sign {
-						Error("未知主机认证!")
-						return
-					}
 					getData := &GetData{}
-					boErr := ByteToObj(reply.Data, &getData)
+					boErr := EnvelopeDecode(reply.Data, getData)
 					if boErr != nil {
 						Error("解析put err :", boErr)
 					}
-					getF, _ := GetDataMap.Load(getData.Id)
+					getF, _ := c.getDataMap.Load(getData.Id)
 					if getF != nil {
 						getF.(*GetData).Response = getData.Response
-						getF.(*GetData).ctxChan <- true
+						getF.(*GetData).done()
 					}
 				}
 			}
@@ -254,58 +470,188 @@ func (c *Client) Write(data []byte) {
 
 // Put client put
 // 向服务端发送数据，如果服务端未在线数据会被积压，等服务器恢复后积压数据会一并发送
-func (c *Client) Put(funcLabel string, data []byte) {
+// 积压数据写入失败或超过 ClientConf.BacklogLimit 时返回错误，数据不会发送
+// BacklogDropNewest 丢弃时返回 ErrBacklogDropped; 写入后因 BacklogDropOldest 或 TTL 丢弃的数据不通知, 需要结果时使用 PutAsync
+func (c *Client) Put(funcLabel string, data []byte) error {
+	return c.put(context.Background(), funcLabel, data, nil)
+}
+
+// PutAsync 发送数据并返回投递结果, s端确认, 积压数据写入失败或被丢弃时结果完成
+func (c *Client) PutAsync(funcLabel string, data []byte) *PutFuture {
+	return c.putAsync(context.Background(), funcLabel, data)
+}
+
+// putAsync ctx 只作用于 BacklogBlock 时等待写入积压
+func (c *Client) putAsync(ctx context.Context, funcLabel string, data []byte) *PutFuture {
+	future := newPutFuture(funcLabel)
+	if err := c.put(ctx, funcLabel, data, future); err != nil {
+		future.resolve(err, PutResponse{})
+	}
+	return future
+}
+
+// PutSync 发送数据并等待s端确认, 返回 nil 表示s端已确认收到
+// ctx 取消或超时时返回 ctx.Err() 包装的错误, 已写入积压的数据继续投递, BacklogBlock 阻塞中的数据不写入
+func (c *Client) PutSync(ctx context.Context, funcLabel string, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return ErrPutCanceled(funcLabel, err)
+	}
+	future := c.putAsync(ctx, funcLabel, data)
+	err := future.Wait(ctx)
+	if ctx.Err() != nil {
+		c.putWait.Delete(future.Id)
+	}
+	return err
+}
+
+// PutSyncResponse 发送数据并等待s端确认, 返回s端 PutReplyHandleFunc 注册的处理方法的 code 与数据
+func (c *Client) PutSyncResponse(ctx context.Context, funcLabel string, data []byte) (int, []byte, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, nil, ErrPutCanceled(funcLabel, err)
+	}
+	future := c.putAsync(ctx, funcLabel, data)
+	if err := future.Wait(ctx); err != nil {
+		c.putWait.Delete(future.Id)
+		return 0, nil, err
+	}
+	code, resp := future.Response()
+	return code, resp, nil
+}
+
+// put 积压并发送, future 不为空时在发送前登记, 等待s端确认
+// BacklogBlock 阻塞时 ctx 取消或超时返回 ErrPutCanceled
+func (c *Client) put(ctx context.Context, funcLabel string, data []byte, future *PutFuture) error {
 	putData := PutData{
 		Label: funcLabel,
 		Id:    id(),
 		Body:  data,
+		Seq:   c.nextPutSeq(funcLabel),
+		Epoch: c.putEpoch,
+		Time:  time.Now().UnixMilli(),
+	}
+	if future != nil {
+		future.Id = putData.Id
+		c.putWait.Store(putData.Id, future)
 	}
+	c.putLabels.Store(putData.Id, putData.Label)
 	// 数据被积压，占时保存
-	backlogAdd(putData.Id, putData)
+	if err := c.backlogAdd(ctx, putData); err != nil {
+		c.putWait.Delete(putData.Id)
+		if ctxErr := ctx.Err(); ctxErr != nil && err == ctxErr {
+			c.putLabels.Delete(putData.Id)
+			return ErrPutCanceled(putData.Label, err)
+		}
+		if err == ErrBacklogDropped {
+			// BacklogDropNewest 丢弃了新的数据
+			c.putDropped(putData.Id, putData.Label, err)
+		} else {
+			c.putLabels.Delete(putData.Id)
+			Error("积压数据写入失败 err:", err)
+		}
+		return err
+	}
 	// 未与servers端确认连接，不发送数据
-	if c.state != 1 {
-		return
+	if c.State() != StateConnected {
+		return nil
 	}
-	b, err := ObjToByte(putData)
+	b, err := c.encode(&putData)
 	if err != nil {
 		Error("ObjToByte err = ", err)
 	}
-	packet, err := PacketEncoder(CommandPut, c.name, c.sign, c.secretKey, b)
+	c.writePacket(CommandPut, b)
+	return nil
+}
+
+// backlogAdd 写入积压, 有限制的积压在阻塞时响应 ctx
+func (c *Client) backlogAdd(ctx context.Context, putData PutData) error {
+	if b, ok := c.backlog.(*limitedBacklog); ok {
+		return b.addContext(ctx, putData)
+	}
+	return c.backlog.Add(putData)
+}
+
+// putAcked s端确认收到, 重复的确认忽略
+func (c *Client) putAcked(putId int64, resp PutResponse) {
+	if future, ok := c.putWait.LoadAndDelete(putId); ok {
+		future.(*PutFuture).resolve(nil, resp)
+	}
+	if label, ok := c.putLabels.LoadAndDelete(putId); ok {
+		c.emitPutAcked(putId, label.(string))
+	}
+}
+
+// putDropped 积压数据因限制或过期被丢弃
+func (c *Client) putDropped(putId int64, label string, reason error) {
+	if future, ok := c.putWait.LoadAndDelete(putId); ok {
+		future.(*PutFuture).resolve(reason, PutResponse{})
+	}
+	if _, ok := c.putLabels.LoadAndDelete(putId); ok {
+		c.emitPutDropped(putId, label, reason)
+	}
+}
+
+// nextPutSeq 标签的下一个Put序号, 用于s端有序处理
+func (c *Client) nextPutSeq(label string) uint64 {
+	c.putSeqLock.Lock()
+	defer c.putSeqLock.Unlock()
+	c.putSeq[label]++
+	return c.putSeq[label]
+}
+
+// writePacket 封包并发送，数据过大时分片发送
+func (c *Client) writePacket(cmd CommandCode, data []byte) {
+	data = c.replayMeta(cmd, data)
+	packets, err := packetEncoderSplit(cmd, c.ProtocolVersion(), c.name, c.getSign(), c.sessionCipher(), data)
 	if err != nil {
 		Error(err)
+		return
 	}
-	c.Write(packet)
+	for _, packet := range sealPackets(c.packetMACKey(), packets) {
+		c.Write(packet)
+	}
+}
+
+// SetFragmentLimit 设置分片重组的超时时间，单条消息最大字节，占用的最大内存; 小于等于0的值不修改
+func (c *Client) SetFragmentLimit(timeout time.Duration, maxMessage, maxMemory int) {
+	c.fragment.setLimit(timeout, maxMessage, maxMemory)
 }
 
 // 向服务端获取数据，指定一个超时时间，未应答就超时
 func (c *Client) get(timeOut int, funcLabel string, param []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*time.Duration(timeOut))
+	defer cancel()
+	res, err := c.GetContext(ctx, funcLabel, param)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, ErrSGetTimeOut(funcLabel, "servers", c.ServersHost)
+	}
+	return res, err
+}
+
+// GetContext 向服务端获取数据，ctx 取消或超时立即返回 ctx.Err() 包装的错误
+func (c *Client) GetContext(ctx context.Context, funcLabel string, param []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, ErrSGetCanceled(funcLabel, "servers", c.ServersHost, err)
+	}
 	getData := &GetData{
 		Label:    funcLabel,
 		Id:       id(),
 		Param:    param,
-		ctxChan:  make(chan bool),
+		ctxChan:  make(chan bool, 1),
 		Response: make([]byte, 0),
 	}
-	GetDataMap.Store(getData.Id, getData)
-	b, err := ObjToByte(getData)
+	c.getDataMap.Store(getData.Id, getData)
+	defer c.getDataMap.Delete(getData.Id)
+	b, err := c.encode(getData)
 	if err != nil {
 		Error("ObjToByte err = ", err)
 	}
-	packet, err := PacketEncoder(CommandGet, c.name, c.sign, c.secretKey, b)
-	if err != nil {
-		Error(err)
-	}
-	c.Write(packet)
+	c.writePacket(CommandGet, b)
 	select {
 	case <-getData.ctxChan:
-		res := getData.Response
-		GetDataMap.Delete(getData.Id)
-		return res, nil
-	case <-time.After(time.Millisecond * time.Duration(timeOut)):
-		GetDataMap.Delete(getData.Id)
-		return nil, ErrSGetTimeOut(funcLabel, "servers", c.SConn.String())
+		return getData.Response, nil
+	case <-ctx.Done():
+		return nil, ErrSGetCanceled(funcLabel, "servers", c.ServersHost, ctx.Err())
 	}
-
 }
 
 // ReplyGet 返回put  state:0x0 成功   state:0x1 签名失败  state:2 业务层面的失败
@@ -316,15 +662,11 @@ func (c *Client) ReplyGet(id int64, state int, data []byte) {
 		Data:      data,
 		StateCode: state,
 	}
-	b, e := ObjToByte(reply)
+	b, e := c.encode(reply)
 	if e != nil {
 		Error("打包数据失败, e= ", e)
 	}
-	data, err := PacketEncoder(CommandReply, c.name, c.sign, c.secretKey, b)
-	if err != nil {
-		Error(err)
-	}
-	c.Write(data)
+	c.writePacket(CommandReply, b)
 }
 
 func (c *Client) Get(funcLabel string, param []byte) ([]byte, error) {
@@ -346,7 +688,8 @@ func (c *Client) NoticeHandleFunc(label string, f func(c *Client, data []byte))
 // ConnectServers 请求连接服务器，获取签名
 // 内容是发送 Connect code
 func (c *Client) ConnectServers() {
-	data, err := PacketEncoder(CommandConnect, c.name, c.sign, c.secretKey, []byte(c.connectCode))
+	c.setState(StateConnecting, StateDisconnected)
+	data, err := PacketEncoderVersion(CommandConnect, c.ProtocolVersion(), c.name, c.getSign(), c.cipher, c.helloData(CommandConnect))
 	if err != nil {
 		Error(err)
 	}
@@ -367,46 +710,103 @@ func (c *Client) DefaultConnectCode() {
 
 func (c *Client) DefaultSecretKey() {
 	c.secretKey = DefaultSecretKey
+	c.cipher, _ = NewCipher(CipherAES256GCM, c.secretKey)
 }
 
-// 时间轮，持续制定时间发送心跳包
+// 时间轮，连接成功后持续制定时间发送心跳包, 未连接或s端丢失时按退避时间重连
 func (c *Client) timeWheel() {
 	go func() {
-		tTime := time.Duration(HeartbeatTime) // 时间轮5秒
+		attempt := 0
 		for {
-			// 5s维护一个心跳，s端收到心跳会返回新的签名
-			timer := time.NewTimer(tTime * time.Second)
+			var wait time.Duration
+			if c.State() == StateConnected {
+				// 5s维护一个心跳，s端收到心跳会返回新的签名
+				attempt = 0
+				wait = HeartbeatTime * time.Second
+			} else {
+				wait = c.getBackoff().next(attempt)
+				attempt++
+			}
+			timer := time.NewTimer(wait)
 			select {
 			case <-timer.C:
-				// 这个时候表示连接不存在
-				c.state = 0
-				data, err := PacketEncoder(CommandHeartbeat, c.name, c.sign, c.secretKey, []byte(c.connectCode))
+			case <-c.wake:
+				timer.Stop()
+				continue
+			case <-c.closer.closing:
+				timer.Stop()
+				return
+			}
+			if b, ok := c.backlog.(*limitedBacklog); ok {
+				b.sweep()
+			}
+			switch c.State() {
+			case StateConnected:
+				last := time.Unix(0, atomic.LoadInt64(&c.lastRecv))
+				if time.Since(last) > ServersLostTime*time.Second {
+					Error("s端失去响应，开始重连...")
+					c.setState(StateServerLost, StateConnected)
+					attempt = 0
+					c.resetVersion()
+					c.ConnectServers()
+					continue
+				}
+				data, err := PacketEncoderVersion(CommandHeartbeat, c.ProtocolVersion(), c.name, c.getSign(), c.cipher, c.helloData(CommandHeartbeat))
 				if err != nil {
 					Error(err)
 				}
 				c.Write(data)
+			case StateConnecting, StateServerLost, StateRejected:
+				c.resetVersion()
+				c.ConnectServers()
 			}
 		}
 	}()
 }
 
+// Shutdown 优雅关闭: 停止接收数据包与心跳, 等待正在执行的处理方法结束, 关闭积压存储(持久化)后关闭连接
+// ctx 超时或取消时不再等待处理方法, 仍会关闭积压存储与连接, 返回 ctx.Err()
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.closer.close()
+	// 让阻塞的读取立即返回, 连接保留给处理方法发送应答
+	_ = c.Conn.SetReadDeadline(time.Now())
+	err := c.closer.wait(ctx)
+	if bErr := c.backlog.Close(); bErr != nil && err == nil { // 积压数据持久化
+		err = bErr
+	}
+	// 未确认的 PutAsync 结束等待, 数据留在积压存储中, 下次启动后继续投递
+	c.putWait.Range(func(key, value any) bool {
+		c.putWait.Delete(key)
+		value.(*PutFuture).resolve(ErrBacklogClosed, PutResponse{})
+		return true
+	})
+	if cErr := c.Conn.Close(); cErr != nil && err == nil {
+		err = cErr
+	}
+	c.setState(StateDisconnected)
+	return err
+}
+
 // SendBacklog 发送积压的数据，
 func (c *Client) SendBacklog() {
-	backlog.Range(func(key, value any) bool {
-		if value == nil {
-			return true
-		}
-		b, err := ObjToByte(value.(PutData))
+	err := c.backlog.Range(func(putData PutData) bool {
+		b, err := c.encode(&putData)
 		if err != nil {
 			Error("ObjToByte err = ", err)
 		}
-		packet, err := PacketEncoder(CommandPut, c.name, c.sign, c.secretKey, b)
-		if err != nil {
-			Error(err)
-		}
-		c.Write(packet)
+		c.writePacket(CommandPut, b)
 		return true
 	})
-	// 如果存在持久化积压数据则进行发送
-	BacklogLoad()
+	if err != nil {
+		Error("遍历积压数据失败 err:", err)
+	}
+}
+
+// BacklogLen 未确认的积压数据条数
+func (c *Client) BacklogLen() int {
+	return c.backlog.Len()
 }
+
+// BacklogLoad 积压数据在创建c端时已从积压存储恢复, 保留为空方法
+// Deprecated: 不再需要调用
+func (c *Client) BacklogLoad() {}
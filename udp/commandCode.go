@@ -11,8 +11,12 @@ const (
 	CommandHeartbeat CommandCode = 0x3 // 发送心跳
 	CommandNotice    CommandCode = 0x4 // 下发签名
 	CommandGet       CommandCode = 0x5 // 获取消息
+	CommandFragment  CommandCode = 0x6 // 分片，收齐后按原指令处理
 )
 
+// commandVersioned 指令最高位, 表示包头带版本字段
+const commandVersioned CommandCode = 0x80
+
 // CommandPut,CommandGet  必须验证签名，否则不接收， 签名由client主导
 
 // 签名逻辑
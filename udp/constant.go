@@ -10,22 +10,72 @@ const (
 	DefaultServersName      = "servers"
 	DefaultClientName       = "client"
 	DefaultSecretKey        = "12345678"
-	DefaultSGetTimeOut      = 1000 // 单位 ms
-	DefaultNoticeMaxRetry   = 10   // 通知消息最大重试次数
-	DefaultNoticeRetryTimer = 100  // 重试等待时间 单位ms
-	HeartbeatTime           = 5    // 5s
-	HeartbeatTimeLast       = 6    // 6s
-	ServersTimeWheel        = 2    // 2s servers 时间轮
+	DefaultSGetTimeOut      = 1000     // 单位 ms
+	DefaultNoticeMaxRetry   = 10       // 通知消息最大重试次数
+	DefaultNoticeRetryTimer = 100      // 重试等待时间 单位ms
+	HeartbeatTime           = 5        // 5s
+	HeartbeatTimeLast       = 6        // 6s
+	ServersLostTime         = 15       // 15s c端超过该时间未收到s端的包视为s端丢失
+	DefaultBackoffMin       = 1000     // 首次重连等待时间 单位ms
+	DefaultBackoffMax       = 30000    // 重连最大等待时间 单位ms
+	DefaultBackoffFactor    = 2        // 重连等待时间倍数
+	DefaultBackoffJitter    = 0.2      // 重连等待时间随机抖动比例
+	ServersTimeWheel        = 2        // 2s servers 时间轮
+	ReadBufferSize          = 65535    // 读取数据包的缓冲大小，UDP包的最大长度
+	SocketReadBuffer        = 4 << 20  // socket接收缓冲区大小，避免分片突发时丢包(受系统 rmem_max 限制)
+	FragmentDataSize        = 1024     // 数据大于此值进行分片，每个分片的数据大小 单位字节
+	FragmentTimeout         = 10000    // 分片消息未收齐的超时时间 单位ms
+	FragmentMaxMessage      = 4 << 20  // 分片重组后单条消息的最大字节
+	FragmentMaxMemory       = 64 << 20 // 分片重组占用的最大内存 单位字节
+	ReplayWindowSize        = 1024     // 防重放滑动窗口的大小 单位包, 64的倍数
+	ReplayMaxAge            = 60000    // 防重放允许的时间差 单位ms
+	PutDedupCapacity        = 10000    // Put去重每个c端保留的 id 数量
+	PutDedupWindow          = 600000   // Put去重记录的保留时间 单位ms
+	PutDedupSaveInterval    = 10000    // Put去重记录持久化的间隔 单位ms
+	PutOrderGapTimeout      = 3000     // 有序Put缺失序号的等待时间 单位ms
+	PutOrderMaxPending      = 1000     // 有序Put每个c端每个标签最多缓存的包数量
+	PutOrderIdle            = 600000   // 有序Put空闲记录的保留时间 单位ms
+)
+
+// 积压数据 WAL
+const (
+	DefaultBacklogDir   = "backlog" // 默认目录
+	WALSegmentSize      = 16 << 20  // 单个段文件的最大字节
+	WALMaxSegments      = 8         // 段数量超过此值时压缩最旧的段
+	WALSyncIntervalTime = 1000      // WALSyncInterval 的刷盘间隔 单位ms
+)
+
+// Reply 状态码
+const (
+	StateCodeVersion = 3 // 协议版本不支持, Data 为s端的协议版本
+	StateCodeAuth    = 4 // c端凭证认证失败或已被吊销
+)
+
+// 包认证码
+const (
+	PacketMACSize    = 16 // 每个包末尾的认证码字节, HMAC-SHA256 截断
+	PacketMACKeySize = 32 // 认证密钥的字节
+)
+
+// 客户端认证
+const (
+	AuthFileCheckInterval = 1000 // 凭证文件变化的检查间隔 单位ms
 )
 
 // err
 var (
 	ErrNmeLengthAbove  = fmt.Errorf("名字不能超过7个长度")
-	ErrDataLengthAbove = fmt.Errorf("数据大于 540个字节, 建议拆分")
+	ErrDataLengthAbove = fmt.Errorf("数据包过大, 超过分片上限")
 	ErrNonePacket      = fmt.Errorf("空包")
 	ErrSGetTimeOut     = func(label, name, ip string) error {
 		return fmt.Errorf("请求客户端 FuncLabel:%s | name:%s | IP:%s 超时", label, name, ip)
 	}
+	ErrSGetCanceled = func(label, name, ip string, err error) error {
+		return fmt.Errorf("请求客户端 FuncLabel:%s | name:%s | IP:%s 取消: %w", label, name, ip, err)
+	}
+	ErrNoticeCanceled = func(name, label string, err error) error {
+		return fmt.Errorf("通知客户端 name:%s | label:%s 取消: %w", name, label, err)
+	}
 	ErrNotFondClient = func(name string) error {
 		return fmt.Errorf("未找到客户端 name:%s ", name)
 	}
@@ -35,7 +85,48 @@ var (
 	PanicPutHandleFuncExist = func(label string) {
 		panic(fmt.Sprintf("put handle func label:%s is exist.", label))
 	}
-	ErrServersSecretKey = fmt.Errorf("秘钥的长度只能为8，并且与Client端统一")
+	ErrServersSecretKey = fmt.Errorf("秘钥不能为空(DES ECB 长度只能为8)，并且与Client端统一")
 	ErrClientNameErr    = fmt.Errorf("client name 不能含特殊字符 @")
-	ErrClientSecretKey  = fmt.Errorf("秘钥的长度只能为8，并且与Servers端统一")
+	ErrClientSecretKey  = fmt.Errorf("秘钥不能为空(DES ECB 长度只能为8)，并且与Servers端统一")
+	ErrSecretKeyEmpty   = fmt.Errorf("秘钥不能为空")
+	ErrDesSecretKey     = fmt.Errorf("DES ECB 秘钥的长度只能为8")
+	ErrEncrypt          = fmt.Errorf("加密数据失败")
+	ErrDecrypt          = fmt.Errorf("解密数据失败")
+	ErrCipherSuite      = func(suite CipherSuite) error {
+		return fmt.Errorf("未知的加密套件:%d", suite)
+	}
+	ErrProtocolVersion = func(version uint8) error {
+		return fmt.Errorf("不支持的协议版本:%d", version)
+	}
+	ErrEnvelope        = fmt.Errorf("信封格式错误")
+	ErrBacklogClosed   = fmt.Errorf("积压数据已关闭")
+	ErrBacklogFull     = fmt.Errorf("积压数据超过限制")
+	ErrBacklogBlockTTL = fmt.Errorf("BacklogBlock 需要设置 TTL, 否则s端不确认时 Put 会一直阻塞")
+	ErrBacklogDropped  = fmt.Errorf("积压数据超过限制被丢弃")
+	ErrBacklogExpired  = fmt.Errorf("积压数据超过过期时间被丢弃")
+	ErrWALRecord       = fmt.Errorf("WAL 记录不完整或校验失败")
+	ErrEnvelopeVersion = func(version byte) error {
+		return fmt.Errorf("不支持的信封版本:%d", version)
+	}
+	ErrPutCanceled = func(label string, err error) error {
+		return fmt.Errorf("发送数据 label:%s 取消: %w", label, err)
+	}
+	ErrAuthCredential    = fmt.Errorf("客户端凭证不正确")
+	ErrAuthRejected      = fmt.Errorf("s端拒绝认证, 凭证不正确或已被吊销")
+	ErrAuthNotRevocable  = fmt.Errorf("未设置 Authenticator 或 Authenticator 不支持吊销")
+	ErrAuthUnknownClient = func(name string) error {
+		return fmt.Errorf("未知客户端 name:%s", name)
+	}
+	ErrAuthFileLine = func(path string, line int) error {
+		return fmt.Errorf("凭证文件 %s 第%d行格式错误, 应为: c端名称 凭证", path, line)
+	}
+	ErrKeyExchangeRequired = fmt.Errorf("设置了 ServerKeyPin, s端未进行密钥交换")
+	ErrServerKeyPin        = fmt.Errorf("s端身份签名校验失败, 与 ServerKeyPin 不一致")
+	ErrBlockClient         = fmt.Errorf("封禁客户端 name 与 ip 不能同时为空")
+	ErrPacketMAC           = fmt.Errorf("包认证码校验失败")
+	ErrPacketMACRequired   = fmt.Errorf("c端未协商包认证码, s端要求 FeaturePacketMAC")
+	ErrServerMACRequired   = fmt.Errorf("严格模式下s端未协商包认证码(FeaturePacketMAC), 不连接")
+	ErrCIDR                = func(cidr string) error {
+		return fmt.Errorf("错误的 CIDR 或 IP:%s", cidr)
+	}
 )
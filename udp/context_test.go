@@ -0,0 +1,119 @@
+package udp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// silentPeer 只接收不应答的对端
+func silentPeer(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func pending(m *sync.Map) int {
+	n := 0
+	m.Range(func(key, value any) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// testServersWithClient s端不运行, 直接登记一个不会应答的c端
+func testServersWithClient(t *testing.T) *Servers {
+	t.Helper()
+	s, err := NewServers("127.0.0.1", 0, ServersConf{SecretKey: "ctx-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Conn.Close() })
+	peer := silentPeer(t)
+	addr := peer.LocalAddr().(*net.UDPAddr)
+	s.clientJoin(formatName("c1"), addr.IP.String(), addr, session{})
+	return s
+}
+
+func TestServersGetContextCancel(t *testing.T) {
+	s := testServersWithClient(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	_, err := s.GetContext(ctx, "f", "c1", nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("GetContext did not return on cancel")
+	}
+	if n := pending(&s.getDataMap); n != 0 {
+		t.Fatalf("%d get requests left on servers", n)
+	}
+
+	// 已取消的 ctx 不发送请求
+	if _, err = s.GetContext(ctx, "f", "c1", nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+
+	// 超时保留原有的超时错误
+	if _, err = s.GetAtNameTimeOut(50, "f", "c1", nil); err == nil || errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want ErrSGetTimeOut", err)
+	}
+	if n := pending(&s.getDataMap); n != 0 {
+		t.Fatalf("%d get requests left on servers", n)
+	}
+}
+
+func TestServersNoticeContextCancel(t *testing.T) {
+	s := testServersWithClient(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 80*time.Millisecond)
+	defer cancel()
+	// 重试时间远大于 ctx, 只有 ctx 能让它返回
+	retry := s.SetNoticeRetry(100, 1000)
+	start := time.Now()
+	_, err := s.NoticeContext(ctx, "c1", "n", []byte("x"), retry)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("NoticeContext did not return on cancel")
+	}
+	if n := pending(&s.noticeMap); n != 0 {
+		t.Fatalf("%d notices left on servers", n)
+	}
+}
+
+func TestClientGetContextCancel(t *testing.T) {
+	peer := silentPeer(t)
+	c, err := NewClient(peer.LocalAddr().String(), ClientConf{Name: "c1", SecretKey: "ctx-test", BacklogDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = c.GetContext(ctx, "f", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+	if n := pending(&c.getDataMap); n != 0 {
+		t.Fatalf("%d get requests left on client", n)
+	}
+	if _, err = c.GetContext(ctx, "f", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+}
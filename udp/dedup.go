@@ -0,0 +1,258 @@
+package udp
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+
+Put 去重: c端积压的数据在连接成功后会重发, s端的确认包丢失时同一个 PutData.Id 会多次到达
+
+1. s端按c端 name@ip 记录最近处理过的 PutData.Id, 每个c端最多保留 capacity 条, 超过 window 的记录被清理
+2. 已处理完成的重复包直接确认, 不再执行 PutHandle, 确认包携带第一次处理的应答; 正在处理的重复包忽略, 由第一次处理完成后确认
+3. 设置持久化文件后定时与 Shutdown 时写入文件, 重启后加载, 保证重启前后的去重
+4. c端积压数据在 window 之后才重发时无法去重, window 需要大于c端可能的离线时间
+
+*/
+
+type dedupState int
+
+const (
+	dedupNew     dedupState = iota // 首次到达
+	dedupRunning                   // 正在处理的重复包
+	dedupDone                      // 已处理完成的重复包
+)
+
+type dedupEntry struct {
+	id   int64
+	time int64 // 处理完成的时间 UnixMilli
+	done bool
+	resp PutResponse // 处理方法的应答
+}
+
+// dedupSet 一个c端最近处理的 id, 按到达顺序排列, 队首为最新
+type dedupSet struct {
+	order *list.List
+	ids   map[int64]*list.Element
+}
+
+// putDedup s端 Put 去重
+type putDedup struct {
+	lock      sync.Mutex
+	clients   map[string]*dedupSet // key = name@ip
+	capacity  int                  // 每个c端最多保留的 id 数量
+	window    time.Duration        // 保留时间
+	path      string               // 持久化文件, 为空不持久化
+	dirty     bool
+	lastSave  time.Time
+	duplicate uint64 // 重复包数量
+}
+
+func newPutDedup() *putDedup {
+	return &putDedup{
+		clients:  make(map[string]*dedupSet),
+		capacity: PutDedupCapacity,
+		window:   PutDedupWindow * time.Millisecond,
+		lastSave: time.Now(),
+	}
+}
+
+func (d *putDedup) set(key string) *dedupSet {
+	set, ok := d.clients[key]
+	if !ok {
+		set = &dedupSet{order: list.New(), ids: make(map[int64]*list.Element)}
+		d.clients[key] = set
+	}
+	return set
+}
+
+// begin 登记一个到达的 id, 返回到达的状态, 已处理完成时同时返回第一次处理的应答
+func (d *putDedup) begin(key string, id int64) (dedupState, PutResponse) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	set := d.set(key)
+	if e, ok := set.ids[id]; ok {
+		atomic.AddUint64(&d.duplicate, 1)
+		if entry := e.Value.(*dedupEntry); entry.done {
+			return dedupDone, entry.resp
+		}
+		return dedupRunning, PutResponse{}
+	}
+	set.ids[id] = set.order.PushFront(&dedupEntry{id: id})
+	for set.order.Len() > d.capacity {
+		d.remove(set, set.order.Back())
+	}
+	return dedupNew, PutResponse{}
+}
+
+// finish 标记 id 处理完成, 记录处理的应答
+func (d *putDedup) finish(key string, id int64, resp PutResponse) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	set, ok := d.clients[key]
+	if !ok {
+		return
+	}
+	if e, ok := set.ids[id]; ok {
+		entry := e.Value.(*dedupEntry)
+		entry.done = true
+		entry.time = time.Now().UnixMilli()
+		entry.resp = resp
+		d.dirty = true
+	}
+}
+
+func (d *putDedup) remove(set *dedupSet, e *list.Element) {
+	delete(set.ids, e.Value.(*dedupEntry).id)
+	set.order.Remove(e)
+}
+
+// sweep 清理超过 window 的记录, 到达持久化间隔时写入文件
+func (d *putDedup) sweep() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	before := time.Now().Add(-d.window).UnixMilli()
+	for key, set := range d.clients {
+		for e := set.order.Back(); e != nil; {
+			entry := e.Value.(*dedupEntry)
+			if !entry.done || entry.time >= before {
+				break
+			}
+			prev := e.Prev()
+			d.remove(set, e)
+			d.dirty = true
+			e = prev
+		}
+		if set.order.Len() == 0 {
+			delete(d.clients, key)
+		}
+	}
+	if time.Since(d.lastSave) >= PutDedupSaveInterval*time.Millisecond {
+		d.save()
+	}
+}
+
+// save 写入持久化文件, 调用方持有锁; 先写临时文件再替换, 避免写入中断损坏文件
+func (d *putDedup) save() {
+	if d.path == "" || !d.dirty {
+		return
+	}
+	d.lastSave = time.Now()
+	tmp := d.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		Error(err)
+		return
+	}
+	w := bufio.NewWriter(file)
+	for key, set := range d.clients {
+		for e := set.order.Back(); e != nil; e = e.Prev() {
+			entry := e.Value.(*dedupEntry)
+			if entry.done {
+				_, _ = fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\n", key, entry.id, entry.time,
+					entry.resp.Code, base64.StdEncoding.EncodeToString(entry.resp.Data))
+			}
+		}
+	}
+	err = w.Flush()
+	if cErr := file.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, d.path)
+	}
+	if err != nil {
+		Error("Put去重记录持久化失败 err:", err)
+		return
+	}
+	d.dirty = false
+}
+
+// load 加载持久化文件, 文件不存在不报错
+func (d *putDedup) load(path string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.path = path
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	before := time.Now().Add(-d.window).UnixMilli()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// key id time [code data], 旧版本的文件没有应答
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 3 && len(fields) != 5 {
+			continue
+		}
+		id, idErr := strconv.ParseInt(fields[1], 10, 64)
+		t, tErr := strconv.ParseInt(fields[2], 10, 64)
+		if idErr != nil || tErr != nil || t < before {
+			continue
+		}
+		resp := PutResponse{}
+		if len(fields) == 5 {
+			code, cErr := strconv.Atoi(fields[3])
+			data, dErr := base64.StdEncoding.DecodeString(fields[4])
+			if cErr != nil || dErr != nil {
+				continue
+			}
+			resp.Code = code
+			if len(data) > 0 {
+				resp.Data = data
+			}
+		}
+		set := d.set(fields[0])
+		if _, ok := set.ids[id]; ok {
+			continue
+		}
+		set.ids[id] = set.order.PushFront(&dedupEntry{id: id, time: t, done: true, resp: resp})
+		for set.order.Len() > d.capacity {
+			d.remove(set, set.order.Back())
+		}
+	}
+	return scanner.Err()
+}
+
+func (d *putDedup) close() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.save()
+}
+
+// SetPutDedup 设置Put去重每个c端保留的 id 数量与保留时间; 小于等于0的值不修改
+func (s *Servers) SetPutDedup(capacity int, window time.Duration) {
+	s.putDedup.lock.Lock()
+	defer s.putDedup.lock.Unlock()
+	if capacity > 0 {
+		s.putDedup.capacity = capacity
+	}
+	if window > 0 {
+		s.putDedup.window = window
+	}
+}
+
+// SetPutDedupFile 设置Put去重记录的持久化文件, 文件存在时加载其中未过期的记录
+func (s *Servers) SetPutDedupFile(path string) error {
+	return s.putDedup.load(path)
+}
+
+// PutDuplicateCount 收到的重复Put包数量
+func (s *Servers) PutDuplicateCount() uint64 {
+	return atomic.LoadUint64(&s.putDedup.duplicate)
+}
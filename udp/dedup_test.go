@@ -0,0 +1,101 @@
+package udp
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPutDedupStates(t *testing.T) {
+	d := newPutDedup()
+	if state, _ := d.begin("c@ip", 1); state != dedupNew {
+		t.Fatalf("first arrival %d", state)
+	}
+	if state, _ := d.begin("c@ip", 1); state != dedupRunning {
+		t.Fatalf("arrival while running %d", state)
+	}
+	if state, _ := d.begin("other@ip", 1); state != dedupNew {
+		t.Fatalf("same id from another client %d", state)
+	}
+	resp := PutResponse{Code: 7, Data: []byte("r")}
+	d.finish("c@ip", 1, resp)
+	state, got := d.begin("c@ip", 1)
+	if state != dedupDone || !reflect.DeepEqual(got, resp) {
+		t.Fatalf("arrival after finish %d %+v", state, got)
+	}
+	if d.duplicate != 2 {
+		t.Fatalf("duplicate count %d", d.duplicate)
+	}
+}
+
+func TestPutDedupCapacity(t *testing.T) {
+	d := newPutDedup()
+	d.capacity = 3
+	for id := int64(1); id <= 4; id++ {
+		d.begin("c", id)
+	}
+	if state, _ := d.begin("c", 1); state != dedupNew {
+		t.Fatal("oldest id kept over capacity")
+	}
+	if state, _ := d.begin("c", 4); state != dedupRunning {
+		t.Fatal("newest id evicted")
+	}
+}
+
+func TestPutDedupSweep(t *testing.T) {
+	d := newPutDedup()
+	d.window = 10 * time.Millisecond
+	d.begin("c", 1)
+	d.finish("c", 1, PutResponse{})
+	d.begin("c", 2) // 正在处理的不会被清理
+	time.Sleep(20 * time.Millisecond)
+	d.sweep()
+	if state, _ := d.begin("c", 2); state != dedupRunning {
+		t.Fatal("running id swept")
+	}
+	if state, _ := d.begin("c", 1); state != dedupNew {
+		t.Fatal("expired id kept")
+	}
+}
+
+func TestPutDedupPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup")
+	d := newPutDedup()
+	if err := d.load(path); err != nil {
+		t.Fatal(err)
+	}
+	d.begin("c@ip", 1)
+	d.finish("c@ip", 1, PutResponse{Code: 3, Data: []byte("resp")})
+	d.begin("c@ip", 2) // 未完成的不持久化
+	d.close()
+
+	// 旧版本的文件没有应答, 过期的记录不加载
+	old := time.Now().Add(-2 * PutDedupWindow * time.Millisecond).UnixMilli()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString("legacy@ip\t9\t" + strconv.FormatInt(time.Now().UnixMilli(), 10) + "\n")
+	_, _ = f.WriteString("c@ip\t3\t" + strconv.FormatInt(old, 10) + "\t0\t\n")
+	_ = f.Close()
+
+	loaded := newPutDedup()
+	if err = loaded.load(path); err != nil {
+		t.Fatal(err)
+	}
+	state, resp := loaded.begin("c@ip", 1)
+	if state != dedupDone || resp.Code != 3 || string(resp.Data) != "resp" {
+		t.Fatalf("restored %d %+v", state, resp)
+	}
+	if state, _ = loaded.begin("legacy@ip", 9); state != dedupDone {
+		t.Fatal("legacy line not restored")
+	}
+	for _, id := range []int64{2, 3} {
+		if state, _ = loaded.begin("c@ip", id); state != dedupNew {
+			t.Fatalf("id %d should not be restored", id)
+		}
+	}
+}
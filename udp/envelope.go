@@ -0,0 +1,236 @@
+package udp
+
+import (
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+)
+
+/*
+
+Envelope 信封设计, PutData, GetData, NoticeData, Reply 序列化后作为数据包的 data
+______________________________________________________________________
+|              |                                                     |
+| 版本(1字节)   |  字段...  整数: varint  label/body: uvarint长度+内容    |
+|______________|_____________________________________________________|
+
+PutData:    版本 | Id | Label | Body | [Seq | Epoch] | [Time]
+GetData:    版本 | Id | Label | Param | Response
+NoticeData: 版本 | Id | Label | Data | Response
+Reply:      版本 | Type | CtxId | StateCode | Data
+PutResponse: 版本 | Code | Data
+
+兼容: 旧版本使用 JSON 信封, 首字节为 '{', 解码时自动识别;
+灰度升级期间可通过 SetJSONEnvelope 让新节点继续发送 JSON 信封;
+[] 中为后续增加的可选字段, 只能追加在末尾, 旧版本解码时忽略, 新版本解码旧数据时为零值
+
+*/
+
+// EnvelopeVersion 当前二进制信封的版本
+const EnvelopeVersion byte = 0x01
+
+// envelopeEncode 序列化为二进制信封, legacy 为 true 时使用旧版 JSON 信封
+func envelopeEncode(obj encoding.BinaryMarshaler, legacy bool) ([]byte, error) {
+	if legacy {
+		return ObjToByte(obj)
+	}
+	return obj.MarshalBinary()
+}
+
+// EnvelopeDecode 反序列化信封, 自动识别旧版 JSON 信封
+func EnvelopeDecode(data []byte, obj encoding.BinaryUnmarshaler) error {
+	if isJSONEnvelope(data) {
+		return json.Unmarshal(data, obj)
+	}
+	return obj.UnmarshalBinary(data)
+}
+
+func isJSONEnvelope(data []byte) bool {
+	return len(data) > 0 && data[0] == '{'
+}
+
+type envelopeWriter struct {
+	buf []byte
+}
+
+func newEnvelopeWriter(size int) *envelopeWriter {
+	w := &envelopeWriter{buf: make([]byte, 0, size+16)}
+	w.buf = append(w.buf, EnvelopeVersion)
+	return w
+}
+
+func (w *envelopeWriter) varint(v int64) {
+	w.buf = binary.AppendVarint(w.buf, v)
+}
+
+func (w *envelopeWriter) bytes(b []byte) {
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *envelopeWriter) string(s string) {
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+// envelopeReader 按顺序读取字段, 出错后的读取都返回零值, 最后检查 err
+type envelopeReader struct {
+	buf []byte
+	err error
+}
+
+func newEnvelopeReader(data []byte) *envelopeReader {
+	r := &envelopeReader{}
+	if len(data) < 1 {
+		r.err = ErrEnvelope
+		return r
+	}
+	if data[0] != EnvelopeVersion {
+		r.err = ErrEnvelopeVersion(data[0])
+		return r
+	}
+	r.buf = data[1:]
+	return r
+}
+
+func (r *envelopeReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.err = ErrEnvelope
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *envelopeReader) bytes() []byte {
+	if r.err != nil {
+		return nil
+	}
+	l, n := binary.Uvarint(r.buf)
+	if n <= 0 || l > uint64(len(r.buf)-n) {
+		r.err = ErrEnvelope
+		return nil
+	}
+	b := r.buf[n : n+int(l)]
+	r.buf = r.buf[n+int(l):]
+	if len(b) == 0 {
+		return nil
+	}
+	return b
+}
+
+// more 是否还有未读取的字段, 用于末尾追加的可选字段
+func (r *envelopeReader) more() bool {
+	return r.err == nil && len(r.buf) > 0
+}
+
+func (r *envelopeReader) string() string {
+	return string(r.bytes())
+}
+
+// MarshalBinary 二进制信封
+func (p *PutData) MarshalBinary() ([]byte, error) {
+	w := newEnvelopeWriter(len(p.Label) + len(p.Body))
+	w.varint(p.Id)
+	w.string(p.Label)
+	w.bytes(p.Body)
+	if p.Seq > 0 || p.Time > 0 {
+		w.varint(int64(p.Seq))
+		w.varint(p.Epoch)
+	}
+	if p.Time > 0 {
+		w.varint(p.Time)
+	}
+	return w.buf, nil
+}
+
+func (p *PutData) UnmarshalBinary(data []byte) error {
+	r := newEnvelopeReader(data)
+	p.Id = r.varint()
+	p.Label = r.string()
+	p.Body = r.bytes()
+	if r.more() {
+		p.Seq = uint64(r.varint())
+		p.Epoch = r.varint()
+	}
+	if r.more() {
+		p.Time = r.varint()
+	}
+	return r.err
+}
+
+// MarshalBinary 二进制信封, Err 不参与传输
+func (g *GetData) MarshalBinary() ([]byte, error) {
+	w := newEnvelopeWriter(len(g.Label) + len(g.Param) + len(g.Response))
+	w.varint(g.Id)
+	w.string(g.Label)
+	w.bytes(g.Param)
+	w.bytes(g.Response)
+	return w.buf, nil
+}
+
+func (g *GetData) UnmarshalBinary(data []byte) error {
+	r := newEnvelopeReader(data)
+	g.Id = r.varint()
+	g.Label = r.string()
+	g.Param = r.bytes()
+	g.Response = r.bytes()
+	return r.err
+}
+
+// MarshalBinary 二进制信封, Err 不参与传输
+func (n *NoticeData) MarshalBinary() ([]byte, error) {
+	w := newEnvelopeWriter(len(n.Label) + len(n.Data) + len(n.Response))
+	w.varint(n.Id)
+	w.string(n.Label)
+	w.bytes(n.Data)
+	w.bytes(n.Response)
+	return w.buf, nil
+}
+
+func (n *NoticeData) UnmarshalBinary(data []byte) error {
+	r := newEnvelopeReader(data)
+	n.Id = r.varint()
+	n.Label = r.string()
+	n.Data = r.bytes()
+	n.Response = r.bytes()
+	return r.err
+}
+
+// MarshalBinary 二进制信封
+func (p *PutResponse) MarshalBinary() ([]byte, error) {
+	w := newEnvelopeWriter(len(p.Data))
+	w.varint(int64(p.Code))
+	w.bytes(p.Data)
+	return w.buf, nil
+}
+
+func (p *PutResponse) UnmarshalBinary(data []byte) error {
+	r := newEnvelopeReader(data)
+	p.Code = int(r.varint())
+	p.Data = r.bytes()
+	return r.err
+}
+
+// MarshalBinary 二进制信封
+func (r *Reply) MarshalBinary() ([]byte, error) {
+	w := newEnvelopeWriter(len(r.Data))
+	w.varint(int64(r.Type))
+	w.varint(r.CtxId)
+	w.varint(int64(r.StateCode))
+	w.bytes(r.Data)
+	return w.buf, nil
+}
+
+func (r *Reply) UnmarshalBinary(data []byte) error {
+	er := newEnvelopeReader(data)
+	r.Type = int(er.varint())
+	r.CtxId = er.varint()
+	r.StateCode = int(er.varint())
+	r.Data = er.bytes()
+	return er.err
+}
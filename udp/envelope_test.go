@@ -0,0 +1,86 @@
+package udp
+
+import (
+	"encoding"
+	"reflect"
+	"testing"
+)
+
+type envelope interface {
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	cases := []struct {
+		in, out envelope
+	}{
+		{&PutData{Label: "put", Id: 1 << 40, Body: []byte("body")}, &PutData{}},
+		{&PutData{Label: "seq", Id: -7, Body: []byte{0, 1, 2}, Seq: 3, Epoch: 1700000000000}, &PutData{}},
+		{&PutData{Label: "ttl", Id: 9, Seq: 1, Epoch: 2, Time: 1700000000001}, &PutData{}},
+		{&GetData{Label: "get", Id: 2, Param: []byte("p"), Response: []byte("r")}, &GetData{}},
+		{&NoticeData{Label: "n", Id: 3, Data: []byte("d")}, &NoticeData{}},
+		{&Reply{Type: int(CommandPut), CtxId: 4, StateCode: 2, Data: []byte("x")}, &Reply{}},
+		{&PutResponse{Code: -1, Data: []byte("resp")}, &PutResponse{}},
+	}
+	for _, legacy := range []bool{false, true} {
+		for _, tc := range cases {
+			b, err := envelopeEncode(tc.in, legacy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if isJSONEnvelope(b) != legacy {
+				t.Fatalf("%T legacy=%v detected as json=%v", tc.in, legacy, isJSONEnvelope(b))
+			}
+			out := reflect.New(reflect.TypeOf(tc.out).Elem()).Interface().(envelope)
+			if err = EnvelopeDecode(b, out); err != nil {
+				t.Fatalf("%T legacy=%v: %v", tc.in, legacy, err)
+			}
+			if !reflect.DeepEqual(tc.in, out) {
+				t.Fatalf("%T legacy=%v: got %+v, want %+v", tc.in, legacy, out, tc.in)
+			}
+		}
+	}
+}
+
+// 旧版本没有可选字段的 PutData 解码为零值
+func TestEnvelopeOptionalFields(t *testing.T) {
+	w := newEnvelopeWriter(0)
+	w.varint(5)
+	w.string("old")
+	w.bytes([]byte("b"))
+	p := &PutData{}
+	if err := EnvelopeDecode(w.buf, p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Id != 5 || p.Label != "old" || string(p.Body) != "b" || p.Seq != 0 || p.Epoch != 0 || p.Time != 0 {
+		t.Fatalf("got %+v", p)
+	}
+}
+
+// 旧版本写入的 JSON 信封, 字段名与大小写保持不变
+func TestEnvelopeLegacyJSON(t *testing.T) {
+	p := &PutData{}
+	if err := EnvelopeDecode([]byte(`{"Label":"l","Id":7,"Body":"aGk="}`), p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Label != "l" || p.Id != 7 || string(p.Body) != "hi" {
+		t.Fatalf("got %+v", p)
+	}
+}
+
+func TestEnvelopeMalformed(t *testing.T) {
+	full, _ := (&GetData{Label: "label", Id: 1, Param: []byte("param")}).MarshalBinary()
+	for i := 0; i < len(full); i++ {
+		if err := EnvelopeDecode(full[:i], &GetData{}); err == nil {
+			t.Fatalf("truncated to %d bytes decoded without error", i)
+		}
+	}
+	bad := append([]byte{EnvelopeVersion + 1}, full[1:]...)
+	if err := EnvelopeDecode(bad, &GetData{}); err == nil {
+		t.Fatal("unknown version decoded without error")
+	}
+	if err := EnvelopeDecode([]byte("{not json"), &GetData{}); err == nil {
+		t.Fatal("broken json decoded without error")
+	}
+}
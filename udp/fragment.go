@@ -0,0 +1,196 @@
+package udp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+
+分片设计: 数据大于 FragmentDataSize 时拆分为多个 CommandFragment 包，接收端重组后再交给对应指令处理
+
+分片数据(加密前)
+__________________________________________________________________________
+|              |             |             |              |              |
+| 消息id(8字节) | 序号(2字节)  | 总数(2字节)  | 原指令(1字节) |  分片数据...  |
+|______________|_____________|_____________|______________|______________|
+
+1. 每个分片都是独立加密的完整数据包，包头与普通包一致
+2. 接收端按 地址+消息id 重组，全部到达后才交给处理方法
+3. 超过 FragmentTimeout 未收齐的消息被丢弃
+4. 单个分片不能超过 FragmentDataSize，单条消息不能超过 maxMessage，所有未完成消息占用内存不能超过 maxMemory
+5. s端在重组前校验每个分片的签名，未通过的分片不占用内存
+
+*/
+
+const fragmentHeadSize = 13
+
+// packetEncoderSplit 封包，数据过大时拆分为多个分片包
+func packetEncoderSplit(cmd CommandCode, version uint8, name, sign string, cipher Cipher, data []byte) ([][]byte, error) {
+	if len(data) <= FragmentDataSize {
+		packet, err := PacketEncoderVersion(cmd, version, name, sign, cipher, data)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{packet}, nil
+	}
+	total := (len(data) + FragmentDataSize - 1) / FragmentDataSize
+	if total > 0xffff {
+		return nil, ErrDataLengthAbove
+	}
+	msgId := id()
+	packets := make([][]byte, 0, total)
+	for i := 0; i < total; i++ {
+		end := (i + 1) * FragmentDataSize
+		if end > len(data) {
+			end = len(data)
+		}
+		buf := new(bytes.Buffer)
+		_ = binary.Write(buf, binary.BigEndian, msgId)
+		_ = binary.Write(buf, binary.BigEndian, uint16(i))
+		_ = binary.Write(buf, binary.BigEndian, uint16(total))
+		_ = binary.Write(buf, binary.BigEndian, cmd)
+		buf.Write(data[i*FragmentDataSize : end])
+		packet, err := PacketEncoderVersion(CommandFragment, version, name, sign, cipher, buf.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		packets = append(packets, packet)
+	}
+	return packets, nil
+}
+
+type fragmentMsg struct {
+	command CommandCode
+	parts   [][]byte
+	got     int
+	size    int
+	start   time.Time
+}
+
+// fragmentBuffer 分片重组
+type fragmentBuffer struct {
+	lock       sync.Mutex
+	msgMap     map[string]*fragmentMsg // key = 地址@消息id
+	used       int                     // 未完成消息占用的内存
+	timeout    time.Duration           // 未收齐的超时时间
+	maxMessage int                     // 单条消息最大字节
+	maxMemory  int                     // 所有未完成消息最大占用字节
+	lastSweep  time.Time
+}
+
+func newFragmentBuffer() *fragmentBuffer {
+	return &fragmentBuffer{
+		msgMap:     make(map[string]*fragmentMsg),
+		timeout:    FragmentTimeout * time.Millisecond,
+		maxMessage: FragmentMaxMessage,
+		maxMemory:  FragmentMaxMemory,
+		lastSweep:  time.Now(),
+	}
+}
+
+func (f *fragmentBuffer) setLimit(timeout time.Duration, maxMessage, maxMemory int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if timeout > 0 {
+		f.timeout = timeout
+	}
+	if maxMessage > 0 {
+		f.maxMessage = maxMessage
+	}
+	if maxMemory > 0 {
+		f.maxMemory = maxMemory
+	}
+}
+
+// add 加入一个分片，消息收齐后返回重组的数据包
+func (f *fragmentBuffer) add(addr string, packet *Packet) (*Packet, bool) {
+	if len(packet.Data) < fragmentHeadSize {
+		Error("错误的分片包")
+		return nil, false
+	}
+	msgId := int64(binary.BigEndian.Uint64(packet.Data[0:8]))
+	index := int(binary.BigEndian.Uint16(packet.Data[8:10]))
+	total := int(binary.BigEndian.Uint16(packet.Data[10:12]))
+	command := CommandCode(packet.Data[12])
+	chunk := packet.Data[fragmentHeadSize:]
+	if total < 1 || index >= total || len(chunk) > FragmentDataSize {
+		Error("错误的分片包")
+		return nil, false
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.sweep()
+
+	key := fmt.Sprintf("%s@%d", addr, msgId)
+	msg, ok := f.msgMap[key]
+	if !ok {
+		if total*FragmentDataSize > f.maxMessage {
+			ErrorF("分片消息过大，丢弃 addr:%s total:%d", addr, total)
+			return nil, false
+		}
+		msg = &fragmentMsg{
+			command: command,
+			parts:   make([][]byte, total),
+			start:   time.Now(),
+		}
+		f.msgMap[key] = msg
+	}
+	if len(msg.parts) != total || msg.command != command {
+		Error("分片信息不一致，丢弃消息")
+		f.drop(key, msg)
+		return nil, false
+	}
+	if msg.parts[index] != nil {
+		return nil, false
+	}
+	if msg.size+len(chunk) > f.maxMessage {
+		ErrorF("分片消息过大，丢弃 addr:%s", addr)
+		f.drop(key, msg)
+		return nil, false
+	}
+	if f.used+len(chunk) > f.maxMemory {
+		ErrorF("分片重组内存超过上限，丢弃 addr:%s", addr)
+		f.drop(key, msg)
+		return nil, false
+	}
+	msg.parts[index] = chunk
+	msg.got++
+	msg.size += len(chunk)
+	f.used += len(chunk)
+	if msg.got < total {
+		return nil, false
+	}
+	f.drop(key, msg)
+	return &Packet{
+		Command: msg.command,
+		Version: packet.Version,
+		Name:    packet.Name,
+		Sign:    packet.Sign,
+		Data:    bytes.Join(msg.parts, nil),
+		authed:  packet.authed,
+	}, true
+}
+
+func (f *fragmentBuffer) drop(key string, msg *fragmentMsg) {
+	f.used -= msg.size
+	delete(f.msgMap, key)
+}
+
+// sweep 清理超时未收齐的消息, 最多每秒执行一次
+func (f *fragmentBuffer) sweep() {
+	if time.Since(f.lastSweep) < time.Second {
+		return
+	}
+	f.lastSweep = time.Now()
+	for key, msg := range f.msgMap {
+		if time.Since(msg.start) > f.timeout {
+			ErrorF("分片消息超时未收齐，丢弃 key:%s got:%d total:%d", key, msg.got, len(msg.parts))
+			f.drop(key, msg)
+		}
+	}
+}
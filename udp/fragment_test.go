@@ -0,0 +1,166 @@
+package udp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// splitPackets 拆分并解开每个分片包
+func splitPackets(t *testing.T, cmd CommandCode, data []byte) []*Packet {
+	t.Helper()
+	cipher, err := NewCipher(CipherAES256GCM, "fragment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := packetEncoderSplit(cmd, ProtocolVersion, "c", "sign123", cipher, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets := make([]*Packet, 0, len(raw))
+	for _, b := range raw {
+		p, err := PacketDecrypt(cipher, b, len(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, p)
+	}
+	return packets
+}
+
+func TestFragmentSmallNotSplit(t *testing.T) {
+	packets := splitPackets(t, CommandPut, make([]byte, FragmentDataSize))
+	if len(packets) != 1 || packets[0].Command != CommandPut {
+		t.Fatalf("got %d packets, command %d", len(packets), packets[0].Command)
+	}
+}
+
+func TestFragmentReassembleOutOfOrder(t *testing.T) {
+	data := make([]byte, 3*FragmentDataSize+100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	packets := splitPackets(t, CommandPut, data)
+	if len(packets) != 4 {
+		t.Fatalf("got %d fragments, want 4", len(packets))
+	}
+	f := newFragmentBuffer()
+	order := []int{3, 1, 1, 0}
+	for _, i := range order {
+		if _, ok := f.add("a", packets[i]); ok {
+			t.Fatalf("fragment %d completed the message early", i)
+		}
+	}
+	whole, ok := f.add("a", packets[2])
+	if !ok {
+		t.Fatal("message not completed")
+	}
+	if whole.Command != CommandPut || whole.Name != packets[0].Name || whole.Sign != packets[0].Sign {
+		t.Fatalf("unexpected header %+v", whole)
+	}
+	if !bytes.Equal(whole.Data, data) {
+		t.Fatal("reassembled data differs")
+	}
+	if len(f.msgMap) != 0 || f.used != 0 {
+		t.Fatalf("buffer not released: msgs=%d used=%d", len(f.msgMap), f.used)
+	}
+}
+
+func TestFragmentSameIdDifferentAddr(t *testing.T) {
+	packets := splitPackets(t, CommandNotice, make([]byte, 2*FragmentDataSize))
+	f := newFragmentBuffer()
+	f.add("a", packets[0])
+	if _, ok := f.add("b", packets[1]); ok {
+		t.Fatal("fragments from different addresses were joined")
+	}
+	if _, ok := f.add("a", packets[1]); !ok {
+		t.Fatal("message not completed")
+	}
+}
+
+func TestFragmentTimeout(t *testing.T) {
+	f := newFragmentBuffer()
+	f.setLimit(10*time.Millisecond, 0, 0)
+	first := splitPackets(t, CommandPut, make([]byte, 2*FragmentDataSize))
+	f.add("a", first[0])
+	time.Sleep(20 * time.Millisecond)
+	f.lastSweep = time.Time{}
+	second := splitPackets(t, CommandPut, make([]byte, 2*FragmentDataSize))
+	f.add("a", second[0])
+	if len(f.msgMap) != 1 || f.used != len(second[0].Data)-fragmentHeadSize {
+		t.Fatalf("expired message not dropped: msgs=%d used=%d", len(f.msgMap), f.used)
+	}
+	if _, ok := f.add("a", first[1]); ok {
+		t.Fatal("expired message completed")
+	}
+}
+
+func TestFragmentMaxMessage(t *testing.T) {
+	f := newFragmentBuffer()
+	f.setLimit(0, 2*FragmentDataSize, 0)
+	packets := splitPackets(t, CommandPut, make([]byte, 2*FragmentDataSize+1))
+	for _, p := range packets {
+		if _, ok := f.add("a", p); ok {
+			t.Fatal("oversized message completed")
+		}
+	}
+	if len(f.msgMap) != 0 || f.used != 0 {
+		t.Fatalf("oversized message buffered: msgs=%d used=%d", len(f.msgMap), f.used)
+	}
+}
+
+func TestFragmentMaxMemory(t *testing.T) {
+	f := newFragmentBuffer()
+	f.setLimit(0, 0, FragmentDataSize+FragmentDataSize/2)
+	first := splitPackets(t, CommandPut, make([]byte, 2*FragmentDataSize))
+	second := splitPackets(t, CommandPut, make([]byte, 2*FragmentDataSize))
+	f.add("a", first[0])
+	f.add("a", second[0])
+	if len(f.msgMap) != 1 || f.used != FragmentDataSize {
+		t.Fatalf("memory cap not enforced: msgs=%d used=%d", len(f.msgMap), f.used)
+	}
+	if _, ok := f.add("a", first[1]); ok {
+		t.Fatal("message over the memory cap completed")
+	}
+	if f.used > FragmentDataSize+FragmentDataSize/2 {
+		t.Fatalf("used %d over the cap", f.used)
+	}
+}
+
+// 单个分片超过 FragmentDataSize 时丢弃, 不能绕过单条消息的限制
+func TestFragmentOversizedChunk(t *testing.T) {
+	f := newFragmentBuffer()
+	packets := splitPackets(t, CommandPut, make([]byte, 2*FragmentDataSize))
+	forged := *packets[0]
+	forged.Data = append(append([]byte(nil), packets[0].Data...), make([]byte, 60000)...)
+	if _, ok := f.add("a", &forged); ok {
+		t.Fatal("oversized chunk completed")
+	}
+	if len(f.msgMap) != 0 || f.used != 0 {
+		t.Fatalf("oversized chunk buffered: msgs=%d used=%d", len(f.msgMap), f.used)
+	}
+}
+
+func TestFragmentInconsistentTotal(t *testing.T) {
+	f := newFragmentBuffer()
+	packets := splitPackets(t, CommandPut, make([]byte, 2*FragmentDataSize))
+	f.add("a", packets[0])
+	forged := *packets[1]
+	forged.Data = append([]byte(nil), packets[1].Data...)
+	forged.Data[11] = 3 // 总数改为3
+	if _, ok := f.add("a", &forged); ok {
+		t.Fatal("inconsistent fragment completed")
+	}
+	if len(f.msgMap) != 0 || f.used != 0 {
+		t.Fatalf("inconsistent message kept: msgs=%d used=%d", len(f.msgMap), f.used)
+	}
+}
+
+// 地址错误或无法连接时返回错误
+func TestNewClientBadHost(t *testing.T) {
+	for _, host := range []string{"127.0.0.1", "127.0.0.1:port"} {
+		if c, err := NewClient(host); err == nil || c != nil {
+			t.Fatalf("host %q: got %v", host, err)
+		}
+	}
+}
@@ -1,7 +1,5 @@
 package udp
 
-import "sync"
-
 type GetData struct {
 	Label    string    // 标签，用于区分当前数据处理的方法
 	Id       int64     // 唯一id
@@ -15,4 +13,10 @@ type ServersGetFunc map[string]func(s *Servers, param []byte) (int, []byte)
 
 type ClientGetFunc map[string]func(c *Client, param []byte) (int, []byte)
 
-var GetDataMap sync.Map
+// done 通知等待方已收到应答, 等待方已经退出时不阻塞
+func (g *GetData) done() {
+	select {
+	case g.ctxChan <- true:
+	default:
+	}
+}
@@ -1,3 +1,10 @@
 module github.com/mangenotwork/beacon-tower/udp
 
 go 1.19
+
+require (
+	go.etcd.io/bbolt v1.3.7
+	golang.org/x/crypto v0.14.0
+)
+
+require golang.org/x/sys v0.13.0 // indirect
@@ -0,0 +1,145 @@
+package udp
+
+import (
+	"sync"
+)
+
+// notifier 按事件发生的顺序依次执行回调, 回调在独立的goroutine中执行, 不阻塞收发
+type notifier struct {
+	lock    sync.Mutex
+	queue   []func()
+	running bool
+}
+
+func (n *notifier) push(fn func()) {
+	n.lock.Lock()
+	n.queue = append(n.queue, fn)
+	if n.running {
+		n.lock.Unlock()
+		return
+	}
+	n.running = true
+	n.lock.Unlock()
+	go func() {
+		for {
+			n.lock.Lock()
+			if len(n.queue) == 0 {
+				n.running = false
+				n.lock.Unlock()
+				return
+			}
+			fn := n.queue[0]
+			n.queue = n.queue[1:]
+			n.lock.Unlock()
+			fn()
+		}
+	}()
+}
+
+// ClientHookFunc 客户端连接生命周期回调
+type ClientHookFunc func(s *Servers, info ClientConnInfo)
+
+// clientHooks 客户端上线, 重连, 离线的回调
+type clientHooks struct {
+	lock      sync.RWMutex
+	notify    notifier
+	connect   ClientHookFunc
+	reconnect ClientHookFunc
+	offline   ClientHookFunc
+}
+
+// OnClientConnect 注册客户端首次上线的回调
+func (s *Servers) OnClientConnect(f ClientHookFunc) {
+	s.hooks.lock.Lock()
+	defer s.hooks.lock.Unlock()
+	s.hooks.connect = f
+}
+
+// OnClientReconnect 注册客户端重新上线的回调: 离线后再次连接, 或在线期间更换了端口(如c端重启)
+func (s *Servers) OnClientReconnect(f ClientHookFunc) {
+	s.hooks.lock.Lock()
+	defer s.hooks.lock.Unlock()
+	s.hooks.reconnect = f
+}
+
+// OnClientOffline 注册客户端离线的回调: 心跳超时或被 ClientDiscard 移除
+func (s *Servers) OnClientOffline(f ClientHookFunc) {
+	s.hooks.lock.Lock()
+	defer s.hooks.lock.Unlock()
+	s.hooks.offline = f
+}
+
+// emitClientEvent 按顺序执行对应事件的回调
+func (s *Servers) emitClientEvent(event clientEvent, info ClientConnInfo) {
+	s.hooks.lock.RLock()
+	var fn ClientHookFunc
+	switch event {
+	case clientEventConnect:
+		fn = s.hooks.connect
+	case clientEventReconnect:
+		fn = s.hooks.reconnect
+	case clientEventOffline:
+		fn = s.hooks.offline
+	}
+	s.hooks.lock.RUnlock()
+	if fn == nil {
+		return
+	}
+	s.hooks.notify.push(func() {
+		fn(s, info)
+	})
+}
+
+// PutAckedFunc c端Put的数据被s端确认的回调, id 为 PutAsync 返回的 PutFuture.Id
+type PutAckedFunc func(c *Client, id int64, label string)
+
+// PutDroppedFunc c端Put的数据未被确认就被丢弃的回调, reason 为 ErrBacklogDropped 或 ErrBacklogExpired
+type PutDroppedFunc func(c *Client, id int64, label string, reason error)
+
+// putHooks c端Put确认与丢弃的回调
+type putHooks struct {
+	lock    sync.RWMutex
+	notify  notifier
+	acked   PutAckedFunc
+	dropped PutDroppedFunc
+}
+
+// OnPutAcked 注册Put的数据被s端确认的回调, 同一个 id 只回调一次, 回调按顺序在独立的goroutine中执行
+// 重启后从积压存储恢复的数据被确认时同样回调
+func (c *Client) OnPutAcked(f PutAckedFunc) {
+	c.putHooks.lock.Lock()
+	defer c.putHooks.lock.Unlock()
+	c.putHooks.acked = f
+}
+
+// OnPutDropped 注册Put的数据因 ClientConf.BacklogLimit 的限制或过期被丢弃的回调
+// BacklogReject 与积压写入失败时 Put 直接返回错误, 不回调
+func (c *Client) OnPutDropped(f PutDroppedFunc) {
+	c.putHooks.lock.Lock()
+	defer c.putHooks.lock.Unlock()
+	c.putHooks.dropped = f
+}
+
+func (c *Client) emitPutAcked(id int64, label string) {
+	c.putHooks.lock.RLock()
+	fn := c.putHooks.acked
+	c.putHooks.lock.RUnlock()
+	if fn == nil {
+		return
+	}
+	c.putHooks.notify.push(func() {
+		fn(c, id, label)
+	})
+}
+
+func (c *Client) emitPutDropped(id int64, label string, reason error) {
+	c.putHooks.lock.RLock()
+	fn := c.putHooks.dropped
+	c.putHooks.lock.RUnlock()
+	if fn == nil {
+		return
+	}
+	c.putHooks.notify.push(func() {
+		fn(c, id, label, reason)
+	})
+}
@@ -0,0 +1,109 @@
+package udp
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRegistryJoinEvents(t *testing.T) {
+	r := newClientRegistry()
+	a := testAddr("10.0.0.1", 1000)
+	if _, event := r.join("c1", "10.0.0.1", a, session{}); event != clientEventConnect {
+		t.Fatalf("first join event %d, want connect", event)
+	}
+	if _, event := r.join("c1", "10.0.0.1", a, session{}); event != clientEventNone {
+		t.Fatalf("heartbeat event %d, want none", event)
+	}
+	if _, event := r.join("c1", "10.0.0.1", testAddr("10.0.0.1", 1001), session{}); event != clientEventReconnect {
+		t.Fatalf("port change event %d, want reconnect", event)
+	}
+	// 旧端口过期不影响新端口的在线状态
+	r.discardExpired(time.Now().Unix() + 1)
+	r.join("c1", "10.0.0.1", testAddr("10.0.0.1", 1001), session{})
+	if offline := r.discard("c1", ""); len(offline) != 1 || offline[0].Addr != "10.0.0.1:1001" {
+		t.Fatalf("discarded %+v", offline)
+	}
+	if _, event := r.join("c1", "10.0.0.1", a, session{}); event != clientEventReconnect {
+		t.Fatalf("join after discard event %d, want reconnect", event)
+	}
+}
+
+func TestClientHooks(t *testing.T) {
+	s, err := NewServers("127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = s.Conn.Close() }()
+	events := make(chan string, 8)
+	hook := func(kind string) ClientHookFunc {
+		return func(s *Servers, info ClientConnInfo) {
+			events <- fmt.Sprintf("%s %s %v", kind, info.Addr, info.Online)
+		}
+	}
+	s.OnClientConnect(hook("connect"))
+	s.OnClientReconnect(hook("reconnect"))
+	s.OnClientOffline(hook("offline"))
+
+	name := formatName("c1")
+	a, b := testAddr("10.0.0.1", 1000), testAddr("10.0.0.1", 1001)
+	s.clientJoin(name, "10.0.0.1", a, session{})
+	s.clientJoin(name, "10.0.0.1", a, session{}) // 心跳不触发
+	s.clientJoin(name, "10.0.0.1", b, session{})
+	s.ClientDiscard("c1", "")
+	s.clientJoin(name, "10.0.0.1", b, session{})
+
+	want := []string{
+		"connect 10.0.0.1:1000 true",
+		"reconnect 10.0.0.1:1001 true",
+		"offline 10.0.0.1:1001 false",
+		"reconnect 10.0.0.1:1001 true",
+	}
+	for i, w := range want {
+		select {
+		case got := <-events:
+			if got != w {
+				t.Fatalf("event %d: %q, want %q", i, got, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %d not delivered", i)
+		}
+	}
+	select {
+	case got := <-events:
+		t.Fatalf("unexpected event %q", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// 回调按顺序执行, 阻塞的回调不阻塞调用方
+func TestNotifierOrder(t *testing.T) {
+	var n notifier
+	release := make(chan struct{})
+	got := make(chan int, 100)
+	n.push(func() { <-release })
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			i := i
+			n.push(func() { got <- i })
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("push blocked on a running hook")
+	}
+	close(release)
+	for i := 0; i < 100; i++ {
+		select {
+		case v := <-got:
+			if v != i {
+				t.Fatalf("hook %d ran at position %d", v, i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("hook %d not run", i)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package udp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+/*
+
+会话密钥交换 (FeatureKeyExchange)
+
+1. c端每次发送连接包生成临时 X25519 密钥, 公钥放在 hello 中
+2. s端生成临时密钥, 共享秘密经 HKDF-SHA256(salt 为预共享秘钥派生, info 为双方公钥) 派生c端发送与s端发送两个方向的会话密钥
+   与包认证密钥(见 mac.go), 连接回应追加 s端公钥 + c端公钥; s端设置了身份密钥时再追加 ed25519 签名, c端设置了 ServerKeyPin 时校验签名
+3. 连接包, 心跳包与连接回应使用预共享秘钥加密, 握手由预共享秘钥认证; 其他包使用会话密钥, 会话建立后用预共享秘钥加密的其他包被丢弃
+4. 临时私钥用完即丢弃, 预共享秘钥或节点泄露后无法解密已记录的会话流量(前向安全)
+5. 心跳不重新交换, 携带当前会话的c端公钥; s端没有对应的会话密钥时(如s端重启)回应不带该特性, c端丢弃会话密钥后重新连接
+   重发的连接包(c端公钥与当前会话一致)不重新交换, 沿用会话密钥与签名, 回应相同的内容
+6. 重新交换后保留上一次的接收密钥, 用于解密交换前已发出的包
+7. DES ECB 与旧版协议(版本0)不支持密钥交换
+8. 拒绝连接的回应只由预共享秘钥加密: 固定了 ServerKeyPin 或建立过会话密钥的c端不因版本拒绝降级,
+   已连接的 ServerKeyPin c端忽略认证拒绝, s端确实拒绝时心跳不再回应, 失去响应后重连时再处理
+
+*/
+
+const kxKeySize = 32 // X25519 公钥与私钥的字节
+
+// sessionKeys 密钥交换派生的会话密钥, 实现 Cipher
+type sessionKeys struct {
+	send      Cipher // 发送
+	recv      Cipher // 接收
+	prevRecv  Cipher // 上一次交换的接收密钥
+	clientPub []byte // c端的临时公钥, 用于心跳确认双方的会话一致
+	macKey    []byte // s端同一次派生的包认证密钥
+	reply     []byte // s端连接回应中的密钥交换数据, 重发的连接包回应相同的内容
+}
+
+func (k *sessionKeys) Suite() CipherSuite {
+	return k.send.Suite()
+}
+
+func (k *sessionKeys) Encrypt(header, data []byte) ([]byte, error) {
+	return k.send.Encrypt(header, data)
+}
+
+func (k *sessionKeys) Decrypt(header, data []byte) ([]byte, error) {
+	out, err := k.recv.Decrypt(header, data)
+	if err != nil && k.prevRecv != nil {
+		return k.prevRecv.Decrypt(header, data)
+	}
+	return out, err
+}
+
+// kxGenerate 生成临时 X25519 密钥
+func kxGenerate() (priv, pub []byte, err error) {
+	priv = make([]byte, kxKeySize)
+	if _, err = io.ReadFull(rand.Reader, priv); err != nil {
+		return nil, nil, err
+	}
+	pub, err = curve25519.X25519(priv, curve25519.Basepoint)
+	return priv, pub, err
+}
+
+// kxTranscript s端身份密钥签名的内容
+func kxTranscript(clientPub, serverPub []byte) []byte {
+	b := make([]byte, 0, 20+2*kxKeySize)
+	b = append(b, "beacon-tower/udp kx:"...)
+	b = append(b, clientPub...)
+	return append(b, serverPub...)
+}
+
+// kxDerive 由共享秘密派生会话密钥, 返回c端发送与s端发送的密钥与包认证密钥
+func kxDerive(suite CipherSuite, secretKey string, priv, peerPub, clientPub, serverPub []byte) (c2s, s2c Cipher, macKey []byte, err error) {
+	shared, err := curve25519.X25519(priv, peerPub)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	info := append([]byte("beacon-tower/udp session:"), clientPub...)
+	info = append(info, serverPub...)
+	key := make([]byte, 64+PacketMACKeySize)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, shared, deriveKey(secretKey), info), key); err != nil {
+		return nil, nil, nil, err
+	}
+	if c2s, err = newAEADCipher(suite, key[:32]); err != nil {
+		return nil, nil, nil, err
+	}
+	if s2c, err = newAEADCipher(suite, key[32:64]); err != nil {
+		return nil, nil, nil, err
+	}
+	return c2s, s2c, key[64:], nil
+}
+
+// SetIdentityKey 设置s端的身份密钥, 连接回应携带对密钥交换的签名, c端通过 ServerKeyPin 固定s端的公钥
+func (s *Servers) SetIdentityKey(key ed25519.PrivateKey) {
+	s.identity = key
+}
+
+// IdentityPublicKey s端身份密钥的公钥, 配置到c端的 ServerKeyPin; 未设置身份密钥时为空
+func (s *Servers) IdentityPublicKey() ed25519.PublicKey {
+	if s.identity == nil {
+		return nil
+	}
+	return s.identity.Public().(ed25519.PublicKey)
+}
+
+// packetSession s端解包使用的会话: 连接包与心跳包使用预共享秘钥, 返回 false; 其他包使用c端的会话密钥与认证密钥
+func (s *Servers) packetSession(addr string, data []byte) (session, bool) {
+	if len(data) > 0 {
+		cmd := CommandCode(data[0]) &^ commandVersioned
+		if cmd == CommandConnect || cmd == CommandHeartbeat {
+			return session{}, false
+		}
+	}
+	return s.clients.session(addr)
+}
+
+// sessionCipher s端向 addr 发包使用的密钥, 未建立会话时使用预共享秘钥
+func (s *Servers) sessionCipher(addr string, sess session) Cipher {
+	if sess.keys != nil {
+		return sess.keys
+	}
+	return s.addrCipher(addr)
+}
+
+// keyExchange s端处理连接包与心跳包中的密钥交换, 结果存入 sess, 返回连接回应中追加的数据
+func (s *Servers) keyExchange(cmd CommandCode, addr string, h *hello, sess *session) []byte {
+	if !sess.Features.Has(FeatureKeyExchange) {
+		return nil
+	}
+	prev, _ := s.clients.session(addr)
+	if s.addrCipher(addr).Suite() == CipherDesECB || len(h.PublicKey) != kxKeySize {
+		sess.Features &^= FeatureKeyExchange
+		return nil
+	}
+	if sameKeyExchange(prev, h) {
+		// 心跳与重发的连接包沿用c端当前的会话密钥
+		sess.keys = prev.keys
+		if cmd == CommandHeartbeat {
+			return nil
+		}
+		return prev.keys.reply
+	}
+	if cmd == CommandHeartbeat {
+		// 不一致时(如s端重启)不带该特性, c端重新连接
+		sess.Features &^= FeatureKeyExchange
+		return nil
+	}
+	priv, pub, err := kxGenerate()
+	if err != nil {
+		Error("生成临时密钥失败 err:", err)
+		sess.Features &^= FeatureKeyExchange
+		return nil
+	}
+	c2s, s2c, macKey, err := kxDerive(s.cipher.Suite(), s.secretKey, priv, h.PublicKey, h.PublicKey, pub)
+	if err != nil {
+		Error("密钥交换失败 err:", err)
+		sess.Features &^= FeatureKeyExchange
+		return nil
+	}
+	out := make([]byte, 0, 2*kxKeySize+ed25519.SignatureSize)
+	out = append(out, pub...)
+	out = append(out, h.PublicKey...)
+	if s.identity != nil {
+		out = append(out, ed25519.Sign(s.identity, kxTranscript(h.PublicKey, pub))...)
+	}
+	keys := &sessionKeys{send: s2c, recv: c2s, clientPub: append([]byte(nil), h.PublicKey...), macKey: macKey, reply: out}
+	if prev.keys != nil {
+		keys.prevRecv = prev.keys.recv
+	}
+	sess.keys = keys
+	return out
+}
+
+// sameKeyExchange 心跳或连接包携带的c端公钥与当前会话一致
+func sameKeyExchange(prev session, h *hello) bool {
+	return prev.keys != nil && len(h.PublicKey) == kxKeySize && bytes.Equal(prev.keys.clientPub, h.PublicKey)
+}
+
+// connectSign 连接回应下发的签名, 重发的连接包沿用当前的签名, 需在存储连接前调用
+func (s *Servers) connectSign(cmd CommandCode, addr string, h *hello) string {
+	if cmd == CommandConnect {
+		if prev, _ := s.clients.session(addr); sameKeyExchange(prev, h) {
+			if sign := s.SignGet(addr); sign != "" {
+				return sign
+			}
+		}
+	}
+	return createSign()
+}
+
+// kxSecured 固定了s端公钥或建立过会话密钥, 见上方说明第8条
+func (c *Client) kxSecured() bool {
+	c.kxLock.Lock()
+	defer c.kxLock.Unlock()
+	return c.serverKeyPin != nil || c.keys != nil
+}
+
+// refusalIgnored 已连接的 ServerKeyPin c端忽略只由预共享秘钥加密的认证拒绝
+func (c *Client) refusalIgnored() bool {
+	c.kxLock.Lock()
+	pinned := c.serverKeyPin != nil && c.keys != nil
+	c.kxLock.Unlock()
+	return pinned && c.State() == StateConnected
+}
+
+// SetServerKeyPin 固定s端身份密钥的公钥, 设置后只接受该s端签名的密钥交换, 为空时不校验
+func (c *Client) SetServerKeyPin(pin ed25519.PublicKey) {
+	c.kxLock.Lock()
+	defer c.kxLock.Unlock()
+	c.serverKeyPin = pin
+}
+
+// keyExchangeEnabled c端是否发起密钥交换
+func (c *Client) keyExchangeEnabled() bool {
+	return c.ProtocolVersion() > 0 && c.cipher.Suite() != CipherDesECB
+}
+
+// sessionCipher c端发包使用的密钥, 未建立会话时使用预共享秘钥
+func (c *Client) sessionCipher() Cipher {
+	c.kxLock.Lock()
+	defer c.kxLock.Unlock()
+	if c.keys != nil {
+		return c.keys
+	}
+	return c.cipher
+}
+
+// kxPublicKey 连接包生成新的临时密钥, 心跳包使用当前会话的公钥
+func (c *Client) kxPublicKey(cmd CommandCode) []byte {
+	c.kxLock.Lock()
+	defer c.kxLock.Unlock()
+	if cmd == CommandHeartbeat {
+		if c.keys == nil {
+			return nil
+		}
+		return c.keys.clientPub
+	}
+	priv, pub, err := kxGenerate()
+	if err != nil {
+		Error("生成临时密钥失败 err:", err)
+		return nil
+	}
+	c.kxPriv, c.kxPub = priv, pub
+	return pub
+}
+
+// packetDecrypt c端解包, 先校验认证码(见 mac.go)并使用会话密钥
+// 返回的 handshake 为 true 表示会话建立后没有认证码或使用预共享秘钥加密的包, 只接受连接回应
+func (c *Client) packetDecrypt(data []byte, n int) (packet *Packet, handshake bool, err error) {
+	c.kxLock.Lock()
+	keys, mac := c.keys, c.mac
+	c.kxLock.Unlock()
+	if mac != nil {
+		m, ok := mac.open(data, n)
+		if !ok {
+			packet, err = PacketDecrypt(c.cipher, data, n)
+			return packet, true, err
+		}
+		cipher := c.cipher
+		if keys != nil {
+			cipher = keys
+		}
+		if packet, err = PacketDecrypt(cipher, data, m); err != nil {
+			return nil, false, err
+		}
+		packet.authed = true
+		return packet, false, nil
+	}
+	if keys != nil {
+		if packet, err = PacketDecrypt(keys, data, n); err == nil {
+			return packet, false, nil
+		}
+	}
+	packet, err = PacketDecrypt(c.cipher, data, n)
+	return packet, keys != nil, err
+}
+
+// acceptKeyExchange 处理连接回应中的密钥交换, 返回同一次派生的包认证密钥, 返回 false 时忽略该回应
+func (c *Client) acceptKeyExchange(features Feature, data []byte) ([]byte, bool) {
+	c.kxLock.Lock()
+	if !c.keyExchangeEnabled() {
+		// 不支持密钥交换的版本, 固定了s端公钥时不接受降级
+		c.keys = nil
+		pinned := c.serverKeyPin != nil
+		c.kxLock.Unlock()
+		if pinned {
+			Error(ErrKeyExchangeRequired)
+			return nil, false
+		}
+		return nil, true
+	}
+	if !features.Has(FeatureKeyExchange) {
+		if c.keys != nil {
+			// s端没有该会话的密钥(如s端重启), 丢弃会话密钥重新连接
+			c.keys = nil
+			c.kxLock.Unlock()
+			Info("会话密钥失效, 重新连接")
+			c.ConnectServers()
+			return nil, false
+		}
+		pinned := c.serverKeyPin != nil
+		c.kxLock.Unlock()
+		if pinned {
+			Error(ErrKeyExchangeRequired)
+			return nil, false
+		}
+		return nil, true
+	}
+	defer c.kxLock.Unlock()
+	if len(data) == 0 {
+		// 心跳的回应, 沿用会话密钥
+		return nil, c.keys != nil
+	}
+	if len(data) < 2*kxKeySize {
+		return nil, false
+	}
+	serverPub, clientPub, sig := data[:kxKeySize], data[kxKeySize:2*kxKeySize], data[2*kxKeySize:]
+	if c.kxPriv == nil || !bytes.Equal(clientPub, c.kxPub) {
+		// 之前的连接包的回应
+		return nil, false
+	}
+	if c.serverKeyPin != nil && (len(sig) != ed25519.SignatureSize || !ed25519.Verify(c.serverKeyPin, kxTranscript(clientPub, serverPub), sig)) {
+		Error(ErrServerKeyPin)
+		return nil, false
+	}
+	c2s, s2c, macKey, err := kxDerive(c.cipher.Suite(), c.secretKey, c.kxPriv, serverPub, clientPub, serverPub)
+	if err != nil {
+		Error("密钥交换失败 err:", err)
+		return nil, false
+	}
+	keys := &sessionKeys{send: c2s, recv: s2c, clientPub: c.kxPub}
+	if c.keys != nil {
+		keys.prevRecv = c.keys.recv
+	}
+	c.keys = keys
+	// 临时私钥用完即丢弃
+	c.kxPriv = nil
+	return macKey, true
+}
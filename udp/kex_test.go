@@ -0,0 +1,170 @@
+package udp
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"net"
+	"testing"
+	"time"
+)
+
+// connectOnce s端处理一次连接包或心跳包, 返回回应中的签名, 认证密钥与密钥交换数据
+func connectOnce(s *Servers, cmd CommandCode, addr *net.UDPAddr, h *hello) (string, []byte, []byte, session) {
+	sess := session{Version: 1, Features: FeatureKeyExchange | FeaturePacketMAC}
+	sign := s.connectSign(cmd, addr.String(), h)
+	kx := s.keyExchange(cmd, addr.String(), h, &sess)
+	macKey := s.issueMAC(cmd, addr.String(), h, &sess)
+	s.clients.join("c", addr.IP.String(), addr, sess)
+	s.SignStore(addr.String(), sign)
+	return sign, macKey, kx, sess
+}
+
+// 重发的连接包沿用会话密钥, 认证密钥与签名, 回应相同的内容
+func TestDuplicateConnect(t *testing.T) {
+	s := testServers(t)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9}
+	_, pub, err := kxGenerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &hello{PublicKey: pub}
+	sign, _, kx, sess := connectOnce(s, CommandConnect, addr, h)
+	if len(kx) == 0 || sess.keys == nil || sess.mac == nil {
+		t.Fatalf("key exchange not negotiated: features %b", sess.Features)
+	}
+	sign2, macKey2, kx2, sess2 := connectOnce(s, CommandConnect, addr, h)
+	if sign2 != sign || len(macKey2) != 0 || !bytes.Equal(kx2, kx) {
+		t.Fatal("duplicate connect answered with a different reply")
+	}
+	if sess2.keys != sess.keys || sess2.mac != sess.mac {
+		t.Fatal("duplicate connect replaced the session keys")
+	}
+
+	// 心跳沿用会话, 重新颁发签名
+	h.MACKeyId = sess.mac.keyId
+	sign3, macKey3, kx3, sess3 := connectOnce(s, CommandHeartbeat, addr, h)
+	if sign3 == sign || len(macKey3) != 0 || len(kx3) != 0 || sess3.keys != sess.keys || sess3.mac != sess.mac {
+		t.Fatal("heartbeat changed the session")
+	}
+
+	// 新的临时公钥重新交换
+	_, pub2, _ := kxGenerate()
+	_, _, kx4, sess4 := connectOnce(s, CommandConnect, addr, &hello{PublicKey: pub2})
+	if bytes.Equal(kx4, kx) || bytes.Equal(sess4.mac.key, sess.mac.key) || sess4.keys == sess.keys {
+		t.Fatal("new connect reused the previous session")
+	}
+	if sess4.keys.prevRecv != sess.keys.recv || !bytes.Equal(sess4.mac.prev, sess.mac.key) {
+		t.Fatal("previous keys not kept")
+	}
+
+	// s端没有对应的会话时心跳不带该特性
+	_, pub3, _ := kxGenerate()
+	if _, _, _, sess5 := connectOnce(s, CommandHeartbeat, addr, &hello{PublicKey: pub3}); sess5.Features.Has(FeatureKeyExchange) || sess5.Features.Has(FeaturePacketMAC) {
+		t.Fatal("heartbeat with an unknown key kept the feature")
+	}
+}
+
+// 协商了密钥交换时认证密钥由同一次派生得到, 连接回应不下发
+func TestKeyExchangeMAC(t *testing.T) {
+	s := testServers(t)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9}
+	priv, pub, _ := kxGenerate()
+	_, macKey, kx, sess := connectOnce(s, CommandConnect, addr, &hello{PublicKey: pub})
+	if len(macKey) != 0 {
+		t.Fatal("derived MAC key sent in the reply")
+	}
+	_, _, derived, err := kxDerive(s.cipher.Suite(), s.secretKey, priv, kx[:kxKeySize], pub, kx[:kxKeySize])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(derived) != PacketMACKeySize || !bytes.Equal(derived, sess.mac.key) {
+		t.Fatal("client and server derived different MAC keys")
+	}
+
+	// 未进行密钥交换时s端生成并下发
+	other := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 10}
+	_, macKey, kx, sess = connectOnce(s, CommandConnect, other, &hello{})
+	if len(kx) != 0 || len(macKey) != PacketMACKeySize || !bytes.Equal(macKey, sess.mac.key) {
+		t.Fatal("MAC key not issued without key exchange")
+	}
+}
+
+// 建立会话后s端只接受会话密钥加密的包
+func TestSessionKeysRequired(t *testing.T) {
+	s := testServers(t)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9}
+	_, pub, _ := kxGenerate()
+	sign, _, _, sess := connectOnce(s, CommandConnect, addr, &hello{PublicKey: pub})
+	psk, err := PacketEncoderVersion(CommandNotice, 1, "c", sign, s.cipher, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	psk = sess.mac.seal(psk)
+	if _, _, ok := s.receive(addr, psk, len(psk)); ok {
+		t.Fatal("pre-shared key packet accepted after key exchange")
+	}
+	client := &sessionKeys{send: sess.keys.recv, recv: sess.keys.send}
+	b, err := PacketEncoderVersion(CommandNotice, 1, "c", sign, client, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = sess.mac.seal(b)
+	if _, _, ok := s.receive(addr, b, len(b)); !ok {
+		t.Fatal("session key packet rejected")
+	}
+}
+
+func TestKeyExchangePin(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c := testPair(t, func(s *Servers) {
+		s.SetIdentityKey(priv)
+		s.PutHandleFunc("r", func(s *Servers, ci *ClientInfo, body []byte) {})
+	}, func(conf *ClientConf) {
+		conf.ServerKeyPin = pub
+	})
+	waitConnected(t, c)
+	if !c.Features().Has(FeatureKeyExchange) || c.sessionCipher() == c.cipher {
+		t.Fatalf("session keys not used, features %b", c.Features())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err = c.PutSync(ctx, "r", []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+
+	// s端的身份与 ServerKeyPin 不一致时不连接
+	other, _, _ := ed25519.GenerateKey(nil)
+	_, bad := testPair(t, func(s *Servers) {
+		s.SetIdentityKey(priv)
+	}, func(conf *ClientConf) {
+		conf.ServerKeyPin = other
+	})
+	time.Sleep(300 * time.Millisecond)
+	if bad.State() == StateConnected {
+		t.Fatal("connected to a server with another identity")
+	}
+}
+
+// 已连接的 ServerKeyPin c端忽略认证拒绝
+func TestRefusalIgnoredWhenPinned(t *testing.T) {
+	c := versionClient()
+	c.serverKeyPin = make(ed25519.PublicKey, ed25519.PublicKeySize)
+	c.keys = &sessionKeys{}
+	c.state = StateConnected
+	if !c.refusalIgnored() {
+		t.Fatal("pinned session accepted a refusal")
+	}
+	c.state = StateConnecting
+	if c.refusalIgnored() {
+		t.Fatal("refusal ignored before connecting")
+	}
+	c.serverKeyPin = nil
+	c.state = StateConnected
+	if c.refusalIgnored() {
+		t.Fatal("refusal ignored without ServerKeyPin")
+	}
+}
@@ -0,0 +1,240 @@
+package udp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+)
+
+/*
+
+包认证码 (FeaturePacketMAC)
+
+_________________________________________________
+|                        |                       |
+|  包头 + 加密的data...    |  认证码(PacketMACSize)  |
+|________________________|_______________________|
+
+1. 协商了 FeatureKeyExchange 时认证密钥与会话密钥由同一次 HKDF 派生(见 kex.go), 连接回应不下发密钥;
+   未进行密钥交换时s端使用 crypto/rand 生成, 在预共享秘钥加密的连接回应中下发;
+   心跳沿用该密钥并携带密钥id确认双方一致, 重发的连接包沿用该密钥
+2. 除连接包, 心跳包与连接回应外, 每个包(包括分片)在末尾追加 HMAC-SHA256(包头 + 加密的data) 的前 PacketMACSize 字节
+3. s端与c端在解密前校验认证码, 校验失败的包被丢弃, 不会交给处理方法; 协商了该特性的会话不再使用包头的签名
+4. s端没有对应的认证密钥时(如s端重启)心跳回应不带该特性, c端丢弃认证密钥后重新连接
+5. 重新连接后保留上一次的密钥, 用于校验重新连接前已发出的包
+6. s端默认拒绝未协商该特性的c端(SetRequirePacketMAC); 迁移期间设置 AllowSignOnly 或 LegacySecretKey 时允许旧版本只使用签名
+
+*/
+
+// packetMAC 会话的包认证密钥
+type packetMAC struct {
+	key   []byte
+	keyId []byte // 心跳携带的密钥id
+	prev  []byte // 上一次连接的密钥
+}
+
+// newPacketMAC 生成新的认证密钥, prev 为上一次连接的密钥
+func newPacketMAC(prev *packetMAC) (*packetMAC, error) {
+	key := make([]byte, PacketMACKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return loadPacketMAC(key, prev), nil
+}
+
+// loadPacketMAC 使用s端下发的 key
+func loadPacketMAC(key []byte, prev *packetMAC) *packetMAC {
+	m := &packetMAC{key: append([]byte(nil), key...)}
+	m.keyId = macKeyId(m.key)
+	if prev != nil {
+		m.prev = prev.key
+	}
+	return m
+}
+
+func macKeyId(key []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte("beacon-tower/udp key id"))
+	return h.Sum(nil)[:8]
+}
+
+func macSum(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)[:PacketMACSize]
+}
+
+// seal 在包的末尾追加认证码
+func (m *packetMAC) seal(packet []byte) []byte {
+	return append(packet, macSum(m.key, packet)...)
+}
+
+// open 校验认证码, 返回去掉认证码后的长度
+func (m *packetMAC) open(data []byte, n int) (int, bool) {
+	if n < 15+PacketMACSize {
+		return n, false
+	}
+	body, tag := data[:n-PacketMACSize], data[n-PacketMACSize:n]
+	if hmac.Equal(macSum(m.key, body), tag) {
+		return n - PacketMACSize, true
+	}
+	if m.prev != nil && hmac.Equal(macSum(m.prev, body), tag) {
+		return n - PacketMACSize, true
+	}
+	return n, false
+}
+
+// appendMACKey 连接回应中协商了 FeaturePacketMAC 时追加的认证密钥, 心跳回应与密钥交换派生时的长度为0
+func appendMACKey(data []byte, features Feature, key []byte) []byte {
+	if !features.Has(FeaturePacketMAC) {
+		return data
+	}
+	data = binary.AppendUvarint(data, uint64(len(key)))
+	return append(data, key...)
+}
+
+// cutMACKey 取出连接回应中的认证密钥, 返回密钥与剩余的数据
+func cutMACKey(data []byte, features Feature) ([]byte, []byte, bool) {
+	if !features.Has(FeaturePacketMAC) {
+		return nil, data, true
+	}
+	l, n := binary.Uvarint(data)
+	if n <= 0 || l > uint64(len(data)-n) {
+		return nil, nil, false
+	}
+	return data[n : n+int(l)], data[n+int(l):], true
+}
+
+// SetRequirePacketMAC 开启后拒绝未协商 FeaturePacketMAC 的c端(旧版本只使用包头签名)
+// 默认开启, 设置了 ServersConf.AllowSignOnly 或 LegacySecretKey 时关闭, 旧版本c端全部升级后开启
+func (s *Servers) SetRequirePacketMAC(on bool) {
+	s.requireMAC = on
+}
+
+// issueMAC s端处理连接包与心跳包的认证密钥, 结果存入 sess, 返回连接回应中下发的密钥; 在 keyExchange 之后调用
+func (s *Servers) issueMAC(cmd CommandCode, addr string, h *hello, sess *session) []byte {
+	if !sess.Features.Has(FeaturePacketMAC) {
+		return nil
+	}
+	prev, _ := s.clients.session(addr)
+	if cmd == CommandHeartbeat {
+		// 心跳沿用当前的密钥, 不一致时(如s端重启)不带该特性, c端重新连接
+		if prev.mac == nil || !hmac.Equal(prev.mac.keyId, h.MACKeyId) {
+			sess.Features &^= FeaturePacketMAC
+			return nil
+		}
+		sess.mac = prev.mac
+		return nil
+	}
+	if sess.keys != nil {
+		// 密钥交换派生的密钥不下发, 重发的连接包沿用当前的密钥
+		if prev.mac != nil && hmac.Equal(prev.mac.key, sess.keys.macKey) {
+			sess.mac = prev.mac
+		} else {
+			sess.mac = loadPacketMAC(sess.keys.macKey, prev.mac)
+		}
+		return nil
+	}
+	mac, err := newPacketMAC(prev.mac)
+	if err != nil {
+		Error("生成认证密钥失败 err:", err)
+		sess.Features &^= FeaturePacketMAC
+		return nil
+	}
+	sess.mac = mac
+	return mac.key
+}
+
+// signCheck 协商了 FeaturePacketMAC 的包已校验认证码, 其他包校验包头的签名
+func (s *Servers) signCheck(addr string, packet *Packet) bool {
+	return packet.authed || s.SignCheck(addr, packet.Sign)
+}
+
+// sealPackets 按会话的认证密钥在每个包的末尾追加认证码, 未协商时不追加
+func sealPackets(mac *packetMAC, packets [][]byte) [][]byte {
+	if mac == nil {
+		return packets
+	}
+	for i, packet := range packets {
+		packets[i] = mac.seal(packet)
+	}
+	return packets
+}
+
+// packetMACKey c端当前的认证密钥
+func (c *Client) packetMACKey() *packetMAC {
+	c.kxLock.Lock()
+	defer c.kxLock.Unlock()
+	return c.mac
+}
+
+// macKeyId 心跳携带的密钥id
+func (c *Client) macKeyId() []byte {
+	if mac := c.packetMACKey(); mac != nil {
+		return mac.keyId
+	}
+	return nil
+}
+
+// acceptPacketMAC 处理连接回应中的认证密钥, derived 为密钥交换派生的密钥, 返回 false 时忽略该回应
+func (c *Client) acceptPacketMAC(features Feature, key, derived []byte) bool {
+	c.kxLock.Lock()
+	if !features.Has(FeaturePacketMAC) {
+		if c.mac != nil && c.ProtocolVersion() > 0 {
+			// s端没有该会话的密钥(如s端重启), 丢弃密钥重新连接
+			c.mac = nil
+			c.kxLock.Unlock()
+			Info("认证密钥失效, 重新连接")
+			c.ConnectServers()
+			return false
+		}
+		c.mac = nil
+		c.kxLock.Unlock()
+		if c.strictServerAuth() {
+			// 严格模式不接受只有签名的会话
+			Error(ErrServerMACRequired)
+			return false
+		}
+		return true
+	}
+	defer c.kxLock.Unlock()
+	if len(derived) > 0 {
+		c.mac = loadPacketMAC(derived, c.mac)
+		return true
+	}
+	if len(key) == 0 {
+		// 心跳的回应, 沿用认证密钥
+		return c.mac != nil
+	}
+	if len(key) != PacketMACKeySize {
+		return false
+	}
+	c.mac = loadPacketMAC(key, c.mac)
+	return true
+}
+
+// getSign c端当前的签名, 未协商 FeaturePacketMAC 时使用
+func (c *Client) getSign() string {
+	if v, ok := c.sign.Load().(string); ok {
+		return v
+	}
+	return ""
+}
+
+// signCheck 协商了 FeaturePacketMAC 的包已校验认证码, 其他包校验包头的签名
+// 心跳回应更新签名前s端可能已使用新的签名发包, 上一次的签名同样有效
+func (c *Client) signCheck(packet *Packet) bool {
+	if packet.authed {
+		return true
+	}
+	if packet.Sign == "" {
+		return false
+	}
+	if packet.Sign == c.getSign() {
+		return true
+	}
+	prev, _ := c.prevSign.Load().(string)
+	return packet.Sign == prev
+}
@@ -0,0 +1,97 @@
+package udp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPacketMACOpen(t *testing.T) {
+	old, err := newPacketMAC(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := newPacketMAC(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher, _ := NewCipher(CipherAES256GCM, "mac-test")
+	b, _ := PacketEncoderVersion(CommandNotice, 1, "c", "", cipher, []byte("hi"))
+	sealed := m.seal(append([]byte(nil), b...))
+	if n, ok := m.open(sealed, len(sealed)); !ok || n != len(b) {
+		t.Fatalf("sealed packet rejected n=%d", n)
+	}
+	sealed[len(b)-1] ^= 1
+	if _, ok := m.open(sealed, len(sealed)); ok {
+		t.Fatal("tampered packet accepted")
+	}
+	// 重新连接前用上一次的密钥发出的包
+	prev := old.seal(append([]byte(nil), b...))
+	if _, ok := m.open(prev, len(prev)); !ok {
+		t.Fatal("packet sealed with the previous key rejected")
+	}
+	if _, ok := m.open(b, len(b)); ok {
+		t.Fatal("packet without MAC accepted")
+	}
+}
+
+// 协商了认证码的会话不再接受只有签名的包
+func TestPacketMACRequiredForSession(t *testing.T) {
+	s := testServers(t)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9}
+	sess := session{Version: 1, Features: FeaturePacketMAC}
+	macKey := s.issueMAC(CommandConnect, addr.String(), &hello{}, &sess)
+	if len(macKey) != PacketMACKeySize {
+		t.Fatal("MAC key not issued")
+	}
+	sess.name = formatName("c")
+	s.clients.join(formatName("c"), addr.IP.String(), addr, sess)
+	s.SignStore(addr.String(), "sign123")
+	b, _ := PacketEncoderVersion(CommandNotice, 1, "c", "sign123", s.cipher, nil)
+	if _, _, ok := s.receive(addr, b, len(b)); ok {
+		t.Fatal("signed packet without MAC accepted")
+	}
+	sealed := sess.mac.seal(b)
+	packet, _, ok := s.receive(addr, sealed, len(sealed))
+	if !ok || !packet.authed {
+		t.Fatal("packet with MAC rejected")
+	}
+}
+
+// 默认拒绝未协商认证码的c端, 迁移期间设置 AllowSignOnly 或 LegacySecretKey 时允许
+func TestRequirePacketMAC(t *testing.T) {
+	for _, conf := range []ServersConf{
+		{SecretKey: "k", AllowSignOnly: true},
+		{SecretKey: "k", LegacySecretKey: "12345678"},
+	} {
+		s, err := NewServers("127.0.0.1", 0, conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.requireMAC {
+			t.Fatalf("MAC required during migration %+v", conf)
+		}
+		_ = s.Conn.Close()
+	}
+
+	s, legacy := testPair(t, nil, func(conf *ClientConf) {
+		conf.LegacyProtocol = true
+	})
+	if !s.requireMAC {
+		t.Fatal("MAC not required by default")
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for legacy.State() != StateRejected {
+		if time.Now().After(deadline) {
+			t.Fatalf("client without MAC state %s", legacy.State())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, allowed := testPair(t, func(s *Servers) {
+		s.SetRequirePacketMAC(false)
+	}, func(conf *ClientConf) {
+		conf.LegacyProtocol = true
+	})
+	waitConnected(t, allowed)
+}
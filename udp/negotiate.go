@@ -0,0 +1,220 @@
+package udp
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
+
+/*
+
+协议版本协商
+
+1. c端按自己的协议版本封包，连接包与心跳包的 data 为 hello: 连接code + c端支持的特性 + 时间戳
+2. s端检查版本，不支持的版本回应 Reply{StateCode: StateCodeVersion, Data: s端版本}，c端支持时降级重连
+3. s端取双方都支持的特性，存入该连接的会话，连接回应的 Data 为 签名 + 协商的特性
+4. 之后双方按协商的版本与特性收发，s端可以同时服务新旧版本的c端
+5. 旧版本(0)的c端连接包 data 只有连接code，s端按旧版包头与 JSON 信封回应
+
+约定: 所有版本的包头前两个字节都是 指令+版本, 新版本只能在 data 中增加内容
+
+*/
+
+const (
+	ProtocolVersion    uint8 = 1 // 当前协议版本
+	MinProtocolVersion uint8 = 0 // 支持的最低协议版本, 0 为没有版本字段的旧版包头
+)
+
+// Feature 特性, 按位表示
+type Feature uint32
+
+const (
+	FeatureBinaryEnvelope Feature = 1 << iota // 二进制信封, 见 envelope.go
+	FeatureReplayGuard                        // 序号与时间戳防重放, 见 replay.go
+	FeaturePutResponse                        // Put 确认包携带处理方法的应答, 见 PutResponse
+	FeatureKeyExchange                        // X25519 密钥交换派生会话密钥, 见 kex.go
+	FeaturePacketMAC                          // 包认证码代替包头的签名, 见 mac.go
+)
+
+// SupportedFeatures 当前版本支持的特性
+const SupportedFeatures = FeatureBinaryEnvelope | FeatureReplayGuard | FeaturePutResponse | FeatureKeyExchange | FeaturePacketMAC
+
+func (f Feature) Has(feature Feature) bool {
+	return f&feature == feature
+}
+
+func supportVersion(version uint8) bool {
+	return version >= MinProtocolVersion && version <= ProtocolVersion
+}
+
+// hello 新版本连接包与心跳包的 data
+type hello struct {
+	ConnectCode string
+	Features    Feature
+	Stamp       int64  // c端时间ms, 单调递增, 协商防重放时s端拒绝过期与重复的连接包, 见 replay.go
+	PublicKey   []byte // 密钥交换的c端临时公钥, 见 kex.go
+	MACKeyId    []byte // 心跳携带的认证密钥id, 见 mac.go
+}
+
+func (h *hello) MarshalBinary() ([]byte, error) {
+	w := newEnvelopeWriter(len(h.ConnectCode) + len(h.PublicKey) + len(h.MACKeyId))
+	w.string(h.ConnectCode)
+	w.varint(int64(h.Features))
+	w.varint(h.Stamp)
+	if len(h.PublicKey) > 0 || len(h.MACKeyId) > 0 {
+		w.bytes(h.PublicKey)
+	}
+	if len(h.MACKeyId) > 0 {
+		w.bytes(h.MACKeyId)
+	}
+	return w.buf, nil
+}
+
+func (h *hello) UnmarshalBinary(data []byte) error {
+	r := newEnvelopeReader(data)
+	h.ConnectCode = r.string()
+	h.Features = Feature(r.varint())
+	h.Stamp = r.varint()
+	if r.more() {
+		h.PublicKey = r.bytes()
+	}
+	if r.more() {
+		h.MACKeyId = r.bytes()
+	}
+	return r.err
+}
+
+// parseHello 解析连接包与心跳包, 旧版本的 data 只有连接code
+func parseHello(packet *Packet) (*hello, error) {
+	if packet.Version == 0 {
+		return &hello{ConnectCode: string(packet.Data)}, nil
+	}
+	h := &hello{}
+	if err := h.UnmarshalBinary(packet.Data); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// connectReplyData 连接回应的 Data, 新版本在签名后追加协商的特性, 认证密钥与密钥交换的数据
+func connectReplyData(sign string, version uint8, features Feature, macKey, kx []byte) []byte {
+	if version == 0 {
+		return []byte(sign)
+	}
+	data := binary.AppendUvarint([]byte(sign), uint64(features))
+	return append(appendMACKey(data, features, macKey), kx...)
+}
+
+// parseConnectReply 解析连接回应的 Data, 返回签名, 协商的特性与之后的数据(认证密钥与密钥交换的数据)
+func parseConnectReply(data []byte, version uint8) (string, Feature, []byte) {
+	if version == 0 || len(data) < 7 {
+		return string(data), 0, nil
+	}
+	features, n := binary.Uvarint(data[7:])
+	if n <= 0 {
+		return string(data[:7]), 0, nil
+	}
+	return string(data[:7]), Feature(features), data[7+n:]
+}
+
+// session s端记录的c端连接协商结果
+type session struct {
+	Version  uint8
+	Features Feature
+	name     string       // 认证通过的c端名称, 补齐后的包头名称
+	keys     *sessionKeys // 密钥交换的会话密钥, 未协商时为空
+	mac      *packetMAC   // 包认证密钥, 未协商时为空
+}
+
+// SetProtocolVersion 设置c端使用的协议版本, 与旧版本的Servers端通讯时设置为0
+// 版本变化时按新版本重新发送连接包, 旧版本的连接回应会被忽略
+func (c *Client) SetProtocolVersion(version uint8) error {
+	if !supportVersion(version) {
+		return ErrProtocolVersion(version)
+	}
+	atomic.StoreUint32(&c.maxVersion, uint32(version))
+	if atomic.SwapUint32(&c.version, uint32(version)) == uint32(version) {
+		return nil
+	}
+	atomic.StoreUint32(&c.features, 0)
+	c.setState(StateConnecting, StateConnected)
+	c.ConnectServers()
+	return nil
+}
+
+// ProtocolVersion c端当前使用的协议版本
+func (c *Client) ProtocolVersion() uint8 {
+	return uint8(atomic.LoadUint32(&c.version))
+}
+
+// Features 与Servers端协商的特性, 连接成功前为0
+func (c *Client) Features() Feature {
+	return Feature(atomic.LoadUint32(&c.features))
+}
+
+// helloData 连接包与心跳包的 data
+func (c *Client) helloData(cmd CommandCode) []byte {
+	if c.ProtocolVersion() == 0 {
+		return []byte(c.connectCode)
+	}
+	h := &hello{ConnectCode: c.connectCode, Features: SupportedFeatures, Stamp: c.nextStamp()}
+	if c.jsonEnvelope {
+		h.Features &^= FeatureBinaryEnvelope
+	}
+	if c.keyExchangeEnabled() {
+		h.PublicKey = c.kxPublicKey(cmd)
+	} else {
+		h.Features &^= FeatureKeyExchange
+	}
+	if cmd == CommandHeartbeat {
+		h.MACKeyId = c.macKeyId()
+	}
+	b, _ := h.MarshalBinary()
+	return b
+}
+
+// versionRejected s端不支持当前版本, s端的版本c端也支持时降级, 返回是否降级
+// 版本拒绝的回应没有签名, 为防止伪造的回应降级协议: 首次连接成功前可以降级,
+// 之后只能降到最近一次连接成功的版本(该s端已证明只支持这个版本);
+// 固定了 ServerKeyPin 或建立过会话密钥时不降级, 旧版本不支持密钥交换, 见 kex.go
+func (c *Client) versionRejected(reply *Reply) bool {
+	if len(reply.Data) < 1 {
+		return false
+	}
+	serversVersion := reply.Data[0]
+	current := c.ProtocolVersion()
+	ErrorF("Servers端不支持协议版本:%d Servers端版本:%d", current, serversVersion)
+	if serversVersion >= current || !supportVersion(serversVersion) {
+		return false
+	}
+	if c.kxSecured() {
+		ErrorF("已固定s端公钥或建立过会话密钥, 不降级到版本:%d", serversVersion)
+		return false
+	}
+	if connected := atomic.LoadInt32(&c.connectedVersion); connected >= 0 && int32(serversVersion) != connected {
+		ErrorF("已按协议版本:%d 连接成功过, 不降级到版本:%d", connected, serversVersion)
+		return false
+	}
+	InfoF("协议版本降级 %d -> %d", current, serversVersion)
+	atomic.StoreUint32(&c.version, uint32(serversVersion))
+	return true
+}
+
+// resetVersion 重连时恢复设置的协议版本, s端升级后可以使用新版本, 不支持时再由 versionRejected 降级
+func (c *Client) resetVersion() {
+	max := atomic.LoadUint32(&c.maxVersion)
+	if atomic.SwapUint32(&c.version, max) != max {
+		atomic.StoreUint32(&c.features, 0)
+	}
+}
+
+// negotiate s端协商c端连接的版本与特性, 不支持的版本返回 false
+func negotiate(packet *Packet, h *hello) (session, bool) {
+	if !supportVersion(packet.Version) {
+		return session{}, false
+	}
+	sess := session{Version: packet.Version}
+	if packet.Version > 0 {
+		sess.Features = h.Features & SupportedFeatures
+	}
+	return sess, true
+}
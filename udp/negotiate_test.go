@@ -0,0 +1,99 @@
+package udp
+
+import (
+	"crypto/ed25519"
+	"sync/atomic"
+	"testing"
+)
+
+func versionClient() *Client {
+	return &Client{
+		version:          uint32(ProtocolVersion),
+		maxVersion:       uint32(ProtocolVersion),
+		connectedVersion: -1,
+	}
+}
+
+func versionReply(version uint8) *Reply {
+	return &Reply{Type: int(CommandConnect), StateCode: StateCodeVersion, Data: []byte{version}}
+}
+
+func TestVersionRejectedBeforeConnect(t *testing.T) {
+	c := versionClient()
+	if c.versionRejected(&Reply{Type: int(CommandConnect), StateCode: StateCodeVersion}) {
+		t.Fatal("downgraded without a servers version")
+	}
+	if c.versionRejected(versionReply(ProtocolVersion + 1)) {
+		t.Fatal("downgraded to an unsupported version")
+	}
+	if !c.versionRejected(versionReply(0)) || c.ProtocolVersion() != 0 {
+		t.Fatalf("not downgraded before the first connect, version %d", c.ProtocolVersion())
+	}
+	if c.versionRejected(versionReply(0)) {
+		t.Fatal("downgraded to the current version")
+	}
+}
+
+// 连接成功后伪造的版本拒绝不能降级
+func TestVersionRejectedAfterConnect(t *testing.T) {
+	c := versionClient()
+	atomic.StoreInt32(&c.connectedVersion, int32(ProtocolVersion))
+	if c.versionRejected(versionReply(0)) || c.ProtocolVersion() != ProtocolVersion {
+		t.Fatalf("downgraded after connecting with version %d", ProtocolVersion)
+	}
+}
+
+// 固定了s端公钥或建立过会话密钥时不降级
+func TestVersionRejectedSecured(t *testing.T) {
+	pinned := versionClient()
+	pinned.serverKeyPin = make(ed25519.PublicKey, ed25519.PublicKeySize)
+	if pinned.versionRejected(versionReply(0)) || pinned.ProtocolVersion() != ProtocolVersion {
+		t.Fatal("pinned client downgraded")
+	}
+	keyed := versionClient()
+	keyed.keys = &sessionKeys{}
+	if keyed.versionRejected(versionReply(0)) || keyed.ProtocolVersion() != ProtocolVersion {
+		t.Fatal("client with session keys downgraded")
+	}
+}
+
+// 重连先按设置的版本连接, 只能降回连接成功过的版本
+func TestVersionResetOnReconnect(t *testing.T) {
+	c := versionClient()
+	c.versionRejected(versionReply(0))
+	atomic.StoreUint32(&c.features, uint32(FeatureBinaryEnvelope))
+	atomic.StoreInt32(&c.connectedVersion, 0)
+
+	c.resetVersion()
+	if c.ProtocolVersion() != ProtocolVersion || c.Features() != 0 {
+		t.Fatalf("version %d features %d after reset", c.ProtocolVersion(), c.Features())
+	}
+	if !c.versionRejected(versionReply(0)) || c.ProtocolVersion() != 0 {
+		t.Fatal("could not return to the version that connected before")
+	}
+
+	legacy := versionClient()
+	legacy.version, legacy.maxVersion = 0, 0
+	legacy.resetVersion()
+	if legacy.ProtocolVersion() != 0 {
+		t.Fatalf("LegacyProtocol client reset to version %d", legacy.ProtocolVersion())
+	}
+}
+
+func TestHelloAndConnectReply(t *testing.T) {
+	b, _ := (&hello{ConnectCode: "code", Features: SupportedFeatures, Stamp: 42}).MarshalBinary()
+	h, err := parseHello(&Packet{Version: ProtocolVersion, Data: b})
+	if err != nil || h.ConnectCode != "code" || h.Features != SupportedFeatures || h.Stamp != 42 {
+		t.Fatalf("hello %+v %v", h, err)
+	}
+	if h, err = parseHello(&Packet{Version: 0, Data: []byte("code")}); err != nil || h.ConnectCode != "code" || h.Features != 0 {
+		t.Fatalf("legacy hello %+v %v", h, err)
+	}
+	sign, features, _ := parseConnectReply(connectReplyData("abcdefg", ProtocolVersion, FeatureBinaryEnvelope, nil, nil), ProtocolVersion)
+	if sign != "abcdefg" || features != FeatureBinaryEnvelope {
+		t.Fatalf("connect reply %q %d", sign, features)
+	}
+	if sign, features, _ = parseConnectReply(connectReplyData("abcdefg", 0, FeatureBinaryEnvelope, nil, nil), 0); sign != "abcdefg" || features != 0 {
+		t.Fatalf("legacy connect reply %q %d", sign, features)
+	}
+}
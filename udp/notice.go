@@ -1,7 +1,5 @@
 package udp
 
-import "sync"
-
 type NoticeData struct {
 	Label    string    // 标签，用于区分当前数据处理的方法
 	Id       int64     // 唯一id
@@ -11,6 +9,12 @@ type NoticeData struct {
 	Err      error
 }
 
-var NoticeDataMap sync.Map
+// done 通知等待方已收到应答, 等待方已经退出时不阻塞
+func (n *NoticeData) done() {
+	select {
+	case n.ctxChan <- true:
+	default:
+	}
+}
 
 type ClientNoticeFunc map[string]func(c *Client, data []byte)
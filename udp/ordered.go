@@ -0,0 +1,239 @@
+package udp
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+
+有序Put: 通过 PutHandleFuncOrdered 注册的标签, 同一个c端(name@ip)的包按发送序号依次执行
+
+1. c端每个标签独立计数 PutData.Seq 从1开始, PutData.Epoch 为c端启动的时间, 积压重发时序号不变
+2. s端按 c端+标签 缓存乱序到达的包, 只执行序号连续的包, 执行完成后才确认
+3. 缺失的序号超过 gapTimeout 未到达时跳过, 缓存的包超过 maxPending 时立即跳过, 跳过后迟到的包直接执行
+4. Epoch 变大表示c端重启, 未执行的旧包按序号执行后从新的 Epoch 的序号1开始; 更早 Epoch 的包(如加载的持久化积压数据)直接执行
+5. s端重启或记录被清理后不知道c端当前的序号, 从序号1开始等待, 最多延迟一个 gapTimeout
+
+*/
+
+type orderedStream struct {
+	epoch    int64
+	next     uint64            // 下一个要执行的序号
+	pending  map[uint64]func() // 乱序到达等待执行的包
+	ready    []func()          // 可以执行的包, 按顺序执行
+	draining bool              // 是否有goroutine正在执行
+	gapTimer *time.Timer
+	last     time.Time
+}
+
+// putOrder s端有序Put
+type putOrder struct {
+	lock       sync.Mutex
+	labels     map[string]bool           // 有序的标签, 注册时写入
+	streams    map[string]*orderedStream // key = name@ip@label
+	gapTimeout time.Duration
+	maxPending int
+	closer     *closer
+	skipped    uint64 // 跳过的序号数量
+}
+
+func newPutOrder(c *closer) *putOrder {
+	return &putOrder{
+		labels:     make(map[string]bool),
+		streams:    make(map[string]*orderedStream),
+		gapTimeout: PutOrderGapTimeout * time.Millisecond,
+		maxPending: PutOrderMaxPending,
+		closer:     c,
+	}
+}
+
+func (p *putOrder) ordered(label string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.labels[label]
+}
+
+func newOrderedStream(epoch int64) *orderedStream {
+	return &orderedStream{
+		epoch:   epoch,
+		next:    1,
+		pending: make(map[uint64]func()),
+	}
+}
+
+// submit 提交一个有序的包, run 执行处理方法并确认
+func (p *putOrder) submit(key string, putData *PutData, run func()) {
+	p.lock.Lock()
+	st, ok := p.streams[key]
+	if !ok {
+		st = newOrderedStream(putData.Epoch)
+		p.streams[key] = st
+	}
+	st.last = time.Now()
+	switch {
+	case putData.Epoch < st.epoch:
+		ErrorF("有序Put收到旧的Epoch, 直接执行 key:%s seq:%d", key, putData.Seq)
+		st.ready = append(st.ready, run)
+	case putData.Epoch > st.epoch:
+		// c端重启, 旧的包按序号执行后从新的 Epoch 开始
+		st.ready = append(st.ready, st.sortedPending()...)
+		st.stopGap()
+		st.epoch, st.next, st.pending = putData.Epoch, 1, make(map[uint64]func())
+		st.pending[putData.Seq] = run
+	case putData.Seq < st.next:
+		ErrorF("有序Put收到已跳过的序号, 直接执行 key:%s seq:%d next:%d", key, putData.Seq, st.next)
+		st.ready = append(st.ready, run)
+	default:
+		st.pending[putData.Seq] = run
+		if len(st.pending) > p.maxPending {
+			p.skip(key, st)
+		}
+	}
+	if st.draining {
+		p.lock.Unlock()
+		return
+	}
+	st.draining = true
+	p.lock.Unlock()
+	p.drain(key, st)
+}
+
+// drain 依次执行可以执行的包, 同一个 stream 同时只有一个goroutine执行
+func (p *putOrder) drain(key string, st *orderedStream) {
+	for {
+		p.lock.Lock()
+		for {
+			run, ok := st.pending[st.next]
+			if !ok {
+				break
+			}
+			delete(st.pending, st.next)
+			st.ready = append(st.ready, run)
+			st.next++
+		}
+		if len(st.ready) == 0 {
+			st.draining = false
+			p.armGap(key, st)
+			p.lock.Unlock()
+			return
+		}
+		run := st.ready[0]
+		st.ready = st.ready[1:]
+		p.lock.Unlock()
+		run()
+	}
+}
+
+// armGap 存在缺失的序号时开始计时, 调用方持有锁
+func (p *putOrder) armGap(key string, st *orderedStream) {
+	if len(st.pending) == 0 {
+		st.stopGap()
+		return
+	}
+	if st.gapTimer != nil {
+		return
+	}
+	st.gapTimer = time.AfterFunc(p.gapTimeout, func() {
+		p.lock.Lock()
+		st.gapTimer = nil
+		if len(st.pending) == 0 || st.draining {
+			p.lock.Unlock()
+			return
+		}
+		p.skip(key, st)
+		if !p.closer.start() {
+			p.lock.Unlock()
+			return
+		}
+		st.draining = true
+		p.lock.Unlock()
+		defer p.closer.done()
+		p.drain(key, st)
+	})
+}
+
+// skip 跳过缺失的序号到缓存中最小的序号, 调用方持有锁
+func (p *putOrder) skip(key string, st *orderedStream) {
+	min := uint64(0)
+	for seq := range st.pending {
+		if min == 0 || seq < min {
+			min = seq
+		}
+	}
+	if min <= st.next {
+		return
+	}
+	ErrorF("有序Put跳过缺失的序号 key:%s %d ~ %d", key, st.next, min-1)
+	atomic.AddUint64(&p.skipped, min-st.next)
+	st.next = min
+}
+
+func (st *orderedStream) stopGap() {
+	if st.gapTimer != nil {
+		st.gapTimer.Stop()
+		st.gapTimer = nil
+	}
+}
+
+func (st *orderedStream) sortedPending() []func() {
+	seqs := make([]uint64, 0, len(st.pending))
+	for seq := range st.pending {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	runs := make([]func(), 0, len(seqs))
+	for _, seq := range seqs {
+		runs = append(runs, st.pending[seq])
+	}
+	return runs
+}
+
+// sweep 清理空闲的 stream
+func (p *putOrder) sweep() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for key, st := range p.streams {
+		if st.draining || len(st.pending) > 0 || len(st.ready) > 0 {
+			continue
+		}
+		if time.Since(st.last) > PutOrderIdle*time.Millisecond {
+			delete(p.streams, key)
+		}
+	}
+}
+
+// PutHandleFuncOrdered 注册有序的PUT方法, 同一个c端的包按发送顺序依次执行
+func (s *Servers) PutHandleFuncOrdered(label string, f func(s *Servers, c *ClientInfo, body []byte)) {
+	s.PutHandleFunc(label, f)
+	s.putOrder.lock.Lock()
+	defer s.putOrder.lock.Unlock()
+	s.putOrder.labels[label] = true
+}
+
+// PutReplyHandleFuncOrdered 注册有序的带应答的PUT方法
+func (s *Servers) PutReplyHandleFuncOrdered(label string, f func(s *Servers, c *ClientInfo, body []byte) (int, []byte)) {
+	s.PutReplyHandleFunc(label, f)
+	s.putOrder.lock.Lock()
+	defer s.putOrder.lock.Unlock()
+	s.putOrder.labels[label] = true
+}
+
+// SetPutOrderLimit 设置有序Put缺失序号的等待时间与每个c端每个标签最多缓存的包数量; 小于等于0的值不修改
+func (s *Servers) SetPutOrderLimit(gapTimeout time.Duration, maxPending int) {
+	s.putOrder.lock.Lock()
+	defer s.putOrder.lock.Unlock()
+	if gapTimeout > 0 {
+		s.putOrder.gapTimeout = gapTimeout
+	}
+	if maxPending > 0 {
+		s.putOrder.maxPending = maxPending
+	}
+}
+
+// PutOrderSkipped 有序Put因超时或缓存已满跳过的序号数量
+func (s *Servers) PutOrderSkipped() uint64 {
+	return atomic.LoadUint64(&s.putOrder.skipped)
+}
@@ -0,0 +1,128 @@
+package udp
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// orderRecorder 记录处理方法的执行顺序
+type orderRecorder struct {
+	lock sync.Mutex
+	seqs []uint64
+}
+
+func (r *orderRecorder) run(seq uint64) func() {
+	return func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.seqs = append(r.seqs, seq)
+	}
+}
+
+func (r *orderRecorder) get() []uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]uint64(nil), r.seqs...)
+}
+
+func (r *orderRecorder) wait(t *testing.T, n int) []uint64 {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if got := r.get(); len(got) >= n {
+			return got
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("got %v, want %d runs", r.get(), n)
+	return nil
+}
+
+func submitSeq(p *putOrder, r *orderRecorder, epoch int64, seqs ...uint64) {
+	for _, seq := range seqs {
+		p.submit("c@ip@label", &PutData{Seq: seq, Epoch: epoch}, r.run(seq))
+	}
+}
+
+func TestPutOrderOutOfOrder(t *testing.T) {
+	p := newPutOrder(newCloser())
+	r := &orderRecorder{}
+	submitSeq(p, r, 1, 3, 2, 5)
+	if got := r.get(); len(got) != 0 {
+		t.Fatalf("ran %v before seq 1 arrived", got)
+	}
+	submitSeq(p, r, 1, 1)
+	if got := r.get(); !reflect.DeepEqual(got, []uint64{1, 2, 3}) {
+		t.Fatalf("got %v", got)
+	}
+	submitSeq(p, r, 1, 4)
+	if got := r.get(); !reflect.DeepEqual(got, []uint64{1, 2, 3, 4, 5}) {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestPutOrderGapTimeout(t *testing.T) {
+	p := newPutOrder(newCloser())
+	p.gapTimeout = 20 * time.Millisecond
+	r := &orderRecorder{}
+	submitSeq(p, r, 1, 1, 3, 4)
+	if got := r.wait(t, 3); !reflect.DeepEqual(got, []uint64{1, 3, 4}) {
+		t.Fatalf("got %v", got)
+	}
+	if p.skipped != 1 {
+		t.Fatalf("skipped %d", p.skipped)
+	}
+	// 跳过后迟到的包直接执行
+	submitSeq(p, r, 1, 2)
+	if got := r.get(); !reflect.DeepEqual(got, []uint64{1, 3, 4, 2}) {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestPutOrderMaxPending(t *testing.T) {
+	p := newPutOrder(newCloser())
+	p.maxPending = 2
+	r := &orderRecorder{}
+	submitSeq(p, r, 1, 2, 3, 4)
+	if got := r.get(); !reflect.DeepEqual(got, []uint64{2, 3, 4}) {
+		t.Fatalf("got %v", got)
+	}
+}
+
+// c端重启: 旧的包按序号执行后从新的 Epoch 的序号1开始, 更早 Epoch 的包直接执行
+func TestPutOrderEpoch(t *testing.T) {
+	p := newPutOrder(newCloser())
+	r := &orderRecorder{}
+	submitSeq(p, r, 1, 1, 4, 3)
+	submitSeq(p, r, 2, 1)
+	if got := r.get(); !reflect.DeepEqual(got, []uint64{1, 3, 4, 1}) {
+		t.Fatalf("got %v", got)
+	}
+	submitSeq(p, r, 1, 9)
+	if got := r.get(); !reflect.DeepEqual(got, []uint64{1, 3, 4, 1, 9}) {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestPutOrderConcurrent(t *testing.T) {
+	p := newPutOrder(newCloser())
+	r := &orderRecorder{}
+	const total = 200
+	var wg sync.WaitGroup
+	for seq := uint64(total); seq >= 1; seq-- {
+		wg.Add(1)
+		go func(seq uint64) {
+			defer wg.Done()
+			submitSeq(p, r, 1, seq)
+		}(seq)
+	}
+	wg.Wait()
+	got := r.wait(t, total)
+	for i, seq := range got {
+		if seq != uint64(i+1) {
+			t.Fatalf("position %d ran seq %d", i, seq)
+		}
+	}
+}
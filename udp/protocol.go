@@ -14,16 +14,17 @@ import (
 
 Packet 包设计
 ______________________________________________________________________
-|            |              |             |                           |
-| 指令(1字节) |  name(7字节)  | 签名(7字节)  |  data(建议小于533字节)...  |
-|____________|______________|_____________|___________________________|
+|            |             |              |             |              |
+| 指令(1字节) | 版本(1字节)  |  name(7字节)  | 签名(7字节)  |    data...   |
+|____________|_____________|______________|_____________|______________|
 
-指令: 区分是什么数据
+指令: 区分是什么数据，最高位为1表示包头带版本字段
+版本: 协议版本，协商见 negotiate.go；旧版本(0)的包头没有版本字段，指令最高位为0
 name: 主要场景s端指定广播，name对应多个ip(节点)
 签名: 用于确保数据安全，签名会更具心跳进行动态签发
-data: 传输的数据，不支持分包，建议小于533字节，可以在业务中设计分次传输
+data: 传输的数据，使用二进制信封序列化，见 envelope.go；大于 FragmentDataSize 的数据会被分片传输，见 fragment.go
 
-包安全: des加密保障数据包不是明文传输
+包安全: 使用可选的加密套件(默认 AES-256-GCM)，包头作为附加认证数据，见 cipher.go
 包压缩: 使用Zlib
 
 场景:
@@ -36,19 +37,31 @@ data: 传输的数据，不支持分包，建议小于533字节，可以在业
 
 type Packet struct {
 	Command CommandCode
+	Version uint8 // 协议版本, 0 为没有版本字段的旧版包头
 	Name    string
 	Sign    string
 	Data    []byte
+	authed  bool // 已校验包认证码, 见 mac.go
 }
 
-// PacketEncoder 封包
-func PacketEncoder(cmd CommandCode, name, sign, secret string, data []byte) ([]byte, error) {
+// PacketEncoder 封包, 使用没有版本字段的旧版包头
+func PacketEncoder(cmd CommandCode, name, sign string, cipher Cipher, data []byte) ([]byte, error) {
+	return PacketEncoderVersion(cmd, 0, name, sign, cipher, data)
+}
+
+// PacketEncoderVersion 按指定的协议版本封包, 版本为0时使用旧版包头
+func PacketEncoderVersion(cmd CommandCode, version uint8, name, sign string, cipher Cipher, data []byte) ([]byte, error) {
 	var (
 		err    error
 		stream []byte
 		buf    = new(bytes.Buffer)
 	)
-	_ = binary.Write(buf, binary.LittleEndian, cmd)
+	if version > 0 {
+		_ = binary.Write(buf, binary.LittleEndian, cmd|commandVersioned)
+		_ = binary.Write(buf, binary.LittleEndian, version)
+	} else {
+		_ = binary.Write(buf, binary.LittleEndian, cmd)
+	}
 	ln := len(name)
 	if ln > 0 && ln <= 7 {
 		// 补齐位
@@ -72,12 +85,15 @@ func PacketEncoder(cmd CommandCode, name, sign, secret string, data []byte) ([]b
 	dCompress := ZlibCompress(data)
 	//Info("压缩后数据长度: ", len(d))
 
-	// 加密数据
-	dEncrypt := DesECBEncrypt(dCompress, []byte(secret))
+	// 加密数据, 包头作为附加认证数据
+	dEncrypt, err := cipher.Encrypt(buf.Bytes(), dCompress)
+	if err != nil {
+		return stream, err
+	}
 	//Info("加密数据 : ", len(d))
 
-	if len(dEncrypt) > 540 {
-		Error(ErrDataLengthAbove)
+	if buf.Len()+len(dEncrypt) > ReadBufferSize {
+		return stream, ErrDataLengthAbove
 	}
 	err = binary.Write(buf, binary.LittleEndian, dEncrypt)
 	if err != nil {
@@ -88,18 +104,33 @@ func PacketEncoder(cmd CommandCode, name, sign, secret string, data []byte) ([]b
 }
 
 // PacketDecrypt 解包
-func PacketDecrypt(secret string, data []byte, n int) (*Packet, error) {
-	var err error
-	if n < 15 {
+func PacketDecrypt(cipher Cipher, data []byte, n int) (*Packet, error) {
+	var (
+		err     error
+		version uint8
+		head    = 15
+	)
+	if n < head {
 		Error("空包")
 		return nil, ErrNonePacket
 	}
-	command := CommandCode(data[0:1][0])
-	name := string(data[1:8])
-	sign := string(data[8:15])
-	b := data[15:n]
+	command := CommandCode(data[0])
+	if command&commandVersioned != 0 {
+		head++
+		if n < head {
+			return nil, ErrNonePacket
+		}
+		command &^= commandVersioned
+		version = data[1]
+	}
+	name := string(data[head-14 : head-7])
+	sign := string(data[head-7 : head])
+	b := data[head:n]
 	// 解密数据
-	bDecrypt := DesECBDecrypt(b, []byte(secret))
+	bDecrypt, err := cipher.Decrypt(data[0:head], b)
+	if err != nil {
+		return nil, err
+	}
 	// 解压数据
 	//b, err := GzipDecompress(data[15:n])
 	bDecompress, err := ZlibDecompress(bDecrypt)
@@ -109,6 +140,7 @@ func PacketDecrypt(secret string, data []byte, n int) (*Packet, error) {
 	}
 	return &Packet{
 		Command: command,
+		Version: version,
 		Name:    name,
 		Sign:    sign,
 		Data:    bDecompress,
@@ -1,15 +1,31 @@
 package udp
 
-import "net"
+import (
+	"context"
+	"net"
+	"sync"
+)
 
 type PutData struct {
 	Label string // 标签，用于区分当前数据处理的方法
 	Id    int64  // 唯一id
 	Body  []byte // 传过来的数据
+	Seq   uint64 // 同一个标签的发送序号, 从1开始, 用于有序处理
+	Epoch int64  // c端启动的时间 UnixMilli, c端重启后序号重新开始
+	Time  int64  // c端Put的时间 UnixMilli, 用于积压数据过期
 }
 
 type ServersPutFunc map[string]func(s *Servers, c *ClientInfo, data []byte)
 
+// ServersPutReplyFunc 带应答的PUT方法, 返回的 code 与 data 随确认包返回c端
+type ServersPutReplyFunc map[string]func(s *Servers, c *ClientInfo, data []byte) (int, []byte)
+
+// PutResponse 协商了 FeaturePutResponse 时 Put 确认包 Reply.Data 的内容
+type PutResponse struct {
+	Code int    // 处理方法返回的 code, 由业务定义
+	Data []byte // 处理方法返回的数据
+}
+
 type ClientInfo struct {
 	Name        string
 	Addr        *net.UDPAddr
@@ -17,4 +33,61 @@ type ClientInfo struct {
 	PacketSize  int
 }
 
-// TODO 给ClientInfo 下发消息，场景是 S端收到C端发来的PUT, S端可以直接进行应答
+// PutFuture PutAsync 的投递结果
+type PutFuture struct {
+	Id    int64 // PutData.Id
+	Label string
+	once  sync.Once
+	done  chan struct{}
+	err   error
+	resp  PutResponse
+}
+
+func newPutFuture(label string) *PutFuture {
+	return &PutFuture{Label: label, done: make(chan struct{})}
+}
+
+// resolve 设置结果, 只有第一次生效
+func (f *PutFuture) resolve(err error, resp PutResponse) {
+	f.once.Do(func() {
+		f.err = err
+		f.resp = resp
+		close(f.done)
+	})
+}
+
+// Done s端确认或投递失败时关闭
+func (f *PutFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err Done 关闭后的结果, 为空表示s端已确认; 未关闭时为空
+func (f *PutFuture) Err() error {
+	select {
+	case <-f.done:
+		return f.err
+	default:
+		return nil
+	}
+}
+
+// Response s端处理方法返回的 code 与数据, Done 关闭且 Err 为空后有效
+// s端未注册带应答的处理方法或未协商 FeaturePutResponse 时为零值
+func (f *PutFuture) Response() (int, []byte) {
+	select {
+	case <-f.done:
+		return f.resp.Code, f.resp.Data
+	default:
+		return 0, nil
+	}
+}
+
+// Wait 等待投递结果, ctx 取消或超时时返回 ctx.Err() 包装的错误, 数据仍在积压中继续投递
+func (f *PutFuture) Wait(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ErrPutCanceled(f.Label, ctx.Err())
+	}
+}
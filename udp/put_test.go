@@ -0,0 +1,260 @@
+package udp
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// testPair 启动s端与连接到该s端的c端, setup 在s端运行前注册处理方法
+func testPair(t *testing.T, setup func(*Servers), mod func(*ClientConf)) (*Servers, *Client) {
+	t.Helper()
+	s, err := NewServers("127.0.0.1", 0, ServersConf{ConnectCode: "c", SecretKey: "pair-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setup != nil {
+		setup(s)
+	}
+	go s.Run()
+	conf := SetClientConf("c1", "c", "pair-test")
+	conf.Backlog = NewMemoryBacklog()
+	if mod != nil {
+		mod(&conf)
+	}
+	c, err := NewClient(s.Conn.LocalAddr().String(), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Serve()
+	t.Cleanup(func() {
+		c.Close()
+		_ = s.Shutdown(context.Background())
+	})
+	return s, c
+}
+
+func waitConnected(t *testing.T, c *Client) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for c.State() != StateConnected {
+		if time.Now().After(deadline) {
+			t.Fatalf("state %s", c.State())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPutSyncAck(t *testing.T) {
+	_, c := testPair(t, func(s *Servers) {
+		s.PutHandleFunc("r", func(s *Servers, ci *ClientInfo, body []byte) {})
+	}, nil)
+	waitConnected(t, c)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := c.PutSync(ctx, "r", []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	future := c.PutAsync("r", []byte("again"))
+	if err := future.Wait(ctx); err != nil || future.Err() != nil {
+		t.Fatalf("async %v %v", err, future.Err())
+	}
+	if c.backlog.Len() != 0 {
+		t.Fatalf("%d entries left after ack", c.backlog.Len())
+	}
+}
+
+func TestPutSyncResponse(t *testing.T) {
+	_, c := testPair(t, func(s *Servers) {
+		s.PutReplyHandleFunc("r", func(s *Servers, ci *ClientInfo, body []byte) (int, []byte) {
+			return 7, append([]byte("echo:"), body...)
+		})
+	}, nil)
+	waitConnected(t, c)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	code, data, err := c.PutSyncResponse(ctx, "r", []byte("hi"))
+	if err != nil || code != 7 || string(data) != "echo:hi" {
+		t.Fatalf("got %d %q %v", code, data, err)
+	}
+	// PutHandleFunc 与未注册的标签应答为零值
+	if code, data, err = c.PutSyncResponse(ctx, "none", []byte("hi")); err != nil || code != 0 || data != nil {
+		t.Fatalf("got %d %q %v", code, data, err)
+	}
+}
+
+// 未连接时数据留在积压中, ctx 超时返回 ErrPutCanceled, 数据继续投递
+func TestPutSyncCancel(t *testing.T) {
+	c, err := NewClient("127.0.0.1:9", ClientConf{Name: "c1", ConnectCode: "c", SecretKey: "pair-test", Backlog: NewMemoryBacklog()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err = c.PutSync(ctx, "r", []byte("hi")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v", err)
+	}
+	if c.backlog.Len() != 1 {
+		t.Fatalf("len %d, want 1", c.backlog.Len())
+	}
+	if err = c.PutSync(ctx, "r", []byte("done")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("canceled ctx: %v", err)
+	}
+}
+
+// BacklogBlock 阻塞的 PutSync 在 ctx 超时后返回, 数据不写入积压
+func TestPutSyncBlockCancel(t *testing.T) {
+	c, err := NewClient("127.0.0.1:9", ClientConf{Name: "c1", ConnectCode: "c", SecretKey: "pair-test",
+		Backlog: NewMemoryBacklog(), BacklogLimit: BacklogLimit{MaxEntries: 1, TTL: time.Hour, Overflow: BacklogBlock}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.Put("r", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- c.PutSync(ctx, "r", []byte("second"))
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("PutSync blocked after ctx timeout")
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v", err)
+	}
+	if c.backlog.Len() != 1 {
+		t.Fatalf("len %d, want 1", c.backlog.Len())
+	}
+}
+
+// BacklogDropNewest 丢弃的数据 Put 返回 ErrBacklogDropped, BacklogDropOldest 丢弃的数据通知 PutAsync
+func TestPutDropped(t *testing.T) {
+	c, err := NewClient("127.0.0.1:9", ClientConf{Name: "c1", ConnectCode: "c", SecretKey: "pair-test",
+		Backlog: NewMemoryBacklog(), BacklogLimit: BacklogLimit{MaxEntries: 1, Overflow: BacklogDropNewest}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.Put("r", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Put("r", []byte("second")); err != ErrBacklogDropped {
+		t.Fatalf("Put got %v", err)
+	}
+	if err = c.PutAsync("r", []byte("third")).Err(); err != ErrBacklogDropped {
+		t.Fatalf("PutAsync got %v", err)
+	}
+
+	oldest, err := NewClient("127.0.0.1:9", ClientConf{Name: "c2", ConnectCode: "c", SecretKey: "pair-test",
+		Backlog: NewMemoryBacklog(), BacklogLimit: BacklogLimit{MaxEntries: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer oldest.Close()
+	future := oldest.PutAsync("r", []byte("first"))
+	if err = oldest.Put("r", []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-future.Done():
+	case <-time.After(time.Second):
+		t.Fatal("dropped PutAsync not resolved")
+	}
+	if future.Err() != ErrBacklogDropped {
+		t.Fatalf("future got %v", future.Err())
+	}
+}
+
+type putEvent struct {
+	id     int64
+	label  string
+	reason error
+}
+
+func TestPutHooks(t *testing.T) {
+	_, c := testPair(t, func(s *Servers) {
+		s.PutHandleFunc("r", func(s *Servers, ci *ClientInfo, body []byte) {})
+	}, nil)
+	acked := make(chan putEvent, 4)
+	c.OnPutAcked(func(c *Client, id int64, label string) {
+		acked <- putEvent{id: id, label: label}
+	})
+	waitConnected(t, c)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	future := c.PutAsync("r", []byte("hi"))
+	if err := future.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-acked:
+		if e.id != future.Id || e.label != "r" {
+			t.Fatalf("acked %+v, want id %d", e, future.Id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnPutAcked not called")
+	}
+	// 重复的确认不回调
+	c.putAcked(future.Id, PutResponse{})
+	select {
+	case e := <-acked:
+		t.Fatalf("acked twice %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPutDroppedHook(t *testing.T) {
+	c, err := NewClient("127.0.0.1:9", ClientConf{Name: "c1", ConnectCode: "c", SecretKey: "pair-test",
+		Backlog: NewMemoryBacklog(), BacklogLimit: BacklogLimit{MaxEntries: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	dropped := make(chan putEvent, 4)
+	c.OnPutDropped(func(c *Client, id int64, label string, reason error) {
+		dropped <- putEvent{id: id, label: label, reason: reason}
+	})
+	first := c.PutAsync("a", []byte("first"))
+	if err = c.Put("b", []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-dropped:
+		if e.id != first.Id || e.label != "a" || e.reason != ErrBacklogDropped {
+			t.Fatalf("dropped %+v, want id %d", e, first.Id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnPutDropped not called")
+	}
+}
+
+// 重启后恢复的积压数据被确认时同样回调
+func TestPutHooksRestored(t *testing.T) {
+	store := NewMemoryBacklog()
+	_ = store.Add(PutData{Label: "old", Id: 42, Body: []byte("x")})
+	c, err := NewClient("127.0.0.1:9", ClientConf{Name: "c1", ConnectCode: "c", SecretKey: "pair-test", Backlog: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	acked := make(chan putEvent, 1)
+	c.OnPutAcked(func(c *Client, id int64, label string) {
+		acked <- putEvent{id: id, label: label}
+	})
+	c.putAcked(42, PutResponse{})
+	select {
+	case e := <-acked:
+		if e.id != 42 || e.label != "old" {
+			t.Fatalf("acked %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnPutAcked not called for restored data")
+	}
+}
@@ -0,0 +1,206 @@
+package udp
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// clientRegistry 客户端连接表, 并发安全
+// 连接包/心跳包的处理, 时间轮, 业务方法会同时读写, 所有访问都要经过锁, 对外只提供副本
+type clientRegistry struct {
+	lock        sync.RWMutex
+	conns       map[string]map[string]*ClientConnectObj // map:name -> map:ipaddr -> obj, obj 存入后不再修改
+	addrs       map[string]*ClientConnectObj            // map:ipaddr -> obj, 按地址查找连接的会话
+	onLineTable map[string]*ClientConnInfo              // c端的在线表 key= name@ip
+}
+
+func newClientRegistry() *clientRegistry {
+	return &clientRegistry{
+		conns:       make(map[string]map[string]*ClientConnectObj),
+		addrs:       make(map[string]*ClientConnectObj),
+		onLineTable: make(map[string]*ClientConnInfo),
+	}
+}
+
+// clientEvent 连接表变化的事件
+type clientEvent int
+
+const (
+	clientEventNone      clientEvent = iota // 在线期间的刷新(心跳)
+	clientEventConnect                      // 首次上线
+	clientEventReconnect                    // 离线后再次上线或更换了端口
+	clientEventOffline                      // 离线
+)
+
+func onLineKey(name, ip string) string {
+	return fmt.Sprintf("%s@%s", name, ip)
+}
+
+// join 存储c端的连接, 每次连接包与心跳包都会刷新, 返回刷新后的在线信息与对应的事件
+func (r *clientRegistry) join(name, ip string, addr *net.UDPAddr, sess session) (ClientConnInfo, clientEvent) {
+	now := time.Now().Unix()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	event := clientEventNone
+	key := onLineKey(name, ip)
+	if prev, ok := r.onLineTable[key]; !ok {
+		event = clientEventConnect
+	} else if !prev.Online || prev.Addr != addr.String() {
+		event = clientEventReconnect
+	}
+	if _, ok := r.conns[name]; !ok {
+		r.conns[name] = make(map[string]*ClientConnectObj)
+	}
+	obj := &ClientConnectObj{
+		IP:       ip,
+		Addr:     addr,
+		Last:     now,
+		Version:  sess.Version,
+		Features: sess.Features,
+		name:     formatName(name),
+		keys:     sess.keys,
+		mac:      sess.mac,
+	}
+	r.conns[name][addr.String()] = obj
+	r.addrs[addr.String()] = obj
+	info := &ClientConnInfo{
+		Name:        name,
+		Online:      true,
+		IP:          ip,
+		Addr:        addr.String(),
+		LastTime:    now,
+		DiscardTime: 0,
+		Version:     sess.Version,
+		Features:    sess.Features,
+	}
+	r.onLineTable[key] = info
+	return *info, event
+}
+
+// discard 移除 name 下指定 ip 的连接, ip 为空时移除 name 下所有连接, 返回离线的在线信息
+func (r *clientRegistry) discard(name, ip string) []ClientConnInfo {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	discarded := make([]ClientConnInfo, 0)
+	v, ok := r.conns[name]
+	if !ok {
+		return discarded
+	}
+	now := time.Now().Unix()
+	for k, c := range v {
+		if ip != "" && c.IP != ip {
+			continue
+		}
+		delete(v, k)
+		r.dropAddr(k, c)
+		if info := r.offline(name, c.IP, k, now); info != nil {
+			discarded = append(discarded, *info)
+		}
+	}
+	if len(v) == 0 {
+		delete(r.conns, name)
+	}
+	return discarded
+}
+
+// discardExpired 移除最后一次连接早于 before 的连接, 检查与移除在同一次加锁中完成
+func (r *clientRegistry) discardExpired(before int64) []ClientConnInfo {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now().Unix()
+	discarded := make([]ClientConnInfo, 0)
+	for name, v := range r.conns {
+		for k, c := range v {
+			if c.Last >= before {
+				continue
+			}
+			delete(v, k)
+			r.dropAddr(k, c)
+			if info := r.offline(name, c.IP, k, now); info != nil {
+				discarded = append(discarded, *info)
+			}
+		}
+		if len(v) == 0 {
+			delete(r.conns, name)
+		}
+	}
+	return discarded
+}
+
+// dropAddr 移除地址索引, 同一地址已被其他 name 使用时不移除, 调用方持有写锁
+func (r *clientRegistry) dropAddr(addr string, obj *ClientConnectObj) {
+	if r.addrs[addr] == obj {
+		delete(r.addrs, addr)
+	}
+}
+
+// session 按地址获取连接协商的版本与特性
+func (r *clientRegistry) session(addr string) (session, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	obj, ok := r.addrs[addr]
+	if !ok {
+		return session{}, false
+	}
+	return session{Version: obj.Version, Features: obj.Features, name: obj.name, keys: obj.keys, mac: obj.mac}, true
+}
+
+// offline 标记在线表离线, 调用方持有写锁
+// 同一 name@ip 换了端口(如c端重启)时在线表记录的是新的地址, 旧地址过期不影响在线状态
+func (r *clientRegistry) offline(name, ip, addr string, now int64) *ClientConnInfo {
+	info := r.onLineTable[onLineKey(name, ip)]
+	if info == nil || !info.Online || info.Addr != addr {
+		return nil
+	}
+	info.Online = false
+	info.DiscardTime = now
+	return info
+}
+
+func (r *clientRegistry) names() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	nameList := make([]string, 0, len(r.conns))
+	for name := range r.conns {
+		nameList = append(nameList, name)
+	}
+	return nameList
+}
+
+// connList 获取 name 下的所有连接, 返回副本
+func (r *clientRegistry) connList(name string) (map[string]*ClientConnectObj, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	v, ok := r.conns[name]
+	if !ok || len(v) == 0 {
+		return nil, false
+	}
+	list := make(map[string]*ClientConnectObj, len(v))
+	for k, c := range v {
+		list[k] = c
+	}
+	return list, true
+}
+
+// snapshot 在线表副本
+func (r *clientRegistry) snapshot() map[string]ClientConnInfo {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	table := make(map[string]ClientConnInfo, len(r.onLineTable))
+	for k, v := range r.onLineTable {
+		table[k] = *v
+	}
+	return table
+}
+
+func (r *clientRegistry) connInfo(name, ip string) (ClientConnInfo, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	info, ok := r.onLineTable[onLineKey(name, ip)]
+	if !ok {
+		return ClientConnInfo{}, false
+	}
+	return *info, true
+}
@@ -0,0 +1,174 @@
+package udp
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testAddr(ip string, port int) *net.UDPAddr {
+	return &net.UDPAddr{IP: net.ParseIP(ip), Port: port}
+}
+
+func TestRegistryJoin(t *testing.T) {
+	r := newClientRegistry()
+	a := testAddr("10.0.0.1", 1000)
+	r.join("c1", "10.0.0.1", a, session{})
+	r.join("c1", "10.0.0.1", a, session{})
+	r.join("c1", "10.0.0.1", testAddr("10.0.0.1", 1001), session{})
+	if list, ok := r.connList("c1"); !ok || len(list) != 2 {
+		t.Fatalf("connList %v %v", list, ok)
+	}
+	if info, ok := r.connInfo("c1", "10.0.0.1"); !ok || !info.Online || info.Addr != "10.0.0.1:1001" {
+		t.Fatalf("online table %+v %v", info, ok)
+	}
+	if names := r.names(); len(names) != 1 || names[0] != "c1" {
+		t.Fatalf("names %v", names)
+	}
+}
+
+func TestRegistryDiscardByIP(t *testing.T) {
+	r := newClientRegistry()
+	r.join("c1", "10.0.0.1", testAddr("10.0.0.1", 1000), session{})
+	r.join("c1", "10.0.0.2", testAddr("10.0.0.2", 1000), session{})
+	r.discard("c1", "10.0.0.1")
+	if _, ok := r.session("10.0.0.1:1000"); ok {
+		t.Fatal("discarded address still has a session")
+	}
+	if _, ok := r.session("10.0.0.2:1000"); !ok {
+		t.Fatal("other ip lost its session")
+	}
+	if info, ok := r.connInfo("c1", "10.0.0.1"); !ok || info.Online || info.DiscardTime == 0 {
+		t.Fatalf("discarded %+v %v", info, ok)
+	}
+	if info, ok := r.connInfo("c1", "10.0.0.2"); !ok || !info.Online {
+		t.Fatalf("other ip %+v %v", info, ok)
+	}
+	if list, ok := r.connList("c1"); !ok || len(list) != 1 {
+		t.Fatalf("connList %v %v", list, ok)
+	}
+	r.discard("c1", "")
+	if _, ok := r.connList("c1"); ok {
+		t.Fatal("connections kept after discarding the name")
+	}
+	if len(r.names()) != 0 {
+		t.Fatalf("names %v after discard", r.names())
+	}
+}
+
+func TestRegistryDiscardExpired(t *testing.T) {
+	r := newClientRegistry()
+	r.join("c1", "10.0.0.1", testAddr("10.0.0.1", 1000), session{})
+	if len(r.discardExpired(time.Now().Unix()-10)) != 0 {
+		t.Fatal("fresh connection expired")
+	}
+	offline := r.discardExpired(time.Now().Unix() + 1)
+	if len(offline) != 1 || offline[0].Online || offline[0].DiscardTime == 0 {
+		t.Fatalf("expired %+v", offline)
+	}
+	if len(r.names()) != 0 {
+		t.Fatalf("names %v after expiry", r.names())
+	}
+}
+
+// 返回的是副本, 修改不影响连接表
+func TestRegistrySnapshotCopy(t *testing.T) {
+	r := newClientRegistry()
+	r.join("c1", "10.0.0.1", testAddr("10.0.0.1", 1000), session{})
+	table := r.snapshot()
+	info := table[onLineKey("c1", "10.0.0.1")]
+	info.Online = false
+	list, _ := r.connList("c1")
+	for k := range list {
+		delete(list, k)
+	}
+	if info, _ := r.connInfo("c1", "10.0.0.1"); !info.Online {
+		t.Fatal("snapshot shares the online table")
+	}
+	if list, ok := r.connList("c1"); !ok || len(list) != 1 {
+		t.Fatal("connList shares the connection table")
+	}
+}
+
+// 同一地址被其他 name 使用后, 移除旧 name 不影响新 name 的会话
+func TestRegistrySharedAddr(t *testing.T) {
+	r := newClientRegistry()
+	a := testAddr("10.0.0.1", 1000)
+	r.join("old", "10.0.0.1", a, session{Version: 0})
+	r.join("new", "10.0.0.1", a, session{Version: 1})
+	r.discard("old", "")
+	if sess, ok := r.session(a.String()); !ok || sess.Version != 1 {
+		t.Fatalf("session %+v %v", sess, ok)
+	}
+}
+
+// 连接, 心跳, 移除, 过期与读取同时进行, 使用 go test -race 运行
+func TestRegistryConcurrent(t *testing.T) {
+	r := newClientRegistry()
+	const (
+		workers = 16
+		rounds  = 500
+	)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				name := fmt.Sprintf("c%d", i%8)
+				ip := fmt.Sprintf("10.0.%d.%d", w%4, i%4)
+				addr := testAddr(ip, 1000+i%3)
+				switch i % 6 {
+				case 0, 1, 2: // 连接与心跳
+					r.join(name, ip, addr, session{Version: uint8(i % 2), Features: Feature(i)})
+				case 3:
+					r.discard(name, ip)
+				case 4:
+					r.discardExpired(time.Now().Unix() - int64(i%2))
+				case 5:
+					r.session(addr.String())
+					r.snapshot()
+					r.names()
+					if list, ok := r.connList(name); ok {
+						for _, c := range list {
+							_ = c.Addr.String()
+						}
+					}
+					r.connInfo(name, ip)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// 连接表, 地址索引与在线表保持一致
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for name, list := range r.conns {
+		if len(list) == 0 {
+			t.Fatalf("empty connection list kept for %s", name)
+		}
+		for addr, c := range list {
+			if r.addrs[addr] == nil {
+				t.Fatalf("%s %s missing from the address index", name, addr)
+			}
+			if info := r.onLineTable[onLineKey(name, c.IP)]; info == nil {
+				t.Fatalf("%s %s missing from the online table", name, addr)
+			}
+		}
+	}
+	for addr, obj := range r.addrs {
+		found := false
+		for _, list := range r.conns {
+			if list[addr] == obj {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Fatalf("address index %s points to a removed connection", addr)
+		}
+	}
+}
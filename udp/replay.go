@@ -0,0 +1,257 @@
+package udp
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+
+防重放: 协商了 FeatureReplayGuard 的c端, 经过签名的包(Put, Get, Notice, Reply) data 前追加
+
+______________________________________________________
+|                 |                  |               |
+| 序号(uvarint)    | 时间戳ms(varint)  |    data...    |
+|_________________|__________________|_______________|
+
+1. 序号在c端单调递增, 初始值为创建c端时的 UnixNano, c端重启后的序号依然大于重启前
+2. s端按c端地址维护滑动窗口, 窗口内重复的序号与早于窗口的序号丢弃
+3. 时间戳与s端时间相差超过 maxAge 的包丢弃, 所以窗口只需保留 maxAge 内活跃的地址
+4. 序号与时间戳在加密数据内, 无法篡改
+5. 连接包与心跳包没有签名, 由 hello 中的时间戳防重放: 时间戳在 maxAge 内并大于该地址上一次的时间戳,
+   c端的时间戳单调递增; 其他地址重放的连接包只能在 maxAge 内生效
+
+*/
+
+const replayBlocks = ReplayWindowSize / 64
+
+// ReplayStats 防重放丢弃的包数量
+type ReplayStats struct {
+	Duplicate uint64 // 窗口内重复的序号
+	Stale     uint64 // 早于窗口的序号
+	Expired   uint64 // 时间戳超过 maxAge
+	Malformed uint64 // 缺少序号与时间戳
+}
+
+// appendReplayMeta data 前追加序号与时间戳
+func appendReplayMeta(seq uint64, ts int64, data []byte) []byte {
+	buf := make([]byte, 0, len(data)+2*binary.MaxVarintLen64)
+	buf = binary.AppendUvarint(buf, seq)
+	buf = binary.AppendVarint(buf, ts)
+	return append(buf, data...)
+}
+
+// cutReplayMeta 取出序号与时间戳
+func cutReplayMeta(data []byte) (uint64, int64, []byte, bool) {
+	seq, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, 0, nil, false
+	}
+	ts, m := binary.Varint(data[n:])
+	if m <= 0 {
+		return 0, 0, nil, false
+	}
+	return seq, ts, data[n+m:], true
+}
+
+// replayWindow 滑动窗口, 按 序号/64 分块的环形位图
+type replayWindow struct {
+	top    uint64
+	bitmap [replayBlocks]uint64
+	last   time.Time
+	stamp  int64 // 最近一次连接包与心跳包的时间戳
+}
+
+// accept 返回是否接收, 不接收时 stale 表示早于窗口
+func (w *replayWindow) accept(seq uint64) (ok bool, stale bool) {
+	index := seq / 64
+	if seq > w.top {
+		current := w.top / 64
+		diff := index - current
+		if diff > replayBlocks {
+			diff = replayBlocks
+		}
+		for i := uint64(1); i <= diff; i++ {
+			w.bitmap[(current+i)%replayBlocks] = 0
+		}
+		w.top = seq
+	} else if w.top-seq > ReplayWindowSize-64 {
+		return false, true
+	}
+	block, bit := index%replayBlocks, uint64(1)<<(seq%64)
+	if w.bitmap[block]&bit != 0 {
+		return false, false
+	}
+	w.bitmap[block] |= bit
+	return true, false
+}
+
+// replayGuard s端按c端地址的防重放窗口
+type replayGuard struct {
+	lock    sync.Mutex
+	windows map[string]*replayWindow
+	maxAge  time.Duration
+	stats   ReplayStats
+}
+
+func newReplayGuard() *replayGuard {
+	return &replayGuard{
+		windows: make(map[string]*replayWindow),
+		maxAge:  ReplayMaxAge * time.Millisecond,
+	}
+}
+
+// check 检查并取出序号与时间戳, 返回去掉序号与时间戳的 data
+func (g *replayGuard) check(addr string, data []byte) ([]byte, bool) {
+	seq, ts, rest, ok := cutReplayMeta(data)
+	if !ok {
+		atomic.AddUint64(&g.stats.Malformed, 1)
+		return nil, false
+	}
+	now := time.Now()
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	age := now.Sub(time.UnixMilli(ts))
+	if age > g.maxAge || age < -g.maxAge {
+		atomic.AddUint64(&g.stats.Expired, 1)
+		return nil, false
+	}
+	w, has := g.windows[addr]
+	if !has {
+		w = &replayWindow{}
+		g.windows[addr] = w
+	}
+	ok, stale := w.accept(seq)
+	if !ok {
+		if stale {
+			atomic.AddUint64(&g.stats.Stale, 1)
+		} else {
+			atomic.AddUint64(&g.stats.Duplicate, 1)
+		}
+		return nil, false
+	}
+	w.last = now
+	return rest, true
+}
+
+// checkStamp 检查连接包与心跳包的时间戳, 需在 maxAge 内并大于该地址上一次的时间戳
+func (g *replayGuard) checkStamp(addr string, stamp int64) bool {
+	now := time.Now()
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	age := now.Sub(time.UnixMilli(stamp))
+	if age > g.maxAge || age < -g.maxAge {
+		atomic.AddUint64(&g.stats.Expired, 1)
+		return false
+	}
+	w, has := g.windows[addr]
+	if !has {
+		w = &replayWindow{}
+		g.windows[addr] = w
+	}
+	if stamp <= w.stamp {
+		atomic.AddUint64(&g.stats.Stale, 1)
+		return false
+	}
+	w.stamp = stamp
+	w.last = now
+	return true
+}
+
+// sweep 移除超过 maxAge 没有收到包的窗口, 这些地址更早的包会因时间戳过期被丢弃
+func (g *replayGuard) sweep() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for addr, w := range g.windows {
+		if time.Since(w.last) > g.maxAge {
+			delete(g.windows, addr)
+		}
+	}
+}
+
+func (g *replayGuard) snapshot() ReplayStats {
+	return ReplayStats{
+		Duplicate: atomic.LoadUint64(&g.stats.Duplicate),
+		Stale:     atomic.LoadUint64(&g.stats.Stale),
+		Expired:   atomic.LoadUint64(&g.stats.Expired),
+		Malformed: atomic.LoadUint64(&g.stats.Malformed),
+	}
+}
+
+// replayProtected 需要防重放的指令, 连接包与心跳包不经过签名, 不携带序号, 由 hello 的时间戳防重放
+func replayProtected(cmd CommandCode) bool {
+	switch cmd {
+	case CommandPut, CommandGet, CommandNotice, CommandReply:
+		return true
+	}
+	return false
+}
+
+// SetReplayMaxAge 设置防重放允许的时间差, 需要大于两端的时钟误差; 小于等于0不修改
+func (s *Servers) SetReplayMaxAge(maxAge time.Duration) {
+	if maxAge <= 0 {
+		return
+	}
+	s.replay.lock.Lock()
+	defer s.replay.lock.Unlock()
+	s.replay.maxAge = maxAge
+}
+
+// ReplayStats 防重放丢弃的包数量
+func (s *Servers) ReplayStats() ReplayStats {
+	return s.replay.snapshot()
+}
+
+// replayCheck 协商了防重放的c端, 检查并去掉序号与时间戳, 不通过的包丢弃
+func (s *Servers) replayCheck(addr string, packet *Packet) bool {
+	if !replayProtected(packet.Command) {
+		return true
+	}
+	sess, _ := s.clients.session(addr)
+	if !sess.Features.Has(FeatureReplayGuard) {
+		return true
+	}
+	data, ok := s.replay.check(addr, packet.Data)
+	if !ok {
+		ErrorF("丢弃重放或过期的包 addr:%s command:%d", addr, packet.Command)
+		return false
+	}
+	packet.Data = data
+	return true
+}
+
+// helloCheck 请求了防重放的连接包与心跳包, 检查 hello 的时间戳, 不通过的包丢弃
+func (s *Servers) helloCheck(addr string, h *hello) bool {
+	if !h.Features.Has(FeatureReplayGuard) {
+		return true
+	}
+	if !s.replay.checkStamp(addr, h.Stamp) {
+		ErrorF("丢弃重放或过期的连接包 addr:%s", addr)
+		return false
+	}
+	return true
+}
+
+// nextStamp 连接包与心跳包的时间戳, 同一毫秒内多次发送时依然递增
+func (c *Client) nextStamp() int64 {
+	for {
+		prev := atomic.LoadInt64(&c.stamp)
+		next := time.Now().UnixMilli()
+		if next <= prev {
+			next = prev + 1
+		}
+		if atomic.CompareAndSwapInt64(&c.stamp, prev, next) {
+			return next
+		}
+	}
+}
+
+// replayMeta c端协商了防重放时追加序号与时间戳
+func (c *Client) replayMeta(cmd CommandCode, data []byte) []byte {
+	if !replayProtected(cmd) || !c.Features().Has(FeatureReplayGuard) {
+		return data
+	}
+	return appendReplayMeta(atomic.AddUint64(&c.seq, 1), time.Now().UnixMilli(), data)
+}
@@ -0,0 +1,167 @@
+package udp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReplayWindowEdges(t *testing.T) {
+	w := &replayWindow{}
+	for _, seq := range []uint64{100, 101, 99, 150} {
+		if ok, _ := w.accept(seq); !ok {
+			t.Fatalf("seq %d rejected", seq)
+		}
+	}
+	if ok, stale := w.accept(101); ok || stale {
+		t.Fatalf("duplicate 101: ok=%v stale=%v", ok, stale)
+	}
+	// 窗口最早的序号
+	top := uint64(5000)
+	w.accept(top)
+	oldest := top - (ReplayWindowSize - 64)
+	if ok, _ := w.accept(oldest); !ok {
+		t.Fatalf("oldest seq %d in the window rejected", oldest)
+	}
+	if ok, stale := w.accept(oldest - 1); ok || !stale {
+		t.Fatalf("seq %d before the window: ok=%v stale=%v", oldest-1, ok, stale)
+	}
+}
+
+// 跳过整个窗口后旧的位图被清空, 不会把新的序号误判为重复
+func TestReplayWindowJump(t *testing.T) {
+	w := &replayWindow{}
+	for seq := uint64(1); seq <= ReplayWindowSize; seq++ {
+		w.accept(seq)
+	}
+	jump := uint64(10 * ReplayWindowSize)
+	if ok, _ := w.accept(jump); !ok {
+		t.Fatal("jump rejected")
+	}
+	for seq := jump - ReplayWindowSize + 64; seq < jump; seq++ {
+		if ok, _ := w.accept(seq); !ok {
+			t.Fatalf("seq %d after the jump rejected", seq)
+		}
+	}
+}
+
+func TestReplayGuardCheck(t *testing.T) {
+	g := newReplayGuard()
+	now := time.Now().UnixMilli()
+	data, ok := g.check("a", appendReplayMeta(1, now, []byte("x")))
+	if !ok || string(data) != "x" {
+		t.Fatalf("got %q %v", data, ok)
+	}
+	if _, ok = g.check("a", appendReplayMeta(1, now, []byte("x"))); ok {
+		t.Fatal("replayed packet accepted")
+	}
+	if _, ok = g.check("b", appendReplayMeta(1, now, []byte("x"))); !ok {
+		t.Fatal("same seq from another address rejected")
+	}
+	maxAge := int64(ReplayMaxAge)
+	if _, ok = g.check("a", appendReplayMeta(2, now-maxAge-1000, nil)); ok {
+		t.Fatal("expired packet accepted")
+	}
+	if _, ok = g.check("a", appendReplayMeta(3, now+maxAge+1000, nil)); ok {
+		t.Fatal("future packet accepted")
+	}
+	if _, ok = g.check("a", nil); ok {
+		t.Fatal("packet without meta accepted")
+	}
+	stats := g.snapshot()
+	if stats.Duplicate != 1 || stats.Expired != 2 || stats.Malformed != 1 || stats.Stale != 0 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+func testServers(t *testing.T) *Servers {
+	t.Helper()
+	s, err := NewServers("127.0.0.1", 0, ServersConf{SecretKey: "servers-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = s.Conn.Close()
+	})
+	return s
+}
+
+// 签名不正确的包不推进防重放窗口
+func TestReplayAfterSignCheck(t *testing.T) {
+	s := testServers(t)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9}
+	s.clients.join("c", "127.0.0.1", addr, session{Version: 1, Features: FeatureReplayGuard})
+	s.SignStore(addr.String(), "sign123")
+	packet := func(sign string, seq uint64) []byte {
+		b, err := PacketEncoderVersion(CommandNotice, 1, "c", sign, s.cipher, appendReplayMeta(seq, time.Now().UnixMilli(), nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	forged := packet("bogus00", 1<<60)
+	if _, _, ok := s.receive(addr, forged, len(forged)); ok {
+		t.Fatal("forged packet accepted")
+	}
+	legit := packet("sign123", 5)
+	if _, _, ok := s.receive(addr, legit, len(legit)); !ok {
+		t.Fatal("legitimate packet rejected after a forged one")
+	}
+	if _, _, ok := s.receive(addr, legit, len(legit)); ok {
+		t.Fatal("replayed packet accepted")
+	}
+}
+
+func TestReplayGuardStamp(t *testing.T) {
+	g := newReplayGuard()
+	now := time.Now().UnixMilli()
+	if !g.checkStamp("a", now) {
+		t.Fatal("fresh stamp rejected")
+	}
+	if g.checkStamp("a", now) {
+		t.Fatal("replayed stamp accepted")
+	}
+	if g.checkStamp("a", now-1) {
+		t.Fatal("older stamp accepted")
+	}
+	if !g.checkStamp("b", now) {
+		t.Fatal("same stamp from another address rejected")
+	}
+	if g.checkStamp("c", now-int64(ReplayMaxAge)-1000) {
+		t.Fatal("expired stamp accepted")
+	}
+	if g.checkStamp("c", 0) {
+		t.Fatal("missing stamp accepted")
+	}
+	stats := g.snapshot()
+	if stats.Stale != 2 || stats.Expired != 2 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+func TestClientNextStamp(t *testing.T) {
+	c := &Client{stamp: time.Now().Add(time.Hour).UnixMilli()}
+	prev := c.nextStamp()
+	for i := 0; i < 100; i++ {
+		next := c.nextStamp()
+		if next <= prev {
+			t.Fatalf("stamp %d after %d", next, prev)
+		}
+		prev = next
+	}
+}
+
+// 请求了防重放的连接包重放后被丢弃, 没有请求的旧c端不检查
+func TestHelloCheck(t *testing.T) {
+	s := testServers(t)
+	h := &hello{Features: FeatureReplayGuard, Stamp: time.Now().UnixMilli()}
+	if !s.helloCheck("127.0.0.1:9", h) {
+		t.Fatal("fresh hello rejected")
+	}
+	if s.helloCheck("127.0.0.1:9", h) {
+		t.Fatal("replayed hello accepted")
+	}
+	if !s.helloCheck("127.0.0.1:9", &hello{}) {
+		t.Fatal("hello without replay guard rejected")
+	}
+}
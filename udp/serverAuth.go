@@ -0,0 +1,90 @@
+package udp
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+/*
+
+c端校验s端的包: 通知, get请求与回应在交给处理方法前校验来源与会话
+
+1. 来源地址需要是连接的s端地址(ServersHost); c端使用 DialUDP 连接的 socket, 系统已过滤其他来源的包,
+   该检查只作为纵深防御, 正常情况下 Address 为0; 默认只统计, 严格模式下丢弃
+2. 协商了 FeaturePacketMAC 的包已校验认证码, 其他包校验包头的签名(当前或上一次连接回应下发的签名, 未连接时没有签名)
+3. 连接回应由预共享秘钥认证, 不校验会话
+4. 通知, get请求与回应的会话认证不通过时丢弃
+5. 严格模式(StrictServerAuth)只接受认证码校验通过的包, 只有签名的包被丢弃; 连接回应没有协商 FeaturePacketMAC 时不连接,
+   只能连接支持该特性的s端
+
+*/
+
+// ServerAuthStats c端未通过s端认证的包数量
+type ServerAuthStats struct {
+	Address uint64 // 来源地址不是连接的s端, 连接的 socket 由系统过滤, 正常情况下为0
+	Session uint64 // 没有通过会话认证(认证码或签名, 严格模式下只接受认证码)
+	Dropped uint64 // 丢弃的数量
+}
+
+// SetStrictServerAuth 设置严格模式, 开启后只接受认证码校验通过的s端包, 并丢弃来源地址不是连接的s端的包
+func (c *Client) SetStrictServerAuth(on bool) {
+	var v uint32
+	if on {
+		v = 1
+	}
+	atomic.StoreUint32(&c.strictAuth, v)
+}
+
+func (c *Client) strictServerAuth() bool {
+	return atomic.LoadUint32(&c.strictAuth) == 1
+}
+
+// ServerAuthStats c端未通过s端认证的包数量
+func (c *Client) ServerAuthStats() ServerAuthStats {
+	return ServerAuthStats{
+		Address: atomic.LoadUint64(&c.authStats.Address),
+		Session: atomic.LoadUint64(&c.authStats.Session),
+		Dropped: atomic.LoadUint64(&c.authStats.Dropped),
+	}
+}
+
+// fromServer 来源地址是否是连接的s端, 返回 false 时丢弃该包
+func (c *Client) fromServer(addr *net.UDPAddr) bool {
+	server, ok := c.Conn.RemoteAddr().(*net.UDPAddr)
+	if !ok || (server.IP.Equal(addr.IP) && server.Port == addr.Port) {
+		return true
+	}
+	atomic.AddUint64(&c.authStats.Address, 1)
+	if !c.strictServerAuth() {
+		return true
+	}
+	atomic.AddUint64(&c.authStats.Dropped, 1)
+	Error("来源地址不是连接的s端, 丢弃 addr:", addr.String())
+	return false
+}
+
+// serverAuth 校验包的会话, 严格模式下只接受认证码, 返回 false 时丢弃该包
+func (c *Client) serverAuth(packet *Packet) bool {
+	if packet.authed || !c.strictServerAuth() && c.signCheck(packet) {
+		return true
+	}
+	atomic.AddUint64(&c.authStats.Session, 1)
+	atomic.AddUint64(&c.authStats.Dropped, 1)
+	Error("未知主机认证! 指令:", packet.Command)
+	return false
+}
+
+// setSign 存储连接回应下发的签名, 保留上一次的签名
+func (c *Client) setSign(sign string) {
+	c.kxLock.Lock()
+	defer c.kxLock.Unlock()
+	c.prevSign.Store(c.getSign())
+	c.sign.Store(sign)
+}
+
+// handshakeDropped 会话建立后没有认证码或使用预共享秘钥加密的包只接受连接回应, 其他包计入会话认证并丢弃
+func (c *Client) handshakeDropped() {
+	atomic.AddUint64(&c.authStats.Session, 1)
+	atomic.AddUint64(&c.authStats.Dropped, 1)
+	Error("会话建立后未使用会话密钥的包")
+}
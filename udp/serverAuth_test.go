@@ -0,0 +1,101 @@
+package udp
+
+import (
+	"net"
+	"testing"
+)
+
+func testClient(t *testing.T) *Client {
+	t.Helper()
+	c, err := NewClient("127.0.0.1:9", ClientConf{Name: "c1", ConnectCode: "c", SecretKey: "auth-test", Backlog: NewMemoryBacklog()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+// 通知, get请求与回应的会话认证不通过时丢弃
+func TestServerAuth(t *testing.T) {
+	c := testClient(t)
+	notice := &Packet{Command: CommandNotice, Sign: "sign001"}
+	if c.serverAuth(notice) {
+		t.Fatal("notice accepted before connecting")
+	}
+	c.setSign("sign001")
+	if !c.serverAuth(notice) {
+		t.Fatal("notice with the current sign rejected")
+	}
+	c.setSign("sign002")
+	if !c.serverAuth(notice) {
+		t.Fatal("notice with the previous sign rejected")
+	}
+	c.setSign("sign003")
+	if c.serverAuth(notice) || c.serverAuth(&Packet{Command: CommandGet}) {
+		t.Fatal("stale or missing sign accepted")
+	}
+	if !c.serverAuth(&Packet{Command: CommandReply, authed: true}) {
+		t.Fatal("authenticated packet rejected")
+	}
+	if stats := c.ServerAuthStats(); stats.Session != 3 || stats.Dropped != 3 || stats.Address != 0 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+// 严格模式只接受认证码, 不接受只有签名的包与会话
+func TestStrictServerAuth(t *testing.T) {
+	c := testClient(t)
+	c.SetStrictServerAuth(true)
+	c.setSign("sign001")
+	if c.serverAuth(&Packet{Command: CommandNotice, Sign: "sign001"}) {
+		t.Fatal("sign-only packet accepted in strict mode")
+	}
+	if !c.serverAuth(&Packet{Command: CommandNotice, authed: true}) {
+		t.Fatal("authenticated packet rejected in strict mode")
+	}
+	if c.acceptPacketMAC(FeatureBinaryEnvelope, nil, nil) {
+		t.Fatal("session without MAC accepted in strict mode")
+	}
+	key := make([]byte, PacketMACKeySize)
+	if !c.acceptPacketMAC(FeaturePacketMAC, key, nil) || c.packetMACKey() == nil {
+		t.Fatal("session with MAC rejected in strict mode")
+	}
+
+	c.SetStrictServerAuth(false)
+	c.kxLock.Lock()
+	c.mac = nil
+	c.kxLock.Unlock()
+	if !c.acceptPacketMAC(FeatureBinaryEnvelope, nil, nil) {
+		t.Fatal("session without MAC rejected without strict mode")
+	}
+}
+
+// 来源地址默认只统计, 严格模式下丢弃
+func TestServerAuthAddress(t *testing.T) {
+	c := testClient(t)
+	if !c.fromServer(c.Conn.RemoteAddr().(*net.UDPAddr)) {
+		t.Fatal("server address rejected")
+	}
+	other := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 10}
+	if !c.fromServer(other) {
+		t.Fatal("other address dropped without strict mode")
+	}
+	c.SetStrictServerAuth(true)
+	if c.fromServer(other) {
+		t.Fatal("other address accepted in strict mode")
+	}
+	if stats := c.ServerAuthStats(); stats.Address != 2 || stats.Dropped != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+// 严格模式的c端与s端协商认证码后正常通讯
+func TestStrictServerAuthConnect(t *testing.T) {
+	_, c := testPair(t, nil, func(conf *ClientConf) {
+		conf.StrictServerAuth = true
+	})
+	waitConnected(t, c)
+	if !c.Features().Has(FeaturePacketMAC) {
+		t.Fatalf("features %b", c.Features())
+	}
+}
@@ -1,37 +1,76 @@
 package udp
 
 import (
+	"context"
+	"crypto/ed25519"
+	"encoding"
+	"errors"
 	"fmt"
 	"net"
+	"strings"
+	"sync"
 	"time"
 )
 
 type Servers struct {
-	Addr        string                                  // 地址 默认0.0.0.0
-	Port        int                                     // 端口
-	Conn        *net.UDPConn                            // S端的UDP连接对象
-	name        string                                  // servers端的名称
-	CMap        map[string]map[string]*ClientConnectObj // 存放客户端连接信息  map:name -> map:ipaddr -> obj
-	connectCode string                                  // 连接code 是静态的由server端配发
-	secretKey   string                                  // 数据传输加密解密秘钥
-	PutHandle   ServersPutFunc                          // PUT类型方法
-	GetHandle   ServersGetFunc                          // GET类型方法
-	onLineTable map[string]*ClientConnInfo              // c端的在线表 key= name+ip
+	Addr        string          // 地址 默认0.0.0.0
+	Port        int             // 端口
+	Conn        *net.UDPConn    // S端的UDP连接对象
+	name        string          // servers端的名称
+	connectCode string          // 连接code 是静态的由server端配发
+	auth        Authenticator   // c端认证, 为空时校验连接code
+	authLock    sync.RWMutex    // auth 的锁
+	secretKey   string          // 数据传输加密解密秘钥
+	cipher      Cipher          // 数据包加密套件
+	PutHandle   ServersPutFunc  // PUT类型方法
+	GetHandle   ServersGetFunc  // GET类型方法
+	clients     *clientRegistry // 客户端连接表与在线表
+	fragment    *fragmentBuffer // 分片重组
+	closer      *closer         // 优雅关闭
+	hooks       clientHooks     // 客户端连接生命周期回调
+	replay      *replayGuard    // 防重放窗口
+	filter      *ipFilter       // IP黑白名单与封禁
+	putDedup    *putDedup       // Put去重
+	putOrder    *putOrder       // 有序Put
+	signMap     sync.Map        // 下发给c端的签名 key= ip+port
+	getDataMap  sync.Map        // 等待c端返回的get请求
+	noticeMap   sync.Map        // 等待c端确认的通知
+
+	legacy      Cipher   // 迁移期间兼容的 DES ECB, 为空时不兼容
+	legacyAddrs sync.Map // 使用 DES ECB 的c端地址
+
+	jsonEnvelope bool // 发送旧版 JSON 信封
+	requireMAC   bool // 拒绝未协商 FeaturePacketMAC 的c端, 见 mac.go
+
+	PutReply ServersPutReplyFunc // 带应答的PUT类型方法
+	identity ed25519.PrivateKey  // 身份密钥, 对密钥交换签名
 }
 
 type ClientConnInfo struct {
-	Name        string // 客户端名称
-	Online      bool   // 是否存活
-	IP          string // 连接的地址 ip
-	Addr        string // 连接的地址 ip+port
-	LastTime    int64  // 最后一次确认数据包加入存活的时间
-	DiscardTime int64  // 记录断开的时间
+	Name        string  // 客户端名称
+	Online      bool    // 是否存活
+	IP          string  // 连接的地址 ip
+	Addr        string  // 连接的地址 ip+port
+	LastTime    int64   // 最后一次确认数据包加入存活的时间
+	DiscardTime int64   // 记录断开的时间
+	Version     uint8   // 协商的协议版本
+	Features    Feature // 协商的特性
 }
 
 type ServersConf struct {
-	Name        string // servers端的名称
-	ConnectCode string // 连接code 是静态的由server端配发
-	SecretKey   string // 数据传输加密解密秘钥 8个字节
+	Name        string      // servers端的名称
+	ConnectCode string      // 连接code 是静态的由server端配发
+	SecretKey   string      // 数据传输加密解密秘钥, DES ECB 时为8个字节
+	CipherSuite CipherSuite // 加密套件 默认 AES-256-GCM, 需与Client端统一
+
+	LegacySecretKey string // 迁移期间兼容的旧版 DES ECB 秘钥(8个字节), 见 cipher.go
+
+	Authenticator Authenticator      // 按c端名称校验凭证(连接code), 为空时所有c端共用 ConnectCode
+	IdentityKey   ed25519.PrivateKey // 身份密钥, 对密钥交换签名, c端通过 ServerKeyPin 校验; 为空时只由预共享秘钥认证
+	AllowList     []string           // IP白名单, 元素为 CIDR 或 IP, 为空时允许所有地址
+	DenyList      []string           // IP黑名单, 元素为 CIDR 或 IP, 优先于白名单
+
+	AllowSignOnly bool // 允许未协商 FeaturePacketMAC 的c端(旧版本)只使用包头签名; 设置了 LegacySecretKey 时同样允许, 迁移完成后关闭
 }
 
 func SetServersConf(serversName, connectCode, secretKey string) ServersConf {
@@ -48,13 +87,19 @@ func NewServers(addr string, port int, conf ...ServersConf) (*Servers, error) {
 		addr = "0.0.0.0"
 	}
 	s := &Servers{
-		Addr:        addr,
-		Port:        port,
-		CMap:        make(map[string]map[string]*ClientConnectObj),
-		PutHandle:   make(ServersPutFunc),
-		GetHandle:   make(ServersGetFunc),
-		onLineTable: make(map[string]*ClientConnInfo),
-	}
+		Addr:      addr,
+		Port:      port,
+		PutHandle: make(ServersPutFunc),
+		PutReply:  make(ServersPutReplyFunc),
+		GetHandle: make(ServersGetFunc),
+		clients:   newClientRegistry(),
+		fragment:  newFragmentBuffer(),
+		closer:    newCloser(),
+		replay:    newReplayGuard(),
+		filter:    newIPFilter(),
+		putDedup:  newPutDedup(),
+	}
+	s.putOrder = newPutOrder(s.closer)
 	if len(conf) >= 1 {
 		if len(conf[0].Name) > 0 && len(conf[0].Name) <= 7 {
 			s.name = conf[0].Name
@@ -65,21 +110,38 @@ func NewServers(addr string, port int, conf ...ServersConf) (*Servers, error) {
 		if len(conf[0].ConnectCode) > 0 {
 			s.connectCode = conf[0].ConnectCode
 		}
-		if len(conf[0].SecretKey) != 8 {
+		if len(conf[0].SecretKey) < 1 {
 			return nil, ErrServersSecretKey
-		} else {
-			s.secretKey = conf[0].SecretKey
 		}
+		s.secretKey = conf[0].SecretKey
+		s.cipher, err = NewCipher(conf[0].CipherSuite, s.secretKey)
+		if err != nil {
+			return nil, err
+		}
+		if err = s.SetLegacySecretKey(conf[0].LegacySecretKey); err != nil {
+			return nil, err
+		}
+		s.auth = conf[0].Authenticator
+		s.identity = conf[0].IdentityKey
+		if err = s.SetAllowList(conf[0].AllowList...); err != nil {
+			return nil, err
+		}
+		if err = s.SetDenyList(conf[0].DenyList...); err != nil {
+			return nil, err
+		}
+		s.requireMAC = !conf[0].AllowSignOnly && conf[0].LegacySecretKey == ""
 	} else {
 		s.DefaultServersName()
 		s.DefaultConnectCode()
 		s.DefaultSecretKey()
+		s.requireMAC = true
 	}
 	s.Conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(s.Addr), Port: s.Port})
 	if err != nil {
 		Error(err)
 		return nil, err
 	}
+	_ = s.Conn.SetReadBuffer(SocketReadBuffer)
 	InfoF("udp server 启动成功 -->  name:%s |  addr: %s  | conn_code: %s \n",
 		s.name, s.Conn.LocalAddr().String(), s.connectCode)
 	return s, nil
@@ -98,107 +160,172 @@ func (s *Servers) SetConnectCode(code string) {
 }
 
 func (s *Servers) SetSecretKey(key string) error {
-	if len(key) != 8 {
+	if len(key) < 1 {
 		return ErrServersSecretKey
 	}
+	cipher, err := NewCipher(s.cipher.Suite(), key)
+	if err != nil {
+		return err
+	}
 	s.secretKey = key
+	s.cipher = cipher
+	return nil
+}
+
+// SetJSONEnvelope 发送时使用旧版 JSON 信封，用于灰度升级期间兼容未升级的Client端，接收时两种信封都能识别
+func (s *Servers) SetJSONEnvelope(on bool) {
+	s.jsonEnvelope = on
+}
+
+// encode 按c端连接协商的特性序列化信封, 未协商二进制信封的c端使用 JSON 信封
+func (s *Servers) encode(client *net.UDPAddr, obj encoding.BinaryMarshaler) ([]byte, error) {
+	sess, _ := s.clients.session(client.String())
+	return envelopeEncode(obj, s.jsonEnvelope || !sess.Features.Has(FeatureBinaryEnvelope))
+}
+
+// SetCipherSuite 设置加密套件，需与Client端统一
+func (s *Servers) SetCipherSuite(suite CipherSuite) error {
+	cipher, err := NewCipher(suite, s.secretKey)
+	if err != nil {
+		return err
+	}
+	s.cipher = cipher
 	return nil
 }
 
+// Run 接收并处理数据包, 调用 Shutdown 后返回
 func (s *Servers) Run() {
 
 	// 启动一个时间轮维护c端的连接
 	s.timeWheel()
 
-	data := make([]byte, 1500)
+	data := make([]byte, ReadBufferSize)
 	for {
 		n, remoteAddr, err := s.Conn.ReadFromUDP(data)
 		if err != nil {
+			if s.closer.isClosed() {
+				return
+			}
 			Error(err)
 			continue
 		}
-		//Info("解包....size = ", n)
-		packet, err := PacketDecrypt(s.secretKey, data, n)
-		if err != nil {
-			Error("错误的包 err:", err)
+		packet, n, ok := s.receive(remoteAddr, data, n)
+		if !ok {
 			continue
 		}
+		if !s.closer.start() {
+			return
+		}
 		go func() {
+			defer s.closer.done()
 			switch packet.Command {
 			case CommandConnect, CommandHeartbeat:
-				if string(packet.Data) != s.connectCode {
-					Error("未知客户端，连接code不正确...")
+				if !supportVersion(packet.Version) {
+					ErrorF("不支持的协议版本:%d name:%s addr:%s", packet.Version, packet.Name, remoteAddr.String())
+					s.replyVersion(remoteAddr)
 					return
 				}
+				h, hErr := parseHello(packet)
+				if hErr != nil {
+					Error("未知客户端，连接包解析失败 err:", hErr)
+					return
+				}
+				if aErr := s.authenticate(strings.TrimRight(packet.Name, " "), remoteAddr.IP.String(), h.ConnectCode); aErr != nil {
+					ErrorF("客户端认证失败 name:%s addr:%s err:%v", packet.Name, remoteAddr.String(), aErr)
+					s.rejectClient(remoteAddr)
+					return
+				}
+				// 按认证通过的名称封禁, 不回应
+				if s.filter.blockedName(formatName(packet.Name), remoteAddr.IP.String()) {
+					return
+				}
+				if !s.helloCheck(remoteAddr.String(), h) {
+					return
+				}
+				sess, _ := negotiate(packet, h)
+				if s.requireMAC && !sess.Features.Has(FeaturePacketMAC) {
+					ErrorF("拒绝客户端 name:%s addr:%s err:%v", packet.Name, remoteAddr.String(), ErrPacketMACRequired)
+					s.rejectClient(remoteAddr)
+					return
+				}
+				sign := s.connectSign(packet.Command, remoteAddr.String(), h)
+				kx := s.keyExchange(packet.Command, remoteAddr.String(), h, &sess)
+				macKey := s.issueMAC(packet.Command, remoteAddr.String(), h, &sess)
 				// 存储c端的连接
-				s.clientJoin(packet.Name, remoteAddr.IP.String(), remoteAddr)
-				// 下发签名
-				s.replyConnect(remoteAddr)
+				s.clientJoin(packet.Name, remoteAddr.IP.String(), remoteAddr, sess)
+				// 下发签名与认证密钥
+				s.replyConnect(remoteAddr, sess, sign, macKey, kx)
 
 			case CommandPut:
-				if !SignCheck(remoteAddr.String(), packet.Sign) {
-					s.ReplyPut(remoteAddr, 0, 1)
-				} else {
-					putData := &PutData{}
-					bErr := ByteToObj(packet.Data, &putData)
-					if bErr != nil {
-						Error("解析put err :", bErr)
+				putData := &PutData{}
+				bErr := EnvelopeDecode(packet.Data, putData)
+				if bErr != nil {
+					Error("解析put err :", bErr)
+				}
+				// 重复的包: 已处理完成的直接确认, 正在处理的等待第一次处理完成后确认
+				dedupKey := onLineKey(packet.Name, remoteAddr.IP.String())
+				state, resp := s.putDedup.begin(dedupKey, putData.Id)
+				switch state {
+				case dedupDone:
+					s.replyPutResponse(remoteAddr, putData.Id, resp)
+					return
+				case dedupRunning:
+					return
+				}
+				run := func() {
+					cInfo := &ClientInfo{
+						Name:        packet.Name,
+						Addr:        remoteAddr,
+						Interactive: time.Now().Unix(),
+						PacketSize:  n,
 					}
+					resp := PutResponse{}
 					if fn, ok := s.PutHandle[putData.Label]; ok {
-						cInfo := &ClientInfo{
-							Name:        packet.Name,
-							Addr:        remoteAddr,
-							Interactive: time.Now().Unix(),
-							PacketSize:  n,
-						}
 						fn(s, cInfo, putData.Body)
+					} else if fn, ok := s.PutReply[putData.Label]; ok {
+						resp.Code, resp.Data = fn(s, cInfo, putData.Body)
 					}
-					s.ReplyPut(remoteAddr, putData.Id, 0)
+					s.putDedup.finish(dedupKey, putData.Id, resp)
+					s.replyPutResponse(remoteAddr, putData.Id, resp)
+				}
+				// 有序的标签按序号依次执行
+				if putData.Seq > 0 && s.putOrder.ordered(putData.Label) {
+					s.putOrder.submit(dedupKey+"@"+putData.Label, putData, run)
+					return
 				}
+				run()
 
 			case CommandGet:
-				if !SignCheck(remoteAddr.String(), packet.Sign) {
-					s.ReplyPut(remoteAddr, 0, 1)
-				} else {
-					getData := &GetData{}
-					boErr := ByteToObj(packet.Data, &getData)
-					if boErr != nil {
-						Error("解析put err :", boErr)
-					}
-					if fn, ok := s.GetHandle[getData.Label]; ok {
-						code, rse := fn(s, getData.Param)
-						getData.Response = rse
-						gb, gbErr := ObjToByte(getData)
-						if gbErr != nil {
-							Error("对象转字节错误...")
-						}
-						s.ReplyGet(remoteAddr, getData.Id, code, gb)
+				getData := &GetData{}
+				boErr := EnvelopeDecode(packet.Data, getData)
+				if boErr != nil {
+					Error("解析put err :", boErr)
+				}
+				if fn, ok := s.GetHandle[getData.Label]; ok {
+					code, rse := fn(s, getData.Param)
+					getData.Response = rse
+					gb, gbErr := s.encode(remoteAddr, getData)
+					if gbErr != nil {
+						Error("对象转字节错误...")
 					}
+					s.ReplyGet(remoteAddr, getData.Id, code, gb)
 				}
 
 			case CommandNotice:
-				if !SignCheck(remoteAddr.String(), packet.Sign) {
-					s.ReplyPut(remoteAddr, 0, 1)
-				} else {
-					notice := &NoticeData{}
-					bErr := ByteToObj(packet.Data, &notice)
-					if bErr != nil {
-						Error("返回的包解析失败， err = ", bErr)
-					}
-					if v, ok := NoticeDataMap.Load(notice.Id); ok {
-						if v != nil {
-							v.(*NoticeData).ctxChan <- true
-						}
+				notice := &NoticeData{}
+				bErr := EnvelopeDecode(packet.Data, notice)
+				if bErr != nil {
+					Error("返回的包解析失败， err = ", bErr)
+				}
+				if v, ok := s.noticeMap.Load(notice.Id); ok {
+					if v != nil {
+						v.(*NoticeData).done()
 					}
 				}
 
 			case CommandReply:
-				if !SignCheck(remoteAddr.String(), packet.Sign) {
-					s.ReplyPut(remoteAddr, 0, 1)
-					break
-				}
 				reply := &Reply{}
-				bErr := ByteToObj(packet.Data, &reply)
+				bErr := EnvelopeDecode(packet.Data, reply)
 				if bErr != nil {
 					Error("返回的包解析失败， err = ", bErr)
 				}
@@ -207,14 +334,14 @@ func (s *Servers) Run() {
 				case CommandGet:
 					// InfoF("请求 ID: %d | StateCode: %d", reply.CtxId, reply.StateCode)
 					getData := &GetData{}
-					boErr := ByteToObj(reply.Data, &getData)
+					boErr := EnvelopeDecode(reply.Data, getData)
 					if boErr != nil {
 						Error("解析put err :", boErr)
 					}
-					getF, _ := GetDataMap.Load(getData.Id)
+					getF, _ := s.getDataMap.Load(getData.Id)
 					if getF != nil {
 						getF.(*GetData).Response = getData.Response
-						getF.(*GetData).ctxChan <- true
+						getF.(*GetData).done()
 					}
 				}
 
@@ -227,6 +354,42 @@ func (s *Servers) Run() {
 	}
 }
 
+// receive 解包并在交给处理方法前检查: 解密, 分片重组, 签名, 防重放
+// 签名通过后才更新防重放窗口, 伪造的包不会推进窗口; 返回的 n 为数据包的大小
+func (s *Servers) receive(remoteAddr *net.UDPAddr, data []byte, n int) (*Packet, int, bool) {
+	// 黑白名单与封禁的地址不解包
+	if !s.filter.check(remoteAddr.IP) {
+		return nil, n, false
+	}
+	//Info("解包....size = ", n)
+	packet, err := s.openPacket(remoteAddr.String(), data, n)
+	if err != nil {
+		Error("错误的包 err:", err)
+		return nil, n, false
+	}
+	// 分片包校验签名, 收齐后再处理
+	if packet.Command == CommandFragment {
+		if !s.signCheck(remoteAddr.String(), packet) {
+			s.ReplyPut(remoteAddr, 0, 1)
+			return nil, n, false
+		}
+		whole, ok := s.fragment.add(remoteAddr.String(), packet)
+		if !ok {
+			return nil, n, false
+		}
+		packet, n = whole, len(whole.Data)
+	}
+	// 除连接包和心跳包都会确认签名与c端名称
+	if replayProtected(packet.Command) && (!s.signCheck(remoteAddr.String(), packet) || !s.nameCheck(remoteAddr.String(), packet)) {
+		s.ReplyPut(remoteAddr, 0, 1)
+		return nil, n, false
+	}
+	if !s.replayCheck(remoteAddr.String(), packet) {
+		return nil, n, false
+	}
+	return packet, n, true
+}
+
 func (s *Servers) Write(client *net.UDPAddr, data []byte) {
 	_, err := s.Conn.WriteToUDP(data, client)
 	if err != nil {
@@ -234,6 +397,24 @@ func (s *Servers) Write(client *net.UDPAddr, data []byte) {
 	}
 }
 
+// writePacket 封包并发送，数据过大时分片发送
+func (s *Servers) writePacket(client *net.UDPAddr, cmd CommandCode, sign string, data []byte) {
+	sess, _ := s.clients.session(client.String())
+	packets, err := packetEncoderSplit(cmd, sess.Version, s.name, sign, s.sessionCipher(client.String(), sess), data)
+	if err != nil {
+		Error(err)
+		return
+	}
+	for _, packet := range sealPackets(sess.mac, packets) {
+		s.Write(client, packet)
+	}
+}
+
+// SetFragmentLimit 设置分片重组的超时时间，单条消息最大字节，占用的最大内存; 小于等于0的值不修改
+func (s *Servers) SetFragmentLimit(timeout time.Duration, maxMessage, maxMemory int) {
+	s.fragment.setLimit(timeout, maxMessage, maxMemory)
+}
+
 func (s *Servers) Get(funcLabel, name string, param []byte) ([]byte, error) {
 	return s.GetAtNameTimeOut(DefaultSGetTimeOut, funcLabel, name, param)
 }
@@ -250,39 +431,50 @@ func (s *Servers) GetAtIPTimeOut(timeOut int, funcLabel, name, ip string, param
 	return s.get(timeOut, funcLabel, name, ip, param)
 }
 
-// Get  向指定 client获取数据，  针对name,ip, 获取指定name或ip Client的数据
 func (s *Servers) get(timeOut int, funcLabel, name, ip string, param []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*time.Duration(timeOut))
+	defer cancel()
+	res, err := s.GetAtIPContext(ctx, funcLabel, name, ip, param)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, ErrSGetTimeOut(funcLabel, name, ip)
+	}
+	return res, err
+}
+
+// GetContext 同 Get, 由 ctx 控制超时与取消
+func (s *Servers) GetContext(ctx context.Context, funcLabel, name string, param []byte) ([]byte, error) {
+	return s.GetAtIPContext(ctx, funcLabel, name, "", param)
+}
+
+// GetAtIPContext  向指定 client获取数据，  针对name,ip, 获取指定name或ip Client的数据
+// ctx 取消或超时立即返回 ctx.Err() 包装的错误
+func (s *Servers) GetAtIPContext(ctx context.Context, funcLabel, name, ip string, param []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, ErrSGetCanceled(funcLabel, name, ip, err)
+	}
+	c, ok := s.GetClientConnFromIP(name, ip)
+	if !ok {
+		return nil, fmt.Errorf("客户端连接不存在")
+	}
 	getData := &GetData{
 		Label:    funcLabel,
 		Id:       id(),
 		Param:    param,
-		ctxChan:  make(chan bool),
+		ctxChan:  make(chan bool, 1),
 		Response: make([]byte, 0),
 	}
-	GetDataMap.Store(getData.Id, getData)
-	b, err := ObjToByte(getData)
+	s.getDataMap.Store(getData.Id, getData)
+	defer s.getDataMap.Delete(getData.Id)
+	b, err := s.encode(c, getData)
 	if err != nil {
 		Error("ObjToByte err = ", err)
 	}
-
-	c, ok := s.GetClientConnFromIP(name, ip)
-	if !ok {
-		return nil, fmt.Errorf("客户端连接不存在")
-	}
-	sign := SignGet(c.String())
-	packet, err := PacketEncoder(CommandGet, s.name, sign, s.secretKey, b)
-	if err != nil {
-		Error(err)
-	}
-	s.Write(c, packet)
+	s.writePacket(c, CommandGet, s.SignGet(c.String()), b)
 	select {
 	case <-getData.ctxChan:
-		res := getData.Response
-		GetDataMap.Delete(getData.Id)
-		return res, nil
-	case <-time.After(time.Millisecond * time.Duration(timeOut)):
-		GetDataMap.Delete(getData.Id)
-		return nil, ErrSGetTimeOut(funcLabel, name, ip)
+		return getData.Response, nil
+	case <-ctx.Done():
+		return nil, ErrSGetCanceled(funcLabel, name, ip, ctx.Err())
 	}
 }
 
@@ -313,12 +505,20 @@ func (s *Servers) NoticeAll(label string, data []byte, retryConf *NoticeRetry) {
 // Notice  通知方法:针对 name,对Client发送通知
 // 特点: 1. 重试次数 2. 指定时间内重试
 func (s *Servers) Notice(name, label string, data []byte, retryConf *NoticeRetry) (string, error) {
+	return s.NoticeContext(context.Background(), name, label, data, retryConf)
+}
+
+// NoticeContext 同 Notice, ctx 取消或超时停止重试并返回 ctx.Err() 包装的错误
+func (s *Servers) NoticeContext(ctx context.Context, name, label string, data []byte, retryConf *NoticeRetry) (string, error) {
 	if name == "" {
 		name = formatName(DefaultClientName)
 	}
 	if retryConf == nil {
 		retryConf = s.SetNoticeRetry(DefaultNoticeMaxRetry, DefaultNoticeRetryTimer)
 	}
+	if err := ctx.Err(); err != nil {
+		return "通知已取消", ErrNoticeCanceled(name, label, err)
+	}
 	// 直接下发消息，等待c端应答
 	client, ok := s.GetClientConn(name)
 	if !ok {
@@ -331,22 +531,19 @@ func (s *Servers) Notice(name, label string, data []byte, retryConf *NoticeRetry
 			Label:   label,
 			Id:      id(),
 			Data:    data,
-			ctxChan: make(chan bool),
+			ctxChan: make(chan bool, 1),
 		}
-		NoticeDataMap.Store(noticeData.Id, noticeData)
+		s.noticeMap.Store(noticeData.Id, noticeData)
 		packetMap[c.Addr] = noticeData
 		go func() {
-			for {
-				timer := time.NewTimer(retryConf.TimeOutTimer)
-				select {
-				case <-noticeData.ctxChan:
-					NoticeDataMap.Delete(noticeData.Id)
-					return
-				case <-timer.C: // 超过设定大于最大重试的时间，释放内存
-					NoticeDataMap.Delete(noticeData.Id)
-					return
-				}
+			timer := time.NewTimer(retryConf.TimeOutTimer)
+			defer timer.Stop()
+			select {
+			case <-noticeData.ctxChan:
+			case <-timer.C: // 超过设定大于最大重试的时间，释放内存
+			case <-ctx.Done():
 			}
+			s.noticeMap.Delete(noticeData.Id)
 		}()
 	}
 	if s.noticeSend(packetMap) {
@@ -366,6 +563,12 @@ func (s *Servers) Notice(name, label string, data []byte, retryConf *NoticeRetry
 				return "通知下发完成", nil
 			}
 			retry++
+		case <-ctx.Done():
+			timer.Stop()
+			for _, v := range packetMap {
+				s.noticeMap.Delete(v.Id)
+			}
+			return "通知已取消", ErrNoticeCanceled(name, label, ctx.Err())
 		}
 	}
 }
@@ -373,19 +576,14 @@ func (s *Servers) Notice(name, label string, data []byte, retryConf *NoticeRetry
 func (s *Servers) noticeSend(packetMap map[*net.UDPAddr]*NoticeData) bool {
 	finish := true
 	for cConn, v := range packetMap {
-		_, has := NoticeDataMap.Load(v.Id)
+		_, has := s.noticeMap.Load(v.Id)
 		if has {
 			finish = false
-			b, err := ObjToByte(v)
+			b, err := s.encode(cConn, v)
 			if err != nil {
 				Error("ObjToByte err = ", err)
 			}
-			sign := SignGet(cConn.String())
-			packet, err := PacketEncoder(CommandNotice, s.name, sign, s.secretKey, b)
-			if err != nil {
-				Error(err)
-			}
-			s.Write(cConn, packet)
+			s.writePacket(cConn, CommandNotice, s.SignGet(cConn.String()), b)
 		}
 	}
 	return finish
@@ -395,27 +593,51 @@ type Reply struct {
 	Type      int
 	CtxId     int64 // 数据包上下文的交互id
 	Data      []byte
-	StateCode int // 状态码  0:成功  1:认证失败  2:自定义错误
+	StateCode int // 状态码  0:成功  1:认证失败  2:自定义错误  3:协议版本不支持  4:凭证认证失败
 }
 
-func (s *Servers) replyConnect(client *net.UDPAddr) {
-	sign := createSign()
+// replyConnect 连接回应使用预共享秘钥加密, macKey 为下发的认证密钥, kx 为密钥交换的数据
+func (s *Servers) replyConnect(client *net.UDPAddr, sess session, sign string, macKey, kx []byte) {
 	reply := &Reply{
 		Type:      int(CommandConnect),
-		Data:      []byte(sign),
+		Data:      connectReplyData(sign, sess.Version, sess.Features, macKey, kx),
 		CtxId:     0,
 		StateCode: 0,
 	}
-	b, e := ObjToByte(reply)
+	b, e := s.encode(client, reply)
 	if e != nil {
 		Error(" e= ", e)
 	}
-	data, err := PacketEncoder(CommandReply, s.name, sign, s.secretKey, b)
+	data, err := PacketEncoderVersion(CommandReply, sess.Version, s.name, sign, s.addrCipher(client.String()), b)
 	if err != nil {
 		Error(err)
 	}
 	// 存储这个 sign  ip+port:sign
-	SignStore(client.String(), sign)
+	s.SignStore(client.String(), sign)
+	s.Write(client, data)
+}
+
+// replyVersion 回应不支持的协议版本, Data 为s端的协议版本
+func (s *Servers) replyVersion(client *net.UDPAddr) {
+	s.replyRefuse(client, StateCodeVersion, []byte{ProtocolVersion})
+}
+
+// replyRefuse 拒绝连接, 使用所有版本都能识别的旧版包头与 JSON 信封
+func (s *Servers) replyRefuse(client *net.UDPAddr, stateCode int, data []byte) {
+	reply := &Reply{
+		Type:      int(CommandConnect),
+		Data:      data,
+		StateCode: stateCode,
+	}
+	b, e := envelopeEncode(reply, true)
+	if e != nil {
+		Error("打包数据失败, e= ", e)
+	}
+	data, err := PacketEncoder(CommandReply, s.name, "", s.addrCipher(client.String()), b)
+	if err != nil {
+		Error(err)
+		return
+	}
 	s.Write(client, data)
 }
 
@@ -428,16 +650,36 @@ func (s *Servers) ReplyPut(client *net.UDPAddr, id, state int64) {
 		Data:      stateB,
 		StateCode: int(state),
 	}
-	b, e := ObjToByte(reply)
+	b, e := s.encode(client, reply)
 	if e != nil {
 		Error("打包数据失败, e= ", e)
 	}
-	sign := SignGet(client.String())
-	data, err := PacketEncoder(CommandReply, s.name, sign, s.secretKey, b)
+	s.writePacket(client, CommandReply, s.SignGet(client.String()), b)
+}
+
+// replyPutResponse 确认Put, 协商了 FeaturePutResponse 的c端携带处理方法的应答
+func (s *Servers) replyPutResponse(client *net.UDPAddr, id int64, resp PutResponse) {
+	sess, _ := s.clients.session(client.String())
+	if !sess.Features.Has(FeaturePutResponse) {
+		s.ReplyPut(client, id, 0)
+		return
+	}
+	data, err := s.encode(client, &resp)
 	if err != nil {
-		Error(err)
+		Error("打包数据失败, e= ", err)
+		return
 	}
-	s.Write(client, data)
+	reply := &Reply{
+		Type:  int(CommandPut),
+		CtxId: id,
+		Data:  data,
+	}
+	b, err := s.encode(client, reply)
+	if err != nil {
+		Error("打包数据失败, e= ", err)
+		return
+	}
+	s.writePacket(client, CommandReply, s.SignGet(client.String()), b)
 }
 
 // ReplyGet 返回put  state:0x0 成功   state:0x1 签名失败  state:2 业务层面的失败
@@ -448,16 +690,11 @@ func (s *Servers) ReplyGet(client *net.UDPAddr, id int64, state int, data []byte
 		Data:      data,
 		StateCode: state,
 	}
-	b, e := ObjToByte(reply)
+	b, e := s.encode(client, reply)
 	if e != nil {
 		Error("打包数据失败, e= ", e)
 	}
-	sign := SignGet(client.String())
-	data, err := PacketEncoder(CommandReply, s.name, sign, s.secretKey, b)
-	if err != nil {
-		Error(err)
-	}
-	s.Write(client, data)
+	s.writePacket(client, CommandReply, s.SignGet(client.String()), b)
 }
 
 func (s *Servers) DefaultServersName() {
@@ -470,13 +707,26 @@ func (s *Servers) DefaultConnectCode() {
 
 func (s *Servers) DefaultSecretKey() {
 	s.secretKey = DefaultSecretKey
+	s.cipher, _ = NewCipher(CipherAES256GCM, s.secretKey)
 }
 
 func (s *Servers) PutHandleFunc(label string, f func(s *Servers, c *ClientInfo, body []byte)) {
-	if _, ok := s.PutHandle[label]; ok {
+	s.putHandleExist(label)
+	s.PutHandle[label] = f
+}
+
+// PutReplyHandleFunc 注册带应答的PUT方法, 返回的 code 与 data 随确认包返回c端, c端通过 PutSyncResponse 或 PutFuture.Response 获取
+func (s *Servers) PutReplyHandleFunc(label string, f func(s *Servers, c *ClientInfo, body []byte) (int, []byte)) {
+	s.putHandleExist(label)
+	s.PutReply[label] = f
+}
+
+func (s *Servers) putHandleExist(label string) {
+	_, put := s.PutHandle[label]
+	_, reply := s.PutReply[label]
+	if put || reply {
 		PanicPutHandleFuncExist(label)
 	}
-	s.PutHandle[label] = f
 }
 
 func (s *Servers) GetHandleFunc(label string, f func(s *Servers, param []byte) (int, []byte)) {
@@ -490,60 +740,35 @@ func (s *Servers) GetServersName() string {
 	return s.name
 }
 
-func (s *Servers) clientJoin(name, ip string, addr *net.UDPAddr) {
-	client := &ClientConnectObj{
-		IP:   ip,
-		Addr: addr,
-		Last: time.Now().Unix(),
+func (s *Servers) clientJoin(name, ip string, addr *net.UDPAddr, sess session) {
+	info, event := s.clients.join(name, ip, addr, sess)
+	if event != clientEventNone {
+		InfoF("客户端上线 名称:%s 地址:%s", info.Name, info.Addr)
+		s.emitClientEvent(event, info)
 	}
-	if _, ok := s.CMap[name]; !ok {
-		s.CMap[name] = make(map[string]*ClientConnectObj)
-	}
-	s.CMap[name][addr.String()] = client
-	s.onLineTable[fmt.Sprintf("%s@%s", name, ip)] = &ClientConnInfo{
-		Name:        name,
-		Online:      true,
-		IP:          ip,
-		Addr:        addr.String(),
-		LastTime:    time.Now().Unix(),
-		DiscardTime: 0,
-	}
-	return
 }
 
+// ClientDiscard 移除 name 下指定 ip 的连接, ip 为空时移除 name 下所有连接
 func (s *Servers) ClientDiscard(name, ip string) {
 	if name == "" {
-		name = formatName(DefaultClientName)
+		name = DefaultClientName
 	}
-	if v, ok := s.CMap[name]; ok {
-		for k, c := range v {
-			Info(k, c.IP, ip)
-			delete(v, k)
-		}
-		if clientConnInfo := s.onLineTable[fmt.Sprintf("%s@%s", name, ip)]; clientConnInfo != nil {
-			clientConnInfo.Online = false
-			clientConnInfo.DiscardTime = time.Now().Unix()
-		}
+	for _, c := range s.clients.discard(formatName(name), ip) {
+		InfoF("移除客户端 名称:%s IP地址:%s", c.Name, c.IP)
+		s.emitClientEvent(clientEventOffline, c)
 	}
 }
 
 func (s *Servers) GetClientAllName() []string {
-	nameList := make([]string, 0)
-	for name, _ := range s.CMap {
-		nameList = append(nameList, name)
-	}
-	return nameList
+	return s.clients.names()
 }
 
+// GetClientConn 获取 name 下的所有连接, 返回的是副本
 func (s *Servers) GetClientConn(name string) (map[string]*ClientConnectObj, bool) {
 	if name == "" {
 		name = DefaultClientName
 	}
-	name = formatName(name)
-	if v, ok := s.CMap[name]; ok && len(v) > 0 {
-		return v, true
-	}
-	return nil, false
+	return s.clients.connList(formatName(name))
 }
 
 func (s *Servers) GetClientConnFromIP(name, ip string) (*net.UDPAddr, bool) {
@@ -568,30 +793,59 @@ func (s *Servers) timeWheel() {
 			select {
 			case <-timer.C:
 				t := time.Now().Unix()
-				for k, v := range s.CMap {
-					for _, c := range v {
-						if t-c.Last > HeartbeatTimeLast { // 这个时间要大于5秒，因为来自c端的心跳就是5秒
-							InfoF("离线服务器名称:%s IP地址:%s  当前t=%d last=%d", k, c.IP, t, c.Last)
-							s.ClientDiscard(k, c.IP)
-						} else {
-							//InfoF("在线服务器名称:%s IP地址:%s  当前t=%d last=%d", k, c.IP, t, c.Last)
-						}
-					}
+				// 这个时间要大于5秒，因为来自c端的心跳就是5秒
+				for _, c := range s.clients.discardExpired(t - HeartbeatTimeLast) {
+					InfoF("离线服务器名称:%s IP地址:%s  当前t=%d last=%d", c.Name, c.IP, t, c.LastTime)
+					s.emitClientEvent(clientEventOffline, c)
 				}
+				s.replay.sweep()
+				s.putDedup.sweep()
+				s.putOrder.sweep()
+				s.filter.sweep()
+			case <-s.closer.closing:
+				timer.Stop()
+				return
 			}
 		}
 	}()
 }
 
-// OnLineTable 获取当前客户端连接情况
-func (s *Servers) OnLineTable() map[string]*ClientConnInfo {
-	return s.onLineTable
+// Shutdown 优雅关闭: 停止接收数据包与时间轮, 等待正在执行的处理方法结束后关闭连接
+// ctx 超时或取消时不再等待处理方法, 关闭连接并返回 ctx.Err()
+func (s *Servers) Shutdown(ctx context.Context) error {
+	s.closer.close()
+	// 让阻塞的读取立即返回, 连接保留给处理方法发送应答
+	_ = s.Conn.SetReadDeadline(time.Now())
+	err := s.closer.wait(ctx)
+	s.putDedup.close()
+	if cErr := s.Conn.Close(); cErr != nil && err == nil {
+		err = cErr
+	}
+	return err
+}
+
+// OnLineTable 获取当前客户端连接情况, 返回的是副本 key= name@ip
+func (s *Servers) OnLineTable() map[string]ClientConnInfo {
+	return s.clients.snapshot()
 }
 
-// TODO ... 拒绝指定客户端的通讯
+// GetClientConnInfo 获取指定 name, ip 客户端的连接情况
+func (s *Servers) GetClientConnInfo(name, ip string) (ClientConnInfo, bool) {
+	if name == "" {
+		name = DefaultClientName
+	}
+	return s.clients.connInfo(formatName(name), ip)
+}
 
+// ClientConnectObj 客户端连接, 存入连接表后不再修改
 type ClientConnectObj struct {
-	IP   string
-	Addr *net.UDPAddr
-	Last int64 // 最后一次连接的时间
+	IP       string
+	Addr     *net.UDPAddr
+	Last     int64   // 最后一次连接的时间
+	Version  uint8   // 协商的协议版本
+	Features Feature // 协商的特性
+	name     string  // 认证通过的c端名称
+
+	keys *sessionKeys // 密钥交换的会话密钥
+	mac  *packetMAC   // 包认证密钥
 }
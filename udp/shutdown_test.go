@@ -0,0 +1,194 @@
+package udp
+
+import (
+	"context"
+	"encoding"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// sendPacket 由 peer 向 dst 发送一个包, 版本0使用旧版包头与 JSON 信封
+func sendPacket(t *testing.T, peer *net.UDPConn, dst *net.UDPAddr, cmd CommandCode, version uint8, sign string, cipher Cipher, obj encoding.BinaryMarshaler) {
+	t.Helper()
+	b, err := envelopeEncode(obj, version == 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, err := PacketEncoderVersion(cmd, version, "c1", sign, cipher, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = peer.WriteToUDP(packet, dst); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readCommand 读取 peer 收到的包直到出现 cmd
+func readCommand(peer *net.UDPConn, cipher Cipher, cmd CommandCode) bool {
+	buf := make([]byte, ReadBufferSize)
+	_ = peer.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		n, _, err := peer.ReadFromUDP(buf)
+		if err != nil {
+			return false
+		}
+		if p, err := PacketDecrypt(cipher, buf, n); err == nil && p.Command == cmd {
+			return true
+		}
+	}
+}
+
+// blockingServers 运行一个 Put 处理方法会阻塞到 release 关闭的s端, 返回 Run 结束的信号
+func blockingServers(t *testing.T, entered chan struct{}, release chan struct{}) (*Servers, *net.UDPConn, chan struct{}) {
+	t.Helper()
+	s, err := NewServers("127.0.0.1", 0, ServersConf{SecretKey: "shutdown-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.PutHandleFunc("slow", func(s *Servers, c *ClientInfo, body []byte) {
+		close(entered)
+		<-release
+	})
+	stopped := make(chan struct{})
+	go func() {
+		s.Run()
+		close(stopped)
+	}()
+	peer := silentPeer(t)
+	sign := createSign()
+	s.clients.join(formatName("c1"), "127.0.0.1", peer.LocalAddr().(*net.UDPAddr), session{})
+	s.SignStore(peer.LocalAddr().String(), sign)
+	sendPacket(t, peer, s.Conn.LocalAddr().(*net.UDPAddr), CommandPut, 0, sign, s.cipher, &PutData{Label: "slow", Id: 1})
+	select {
+	case <-entered:
+	case <-time.After(3 * time.Second):
+		t.Fatal("put handler not called")
+	}
+	return s, peer, stopped
+}
+
+func TestServersShutdownDrain(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	s, peer, stopped := blockingServers(t, entered, release)
+
+	result := make(chan error, 1)
+	go func() { result <- s.Shutdown(context.Background()) }()
+	select {
+	case err := <-result:
+		t.Fatalf("Shutdown returned %v while a handler was running", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Shutdown did not return after the handler finished")
+	}
+	// 处理方法结束后的应答仍然发出
+	if !readCommand(peer, s.cipher, CommandReply) {
+		t.Fatal("put reply not sent before shutdown")
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return")
+	}
+}
+
+func TestServersShutdownContext(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	s, _, stopped := blockingServers(t, entered, release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return")
+	}
+}
+
+// blockingClient c端连接到 peer, peer 下发通知, 通知处理方法阻塞到 release 关闭
+func blockingClient(t *testing.T, entered chan struct{}, release chan struct{}) (*Client, *net.UDPConn, chan struct{}) {
+	t.Helper()
+	peer := silentPeer(t)
+	c, err := NewClient(peer.LocalAddr().String(), ClientConf{Name: "c1", SecretKey: "shutdown-test", BacklogDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.NoticeHandleFunc("slow", func(c *Client, data []byte) {
+		close(entered)
+		<-release
+	})
+	stopped := make(chan struct{})
+	go func() {
+		c.Serve()
+		close(stopped)
+	}()
+	// 通知需要通过会话认证, 使用连接回应下发的签名
+	c.setSign("sign001")
+	dst := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: c.Conn.LocalAddr().(*net.UDPAddr).Port}
+	sendPacket(t, peer, dst, CommandNotice, 0, "sign001", c.cipher, &NoticeData{Label: "slow", Id: 1})
+	select {
+	case <-entered:
+	case <-time.After(3 * time.Second):
+		t.Fatal("notice handler not called")
+	}
+	return c, peer, stopped
+}
+
+func TestClientShutdownDrain(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	c, peer, stopped := blockingClient(t, entered, release)
+
+	result := make(chan error, 1)
+	go func() { result <- c.Shutdown(context.Background()) }()
+	select {
+	case err := <-result:
+		t.Fatalf("Shutdown returned %v while a handler was running", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Shutdown did not return after the handler finished")
+	}
+	if !readCommand(peer, c.cipher, CommandNotice) {
+		t.Fatal("notice ack not sent before shutdown")
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return")
+	}
+}
+
+func TestClientShutdownContext(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	c, _, stopped := blockingClient(t, entered, release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return")
+	}
+}
@@ -1,8 +1,8 @@
 package udp
 
 import (
+	crand "crypto/rand"
 	"math/rand"
-	"sync"
 	"time"
 )
 
@@ -10,30 +10,31 @@ func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
+// createSign 旧版的签名, 未协商 FeaturePacketMAC 的c端使用, 见 mac.go
 func createSign() string {
 	b := make([]byte, 7)
+	_, _ = crand.Read(b)
 	for i := range b {
-		b[i] = SignLetterBytes[rand.Intn(len(SignLetterBytes))]
+		b[i] = SignLetterBytes[int(b[i])%len(SignLetterBytes)]
 	}
 	return string(b)
 }
 
-var signMap sync.Map
-
-func SignStore(addr, sign string) {
-	signMap.Store(addr, sign)
+// SignStore 存储下发给 addr 的签名
+func (s *Servers) SignStore(addr, sign string) {
+	s.signMap.Store(addr, sign)
 }
 
-func SignCheck(addr, sign string) bool {
-	v, ok := signMap.Load(addr)
+func (s *Servers) SignCheck(addr, sign string) bool {
+	v, ok := s.signMap.Load(addr)
 	if ok && v.(string) == sign {
 		return true
 	}
 	return false
 }
 
-func SignGet(addr string) string {
-	v, ok := signMap.Load(addr)
+func (s *Servers) SignGet(addr string) string {
+	v, ok := s.signMap.Load(addr)
 	if !ok {
 		return ""
 	}
@@ -0,0 +1,148 @@
+package udp
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+/*
+
+Client 连接状态
+
+1. Disconnected -> Connecting : NewClient/ConnectServers 发送连接请求
+2. Connecting   -> Connected  : 收到连接回应，未收到回应时按退避时间重试
+3. Connected    -> ServerLost : 超过 ServersLostTime 未收到s端的包，或读取时连接异常(如端口不可达)
+4. ServerLost   -> Connected  : 按退避时间重连，收到连接回应
+5. 任意状态      -> Disconnected : Shutdown
+6. Connecting/Connected/ServerLost -> Rejected : s端拒绝认证(StateCodeAuth)，凭证不正确或已被吊销
+7. Rejected     -> Connected  : 按退避时间重试，s端更新凭证后收到连接回应
+
+*/
+
+// ClientState 客户端连接状态
+type ClientState int
+
+const (
+	StateDisconnected ClientState = iota // 未连接
+	StateConnecting                      // 已发送连接请求，等待s端回应
+	StateConnected                       // 连接成功
+	StateServerLost                      // 连接成功后s端失去响应，正在重连
+	StateRejected                        // s端拒绝认证，按退避时间重试
+)
+
+func (state ClientState) String() string {
+	switch state {
+	case StateDisconnected:
+		return "Disconnected"
+	case StateConnecting:
+		return "Connecting"
+	case StateConnected:
+		return "Connected"
+	case StateServerLost:
+		return "ServerLost"
+	case StateRejected:
+		return "Rejected"
+	}
+	return "unknown"
+}
+
+// Backoff 连接/重连的指数退避, 零值字段使用默认值
+type Backoff struct {
+	Min    time.Duration // 首次重试的等待时间 默认1s
+	Max    time.Duration // 最大等待时间 默认30s
+	Factor float64       // 每次重试等待时间的倍数 默认2
+	Jitter float64       // 随机抖动比例 0~1 默认0.2, 避免大量客户端同时重连
+}
+
+func (b Backoff) withDefault() Backoff {
+	if b.Min <= 0 {
+		b.Min = DefaultBackoffMin * time.Millisecond
+	}
+	if b.Max < b.Min {
+		b.Max = DefaultBackoffMax * time.Millisecond
+		if b.Max < b.Min {
+			b.Max = b.Min
+		}
+	}
+	if b.Factor < 1 {
+		b.Factor = DefaultBackoffFactor
+	}
+	if b.Jitter <= 0 || b.Jitter > 1 {
+		b.Jitter = DefaultBackoffJitter
+	}
+	return b
+}
+
+// next 第 attempt 次(从0开始)重试前的等待时间
+func (b Backoff) next(attempt int) time.Duration {
+	d := float64(b.Min) * math.Pow(b.Factor, float64(attempt))
+	if d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	d += d * b.Jitter * (rand.Float64()*2 - 1)
+	return time.Duration(d)
+}
+
+// State 当前连接状态
+func (c *Client) State() ClientState {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	return c.state
+}
+
+// OnStateChange 注册连接状态变化的回调, 回调按变化顺序在独立的goroutine中执行
+func (c *Client) OnStateChange(f func(c *Client, from, to ClientState)) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	c.onStateChange = f
+}
+
+// SetBackoff 设置连接/重连的指数退避
+func (c *Client) SetBackoff(b Backoff) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	c.backoff = b.withDefault()
+}
+
+func (c *Client) getBackoff() Backoff {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	return c.backoff
+}
+
+// setState 切换状态, from 不为空时只有当前状态在 from 中才切换
+func (c *Client) setState(to ClientState, from ...ClientState) bool {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	if c.state == to {
+		return false
+	}
+	if len(from) > 0 {
+		match := false
+		for _, f := range from {
+			if c.state == f {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return false
+		}
+	}
+	prev := c.state
+	c.state = to
+	InfoF("连接状态 %s -> %s", prev, to)
+	// 唤醒时间轮按新的状态重新计时
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	if c.onStateChange != nil {
+		fn := c.onStateChange
+		c.stateNotify.push(func() {
+			fn(c, prev, to)
+		})
+	}
+	return true
+}
@@ -0,0 +1,152 @@
+package udp
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+type transition struct {
+	from ClientState
+	to   ClientState
+}
+
+func TestBackoffDefault(t *testing.T) {
+	b := Backoff{}.withDefault()
+	if b.Min != DefaultBackoffMin*time.Millisecond || b.Max != DefaultBackoffMax*time.Millisecond ||
+		b.Factor != DefaultBackoffFactor || b.Jitter != DefaultBackoffJitter {
+		t.Fatalf("defaults %+v", b)
+	}
+	// Max 小于 Min 时不小于 Min
+	b = Backoff{Min: time.Minute, Max: time.Second}.withDefault()
+	if b.Max != time.Minute {
+		t.Fatalf("max %s, want %s", b.Max, time.Minute)
+	}
+}
+
+func TestBackoffNextBounds(t *testing.T) {
+	b := Backoff{Min: 100 * time.Millisecond, Max: 2 * time.Second, Factor: 2, Jitter: 0.2}.withDefault()
+	base := b.Min
+	for attempt := 0; attempt < 40; attempt++ {
+		if base > b.Max {
+			base = b.Max
+		}
+		lo := time.Duration(float64(base) * (1 - b.Jitter))
+		hi := time.Duration(float64(base) * (1 + b.Jitter))
+		for i := 0; i < 20; i++ {
+			if d := b.next(attempt); d < lo || d > hi {
+				t.Fatalf("attempt %d: %s not in [%s, %s]", attempt, d, lo, hi)
+			}
+		}
+		base *= 2
+	}
+}
+
+func TestClientSetState(t *testing.T) {
+	c := &Client{wake: make(chan struct{}, 1)}
+	events := make(chan transition, 8)
+	c.OnStateChange(func(c *Client, from, to ClientState) {
+		events <- transition{from: from, to: to}
+	})
+	steps := []struct {
+		to   ClientState
+		from []ClientState
+		want bool
+	}{
+		{StateConnecting, []ClientState{StateDisconnected}, true},
+		{StateConnecting, nil, false}, // 状态不变
+		{StateServerLost, []ClientState{StateConnected}, false},
+		{StateConnected, nil, true},
+		{StateServerLost, []ClientState{StateConnected}, true},
+		{StateConnecting, []ClientState{StateDisconnected}, false},
+		{StateConnected, nil, true},
+		{StateDisconnected, nil, true},
+	}
+	for i, v := range steps {
+		if got := c.setState(v.to, v.from...); got != v.want {
+			t.Fatalf("step %d: setState(%s) = %v, want %v", i, v.to, got, v.want)
+		}
+	}
+	want := []transition{
+		{StateDisconnected, StateConnecting},
+		{StateConnecting, StateConnected},
+		{StateConnected, StateServerLost},
+		{StateServerLost, StateConnected},
+		{StateConnected, StateDisconnected},
+	}
+	for i, w := range want {
+		select {
+		case ev := <-events:
+			if ev != w {
+				t.Fatalf("event %d: %s -> %s, want %s -> %s", i, ev.from, ev.to, w.from, w.to)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %d not delivered", i)
+		}
+	}
+}
+
+// s端不回应时按退避时间重发连接包
+func TestClientConnectRetry(t *testing.T) {
+	peer := silentPeer(t)
+	c, err := NewClient(peer.LocalAddr().String(), ClientConf{Name: "c1", SecretKey: "state-test", BacklogDir: t.TempDir(),
+		Backoff: Backoff{Min: 20 * time.Millisecond, Max: 40 * time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.State() != StateConnecting {
+		t.Fatalf("state %s after NewClient", c.State())
+	}
+	go c.Serve()
+	defer func() { _ = c.Shutdown(context.Background()) }()
+	for i := 0; i < 3; i++ {
+		if !readCommand(peer, c.cipher, CommandConnect) {
+			t.Fatalf("connect packet %d not sent", i)
+		}
+	}
+	if c.State() != StateConnecting {
+		t.Fatalf("state %s without a reply", c.State())
+	}
+}
+
+func TestClientStateLifecycle(t *testing.T) {
+	peer := silentPeer(t)
+	c, err := NewClient(peer.LocalAddr().String(), ClientConf{Name: "c1", SecretKey: "state-test", BacklogDir: t.TempDir(),
+		Backoff: Backoff{Min: time.Minute}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan transition, 8)
+	c.OnStateChange(func(c *Client, from, to ClientState) {
+		events <- transition{from: from, to: to}
+	})
+	go c.Serve()
+
+	// 回应连接包
+	if !readCommand(peer, c.cipher, CommandConnect) {
+		t.Fatal("connect packet not sent")
+	}
+	dst := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: c.Conn.LocalAddr().(*net.UDPAddr).Port}
+	sendPacket(t, peer, dst, CommandReply, ProtocolVersion, "", c.cipher,
+		&Reply{Type: int(CommandConnect), Data: connectReplyData("sign123", ProtocolVersion, 0, nil, nil)})
+	select {
+	case ev := <-events:
+		if ev.from != StateConnecting || ev.to != StateConnected {
+			t.Fatalf("%s -> %s, want Connecting -> Connected", ev.from, ev.to)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("connect event not delivered")
+	}
+	if err = c.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ev := <-events:
+		if ev.from != StateConnected || ev.to != StateDisconnected {
+			t.Fatalf("%s -> %s, want Connected -> Disconnected", ev.from, ev.to)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("shutdown event not delivered")
+	}
+}
@@ -0,0 +1,466 @@
+package udp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+
+积压数据的预写日志(WAL): Put 时追加写入, 收到s端确认时追加确认记录, 启动时回放恢复未确认的数据
+
+目录: <BacklogDir>/<客户端名称@服务端地址>/<段序号>.wal
+
+记录
+___________________________________________________________________________
+|              |                    |             |                        |
+| 长度(4字节)   | crc32c(4字节)       | 类型(1字节)  |       内容...           |
+|______________|____________________|_____________|________________________|
+
+长度: 类型+内容的长度; crc32c: 类型+内容的校验
+类型: 1 写入, 内容为 写入序号(uvarint) + PutData 二进制信封; 2 确认, 内容为 PutData.Id(varint)
+
+1. 段文件超过 segmentSize 后切换到新的段, 只追加不修改
+2. 回放时最后一个段末尾不完整或校验失败的记录(写入中断)被截断, 之前的段遇到损坏的记录跳过该段剩余部分
+3. 确认记录只会出现在对应写入记录的同一段或之后的段, 所以只删除从最旧开始全部已确认的段
+4. 段数量超过 WALMaxSegments 且最旧段中已确认的过半时, 将其中未确认的数据按写入序号重新写入当前段, 然后删除最旧段
+   重新写入的记录保留原来的写入序号, 回放按写入序号排列, 与 Put 的顺序一致
+5. 刷盘策略见 WALSyncPolicy, 写入都会立即进入操作系统, 进程崩溃不丢数据; 刷盘只影响断电
+
+*/
+
+// WALSyncPolicy WAL 刷盘策略
+type WALSyncPolicy int
+
+const (
+	WALSyncInterval WALSyncPolicy = iota // 每 WALSyncIntervalTime 刷盘一次, 默认
+	WALSyncAlways                        // 每条记录写入后刷盘
+	WALSyncNever                         // 不主动刷盘, 由操作系统决定
+)
+
+const (
+	walRecordAdd byte = 1
+	walRecordAck byte = 2
+
+	walHeadSize   = 8
+	walMaxRecord  = 64 << 20
+	walFileSuffix = ".wal"
+)
+
+var walCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type walSegment struct {
+	seq   uint64
+	total int // 写入记录数量
+	live  int // 未确认的写入记录数量
+}
+
+func (s *walSegment) fileName(dir string) string {
+	return filepath.Join(dir, fmt.Sprintf("%016d%s", s.seq, walFileSuffix))
+}
+
+type wal struct {
+	lock        sync.Mutex
+	dir         string
+	policy      WALSyncPolicy
+	segmentSize int64
+	segments    []*walSegment         // 按序号排列, 最后一个是当前写入的段
+	location    map[int64]*walSegment // PutData.Id -> 写入记录所在的段
+	order       map[int64]uint64      // PutData.Id -> 写入序号
+	next        uint64                // 下一个写入序号
+	file        *os.File              // 当前写入的段
+	size        int64                 // 当前段的大小
+	dirty       bool                  // 有未刷盘的写入
+	lookup      func(id int64) (PutData, bool)
+	stop        chan struct{}
+	closed      bool
+}
+
+// openWAL 打开目录下的 WAL, 回放返回未确认的数据(按写入顺序); lookup 用于压缩时获取未确认的数据
+func openWAL(dir string, policy WALSyncPolicy, lookup func(id int64) (PutData, bool)) (*wal, []PutData, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+	w := &wal{
+		dir:         dir,
+		policy:      policy,
+		segmentSize: WALSegmentSize,
+		location:    make(map[int64]*walSegment),
+		order:       make(map[int64]uint64),
+		lookup:      lookup,
+		stop:        make(chan struct{}),
+	}
+	pending, err := w.replay()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = w.openCurrent(); err != nil {
+		return nil, nil, err
+	}
+	w.removeAcked()
+	if policy == WALSyncInterval {
+		go w.syncLoop()
+	}
+	return w, pending, nil
+}
+
+// replay 按顺序回放所有段
+func (w *wal) replay() ([]PutData, error) {
+	files, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+	seqs := make([]uint64, 0, len(files))
+	for _, f := range files {
+		var seq uint64
+		if f.IsDir() || !strings.HasSuffix(f.Name(), walFileSuffix) {
+			continue
+		}
+		if _, err := fmt.Sscanf(f.Name(), "%016d.wal", &seq); err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	data := make(map[int64]PutData)
+	for i, seq := range seqs {
+		seg := &walSegment{seq: seq}
+		w.segments = append(w.segments, seg)
+		last := i == len(seqs)-1
+		err := w.replaySegment(seg, last, func(kind byte, payload []byte) {
+			switch kind {
+			case walRecordAdd:
+				order, putData, err := decodeWALAdd(payload)
+				if err != nil {
+					Error("WAL 记录解析失败 err:", err)
+					return
+				}
+				if old, ok := w.location[putData.Id]; ok {
+					old.live--
+				}
+				data[putData.Id] = putData
+				w.location[putData.Id] = seg
+				w.order[putData.Id] = order
+				if order >= w.next {
+					w.next = order + 1
+				}
+				seg.total++
+				seg.live++
+			case walRecordAck:
+				id, n := binary.Varint(payload)
+				if n <= 0 {
+					return
+				}
+				if loc, ok := w.location[id]; ok {
+					loc.live--
+					delete(w.location, id)
+					delete(w.order, id)
+					delete(data, id)
+				}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	pending := make([]PutData, 0, len(data))
+	for _, putData := range data {
+		pending = append(pending, putData)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return w.order[pending[i].Id] < w.order[pending[j].Id]
+	})
+	return pending, nil
+}
+
+// replaySegment 回放一个段, 最后一个段末尾损坏的记录被截断
+func (w *wal) replaySegment(seg *walSegment, last bool, apply func(kind byte, payload []byte)) error {
+	name := seg.fileName(w.dir)
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		kind, payload, n, rErr := readWALRecord(reader)
+		if rErr == io.EOF {
+			break
+		}
+		if rErr != nil {
+			ErrorF("WAL 记录损坏 file:%s offset:%d err:%v", name, offset, rErr)
+			_ = file.Close()
+			if last {
+				// 写入中断的记录, 截断后继续追加
+				return os.Truncate(name, offset)
+			}
+			return nil
+		}
+		apply(kind, payload)
+		offset += n
+	}
+	return file.Close()
+}
+
+// readWALRecord 读取一条记录, 返回类型, 内容与记录的总长度
+func readWALRecord(r io.Reader) (byte, []byte, int64, error) {
+	head := make([]byte, walHeadSize)
+	n, err := io.ReadFull(r, head)
+	if err == io.EOF {
+		return 0, nil, 0, io.EOF
+	}
+	if err != nil {
+		return 0, nil, 0, ErrWALRecord
+	}
+	length := binary.BigEndian.Uint32(head[0:4])
+	sum := binary.BigEndian.Uint32(head[4:8])
+	if length < 1 || length > walMaxRecord {
+		return 0, nil, 0, ErrWALRecord
+	}
+	body := make([]byte, length)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return 0, nil, 0, ErrWALRecord
+	}
+	if crc32.Checksum(body, walCrcTable) != sum {
+		return 0, nil, 0, ErrWALRecord
+	}
+	return body[0], body[1:], int64(n) + int64(length), nil
+}
+
+func encodeWALRecord(kind byte, payload []byte) []byte {
+	record := make([]byte, walHeadSize+1+len(payload))
+	body := record[walHeadSize:]
+	body[0] = kind
+	copy(body[1:], payload)
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(body, walCrcTable))
+	return record
+}
+
+// encodeWALAdd 写入记录的内容: 写入序号 + PutData 二进制信封
+func encodeWALAdd(order uint64, putData *PutData) ([]byte, error) {
+	payload, err := putData.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return append(binary.AppendUvarint(nil, order), payload...), nil
+}
+
+func decodeWALAdd(payload []byte) (uint64, PutData, error) {
+	putData := PutData{}
+	order, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return 0, putData, ErrWALRecord
+	}
+	err := putData.UnmarshalBinary(payload[n:])
+	return order, putData, err
+}
+
+// openCurrent 打开最后一个段继续写入, 没有段或已写满时创建新的段
+func (w *wal) openCurrent() error {
+	if n := len(w.segments); n > 0 {
+		seg := w.segments[n-1]
+		info, err := os.Stat(seg.fileName(w.dir))
+		if err != nil {
+			return err
+		}
+		if info.Size() < w.segmentSize {
+			file, err := os.OpenFile(seg.fileName(w.dir), os.O_APPEND|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			w.file, w.size = file, info.Size()
+			return nil
+		}
+	}
+	return w.rotate()
+}
+
+// rotate 切换到新的段, 调用方持有锁
+func (w *wal) rotate() error {
+	var seq uint64 = 1
+	if n := len(w.segments); n > 0 {
+		seq = w.segments[n-1].seq + 1
+	}
+	if w.file != nil {
+		if err := w.file.Sync(); err != nil {
+			return err
+		}
+		if err := w.file.Close(); err != nil {
+			return err
+		}
+	}
+	seg := &walSegment{seq: seq}
+	file, err := os.OpenFile(seg.fileName(w.dir), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w.segments = append(w.segments, seg)
+	w.file, w.size, w.dirty = file, 0, false
+	return nil
+}
+
+// write 追加一条记录, 调用方持有锁
+func (w *wal) write(kind byte, payload []byte) error {
+	if w.closed {
+		return ErrBacklogClosed
+	}
+	record := encodeWALRecord(kind, payload)
+	if w.size > 0 && w.size+int64(len(record)) > w.segmentSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err := w.file.Write(record); err != nil {
+		// 去掉写入了一部分的记录, 避免之后的记录在回放时被截断
+		_ = w.file.Truncate(w.size)
+		return err
+	}
+	w.size += int64(len(record))
+	if w.policy == WALSyncAlways {
+		return w.file.Sync()
+	}
+	w.dirty = true
+	return nil
+}
+
+// append 写入一条积压数据
+func (w *wal) append(putData *PutData) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	payload, err := encodeWALAdd(w.next, putData)
+	if err != nil {
+		return err
+	}
+	if err = w.write(walRecordAdd, payload); err != nil {
+		return err
+	}
+	if old, ok := w.location[putData.Id]; ok {
+		old.live--
+	}
+	seg := w.segments[len(w.segments)-1]
+	w.location[putData.Id] = seg
+	w.order[putData.Id] = w.next
+	w.next++
+	seg.total++
+	seg.live++
+	return nil
+}
+
+// ack 写入确认记录, 清理全部已确认的段
+func (w *wal) ack(id int64) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	seg, ok := w.location[id]
+	if !ok {
+		return nil
+	}
+	if err := w.write(walRecordAck, binary.AppendVarint(nil, id)); err != nil {
+		return err
+	}
+	delete(w.location, id)
+	delete(w.order, id)
+	seg.live--
+	w.removeAcked()
+	// 最旧段中未确认的数据过半时不压缩, 避免积压期间反复搬运
+	if oldest := w.segments[0]; len(w.segments) > WALMaxSegments && oldest.live*2 <= oldest.total {
+		w.compact()
+	}
+	return nil
+}
+
+// removeAcked 从最旧的段开始删除全部已确认的段, 当前写入的段不删除, 调用方持有锁
+func (w *wal) removeAcked() {
+	for len(w.segments) > 1 && w.segments[0].live <= 0 {
+		if err := os.Remove(w.segments[0].fileName(w.dir)); err != nil && !os.IsNotExist(err) {
+			Error("WAL 删除段失败 err:", err)
+			return
+		}
+		w.segments = w.segments[1:]
+	}
+}
+
+// compact 将最旧段中未确认的数据按写入序号重新写入当前段, 然后删除最旧段, 调用方持有锁
+func (w *wal) compact() {
+	oldest := w.segments[0]
+	ids := make([]int64, 0, oldest.live)
+	for id, seg := range w.location {
+		if seg == oldest {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return w.order[ids[i]] < w.order[ids[j]] })
+	for _, id := range ids {
+		putData, ok := w.lookup(id)
+		if !ok {
+			continue
+		}
+		payload, err := encodeWALAdd(w.order[id], &putData)
+		if err != nil {
+			Error(err)
+			return
+		}
+		if err = w.write(walRecordAdd, payload); err != nil {
+			Error("WAL 压缩失败 err:", err)
+			return
+		}
+		current := w.segments[len(w.segments)-1]
+		w.location[id] = current
+		current.total++
+		current.live++
+		oldest.live--
+	}
+	// 重新写入的数据需要先落盘再删除旧的段
+	if err := w.file.Sync(); err != nil {
+		Error("WAL 压缩失败 err:", err)
+		return
+	}
+	w.dirty = false
+	w.removeAcked()
+}
+
+func (w *wal) syncLoop() {
+	ticker := time.NewTicker(WALSyncIntervalTime * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.lock.Lock()
+			if w.dirty && !w.closed {
+				if err := w.file.Sync(); err != nil {
+					Error("WAL 刷盘失败 err:", err)
+				}
+				w.dirty = false
+			}
+			w.lock.Unlock()
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// close 刷盘并关闭, 重复调用无影响
+func (w *wal) close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	close(w.stop)
+	err := w.file.Sync()
+	if cErr := w.file.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
@@ -0,0 +1,245 @@
+package udp
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func openTestBacklog(t *testing.T, dir string) *walBacklog {
+	t.Helper()
+	b, err := NewWALBacklog(dir, WALSyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.(*walBacklog)
+}
+
+func addIds(t *testing.T, b BacklogStore, ids ...int64) {
+	t.Helper()
+	for _, id := range ids {
+		if err := b.Add(PutData{Label: "wal", Id: id, Body: []byte("body")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// replayIds 重新打开 WAL, 返回按写入顺序恢复的 id
+func replayIds(t *testing.T, dir string) []int64 {
+	t.Helper()
+	w, pending, err := openWAL(dir, WALSyncNever, func(int64) (PutData, bool) { return PutData{}, false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = w.close()
+	}()
+	ids := make([]int64, 0, len(pending))
+	for _, putData := range pending {
+		if putData.Label != "wal" || string(putData.Body) != "body" {
+			t.Fatalf("recovered %+v", putData)
+		}
+		ids = append(ids, putData.Id)
+	}
+	return ids
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"+walFileSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestWALReopen(t *testing.T) {
+	dir := t.TempDir()
+	b := openTestBacklog(t, dir)
+	addIds(t, b, 1, 2, 3, 4, 5)
+	_ = b.Ack(2)
+	_ = b.Ack(4)
+	_ = b.Close()
+	if got := replayIds(t, dir); !reflect.DeepEqual(got, []int64{1, 3, 5}) {
+		t.Fatalf("got %v", got)
+	}
+}
+
+// 写入中断的记录在启动时被截断, 之后追加的记录不受影响
+func TestWALTornTail(t *testing.T) {
+	dir := t.TempDir()
+	b := openTestBacklog(t, dir)
+	addIds(t, b, 1, 2, 3)
+	_ = b.Close()
+	name := segmentFiles(t, dir)[0]
+	info, _ := os.Stat(name)
+	payload, _ := encodeWALAdd(4, &PutData{Label: "wal", Id: 4, Body: []byte("body")})
+	record := encodeWALRecord(walRecordAdd, payload)
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write(record[:len(record)/2])
+	_ = f.Close()
+
+	if got := replayIds(t, dir); !reflect.DeepEqual(got, []int64{1, 2, 3}) {
+		t.Fatalf("got %v", got)
+	}
+	if after, _ := os.Stat(name); after.Size() != info.Size() {
+		t.Fatalf("torn tail not truncated: %d, want %d", after.Size(), info.Size())
+	}
+	b = openTestBacklog(t, dir)
+	addIds(t, b, 5)
+	_ = b.Close()
+	if got := replayIds(t, dir); !reflect.DeepEqual(got, []int64{1, 2, 3, 5}) {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestWALChecksum(t *testing.T) {
+	dir := t.TempDir()
+	b := openTestBacklog(t, dir)
+	addIds(t, b, 1, 2, 3)
+	_ = b.Close()
+	name := segmentFiles(t, dir)[0]
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err = os.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := replayIds(t, dir); !reflect.DeepEqual(got, []int64{1, 2}) {
+		t.Fatalf("got %v", got)
+	}
+}
+
+// 之前的段中损坏的记录跳过该段剩余部分, 之后的段正常回放
+func TestWALCorruptOlderSegment(t *testing.T) {
+	dir := t.TempDir()
+	b := openTestBacklog(t, dir)
+	b.wal.segmentSize = 1 // 每条记录一个段
+	addIds(t, b, 1, 2, 3, 4)
+	_ = b.Close()
+	files := segmentFiles(t, dir)
+	if len(files) != 4 {
+		t.Fatalf("got %d segments", len(files))
+	}
+	data, _ := os.ReadFile(files[1])
+	data[walHeadSize] ^= 0xff
+	_ = os.WriteFile(files[1], data, 0644)
+	if got := replayIds(t, dir); !reflect.DeepEqual(got, []int64{1, 3, 4}) {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestWALRemoveAcked(t *testing.T) {
+	dir := t.TempDir()
+	b := openTestBacklog(t, dir)
+	b.wal.segmentSize = 1
+	addIds(t, b, 1, 2, 3)
+	first := segmentFiles(t, dir)[0]
+	_ = b.Ack(3)
+	if _, err := os.Stat(first); err != nil {
+		t.Fatal("oldest segment removed while it has live data")
+	}
+	_ = b.Ack(1)
+	if _, err := os.Stat(first); !os.IsNotExist(err) {
+		t.Fatal("fully acked oldest segment kept")
+	}
+	_ = b.Ack(2)
+	_ = b.Close()
+	if n := len(segmentFiles(t, dir)); n != 1 {
+		t.Fatalf("%d segments left after acking everything", n)
+	}
+	if got := replayIds(t, dir); len(got) != 0 {
+		t.Fatalf("got %v", got)
+	}
+}
+
+// 段数量超过 WALMaxSegments 时压缩最旧的段, 其中未确认的数据重新写入, 回放的顺序不变
+func TestWALCompact(t *testing.T) {
+	dir := t.TempDir()
+	b := openTestBacklog(t, dir)
+	payload, _ := encodeWALAdd(1<<20, &PutData{Label: "wal", Id: 1 << 20, Body: []byte("body")})
+	b.wal.segmentSize = int64(4 * len(encodeWALRecord(walRecordAdd, payload)))
+	// id 与写入顺序相反, 压缩按 id 或 map 的顺序写入时回放的顺序会变
+	total := int64(4 * (WALMaxSegments + 2))
+	for id := total; id >= 1; id-- {
+		addIds(t, b, id)
+	}
+	first := segmentFiles(t, dir)[0]
+	_ = b.Ack(total)
+	_ = b.Ack(total - 2)
+	if _, err := os.Stat(first); !os.IsNotExist(err) {
+		t.Fatal("oldest segment not compacted")
+	}
+	want := []int64{total - 1, total - 3}
+	for id := total - 4; id >= 1; id-- {
+		want = append(want, id)
+	}
+	_ = b.Close()
+	if got := replayIds(t, dir); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	// 压缩后继续写入的数据在最后
+	b = openTestBacklog(t, dir)
+	addIds(t, b, total+1)
+	_ = b.Close()
+	if got := replayIds(t, dir); !reflect.DeepEqual(got, append(want, total+1)) {
+		t.Fatalf("got %v after reopen", got)
+	}
+}
+
+// WAL 写入失败时数据不积压
+func TestWALAddFailure(t *testing.T) {
+	b := openTestBacklog(t, t.TempDir())
+	addIds(t, b, 1)
+	_ = b.Close()
+	if err := b.Add(PutData{Id: 2}); err == nil {
+		t.Fatal("add after the WAL closed succeeded")
+	}
+	if b.Len() != 1 {
+		t.Fatalf("len %d, want 1", b.Len())
+	}
+	if _, ok := b.get(2); ok {
+		t.Fatal("failed add kept in memory")
+	}
+}
+
+// 写入过程中进程被 kill, 重新打开后恢复连续的写入
+func TestWALCrash(t *testing.T) {
+	if dir := os.Getenv("BT_WAL_CRASH_DIR"); dir != "" {
+		b := openTestBacklog(t, dir)
+		for id := int64(1); ; id++ {
+			addIds(t, b, id)
+		}
+	}
+	if testing.Short() {
+		t.Skip("subprocess test")
+	}
+	dir := t.TempDir()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestWALCrash$")
+	cmd.Env = append(os.Environ(), "BT_WAL_CRASH_DIR="+dir)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	_ = cmd.Process.Kill()
+	_ = cmd.Wait()
+	got := replayIds(t, dir)
+	if len(got) == 0 {
+		t.Fatal("nothing recovered")
+	}
+	for i, id := range got {
+		if id != int64(i+1) {
+			t.Fatalf("position %d recovered id %d", i, id)
+		}
+	}
+}